@@ -0,0 +1,96 @@
+package app
+
+import (
+	"net/http"
+	"time"
+
+	ginjwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+
+	"github.com/mercedtime/api/audit"
+	"github.com/mercedtime/api/users"
+)
+
+// The account operations of the REST routes for handlers
+// that do not use them, like the graphql mutations.
+
+// OptionalAuth is the jwt middleware for routes that can be
+// used without logging in. Requests with a valid token get an
+// identity, requests without a token are let through without one.
+func (a *App) OptionalAuth(c *gin.Context) {
+	if a.auth == nil {
+		c.Next()
+		return
+	}
+	claims, err := a.auth.GetClaimsFromJWT(c)
+	switch err {
+	case nil:
+	case ginjwt.ErrEmptyAuthHeader, ginjwt.ErrEmptyQueryToken, ginjwt.ErrEmptyCookieToken:
+		c.Next()
+		return
+	default:
+		a.auth.Unauthorized(c, http.StatusUnauthorized, err.Error())
+		return
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok || int64(exp) < a.auth.TimeFunc().Unix() {
+		a.auth.Unauthorized(c, http.StatusUnauthorized, ginjwt.ErrExpiredToken.Error())
+		return
+	}
+	c.Set("JWT_PAYLOAD", claims)
+	// Disabled users and users that need a new
+	// password are not treated as anonymous.
+	u, ok := a.identityHandler(c).(*users.User)
+	if !ok || u.ResetRequired {
+		a.auth.Unauthorized(c, http.StatusForbidden, ginjwt.ErrForbidden.Error())
+		return
+	}
+	c.Set(a.jwtIdentidyKey, u)
+	c.Next()
+}
+
+// Identity returns the user that made the request as it
+// was in the database when the request started.
+func (a *App) Identity(c *gin.Context) (*users.User, bool) {
+	return getIdentity(a.jwtIdentidyKey, c)
+}
+
+// Login checks a user's password and returns a new token.
+func (a *App) Login(c *gin.Context, name, password string) (*users.User, string, time.Time, error) {
+	u, err := a.checkLogin(c, name, password)
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+	token, expire, err := a.token(c, u)
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+	a.auditAs(c, &u.ID, audit.Login, userTarget(u.ID))
+	return u, token, expire, nil
+}
+
+// Signup creates a new user and returns a token for them.
+func (a *App) Signup(c *gin.Context, u *users.User, password string) (string, time.Time, error) {
+	_, err := a.newUser(u, password)
+	switch {
+	case err == nil:
+	case isConflict(err):
+		return "", time.Time{}, errUserConflict
+	case err == users.ErrInvalidUser:
+		return "", time.Time{}, ErrStatus(400, "must give a username or email")
+	default:
+		return "", time.Time{}, err
+	}
+	a.auditAs(c, &u.ID, audit.Signup, userTarget(u.ID))
+	return a.token(c, u)
+}
+
+// DeleteUser deletes a user on behalf of
+// the user that made the request.
+func (a *App) DeleteUser(c *gin.Context, id int) error {
+	if err := users.Delete(a.DB, users.User{ID: id}); err != nil {
+		return err
+	}
+	a.audit(c, audit.UserDelete, userTarget(id))
+	return nil
+}
@@ -0,0 +1,190 @@
+package app
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+
+	"github.com/mercedtime/api/audit"
+	"github.com/mercedtime/api/users"
+)
+
+const defaultLockDuration = time.Hour * 24
+
+// adminGroup returns the router group for the
+// admin only user management routes.
+func (a *App) adminGroup(g *gin.RouterGroup) *gin.RouterGroup {
+	admin := g.Group("/admin", a.Protected, a.adminOnly)
+	admin.GET("/users", listParamsMiddleware, a.adminListUsers)
+	admin.POST("/users", a.adminCreateUser)
+	admin.GET("/audit", a.queryAuditLog)
+
+	u := admin.Group("/users/:id", idParamMiddleware)
+	u.GET("", a.adminGetUser)
+	u.DELETE("", a.notSelf("delete"), a.audited(audit.AdminUserDelete), a.deleteUser)
+	u.POST("/promote", a.audited(audit.AdminPromote), a.adminSetAdmin(true))
+	u.POST("/demote", a.notSelf("demote"), a.audited(audit.AdminDemote), a.adminSetAdmin(false))
+	u.POST("/disable", a.notSelf("disable"), a.audited(audit.AdminDisable), a.adminUpdate(users.Disable))
+	u.POST("/enable", a.audited(audit.AdminEnable), a.adminUpdate(users.Enable))
+	u.POST("/lock", a.notSelf("lock"), a.audited(audit.AdminLock), a.adminLock)
+	u.POST("/unlock", a.audited(audit.AdminUnlock), a.adminUpdate(users.Unlock))
+	u.POST("/reset-password", a.audited(audit.AdminResetPassword), a.adminResetPassword)
+	return admin
+}
+
+// adminOnly checks the database to make sure that the user
+// is still an admin. The token claims may be out of date.
+func (a *App) adminOnly(c *gin.Context) {
+	self, ok := getIdentity(a.jwtIdentidyKey, c)
+	if !ok {
+		c.AbortWithStatusJSON(401, &Error{"no identity", 401})
+		return
+	}
+	u, err := users.GetUserByID(a.DB, self.ID)
+	if err != nil || !u.IsAdmin || u.Disabled() {
+		c.AbortWithStatusJSON(403, &Error{"forbidden", 403})
+		return
+	}
+	c.Next()
+}
+
+// notSelf stops admins from doing things to their own
+// account that could leave the api without an admin.
+func (a *App) notSelf(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := getSelfID(a.jwtIdentidyKey, c)
+		if err != nil {
+			c.AbortWithStatusJSON(401, &Error{"no identity", 401})
+			return
+		}
+		if id == c.GetInt("id") {
+			c.AbortWithStatusJSON(400, &Error{"admins cannot " + action + " themselves", 400})
+			return
+		}
+		c.Next()
+	}
+}
+
+// UserList is a page of users.
+type UserList struct {
+	Users []*users.User `json:"users"`
+	Total int           `json:"total"`
+}
+
+func (a *App) adminListUsers(c *gin.Context) {
+	var (
+		list UserList
+		err  error
+		p    = users.SearchParams{Query: c.Query("q")}
+	)
+	if limit, ok := c.Get("limit"); ok && limit != nil {
+		l := limit.(uint)
+		p.Limit = &l
+	}
+	if offset, ok := c.Get("offset"); ok && offset != nil {
+		o := offset.(uint)
+		p.Offset = &o
+	}
+	list.Users, list.Total, err = users.Search(a.DB, p)
+	if err != nil {
+		senderr(c, err, 500)
+		return
+	}
+	c.JSON(200, &list)
+}
+
+func (a *App) adminCreateUser(c *gin.Context) {
+	var body struct {
+		Name     string `json:"name"`
+		Email    string `json:"email"`
+		Password string `json:"password" binding:"required"`
+		IsAdmin  bool   `json:"is_admin"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.AbortWithStatusJSON(400, &Error{"could not read request body", 400})
+		return
+	}
+	u := users.User{Name: body.Name, Email: body.Email, IsAdmin: body.IsAdmin}
+	_, err := a.CreateUser(&u, body.Password)
+	if isConflict(err) {
+		c.AbortWithStatusJSON(409, errUserConflict)
+		return
+	}
+	switch err {
+	case nil:
+		a.audit(c, audit.AdminUserCreate, userTarget(u.ID))
+		c.JSON(201, &u)
+	case users.ErrInvalidUser:
+		c.AbortWithStatusJSON(400, &Error{"must give a username or email", 400})
+	default:
+		senderr(c, err, 500)
+	}
+}
+
+func (a *App) adminGetUser(c *gin.Context) {
+	u, err := users.GetUserByID(a.DB, c.GetInt("id"))
+	if err != nil {
+		senderr(c, users.ErrUserNotFound, 404)
+		return
+	}
+	c.JSON(200, u)
+}
+
+func (a *App) adminSetAdmin(admin bool) gin.HandlerFunc {
+	return a.adminUpdate(func(db *sqlx.DB, id int) error {
+		return users.SetAdmin(db, id, admin)
+	})
+}
+
+// adminUpdate runs an update on the user from the url
+// parameters and responds with the updated user.
+func (a *App) adminUpdate(update func(*sqlx.DB, int) error) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch err := update(a.DB, c.GetInt("id")); err {
+		case nil:
+			a.adminGetUser(c)
+		case users.ErrUserNotFound:
+			senderr(c, err, 404)
+		default:
+			senderr(c, err, 500)
+		}
+	}
+}
+
+func (a *App) adminLock(c *gin.Context) {
+	var body struct {
+		Duration string `json:"duration"`
+	}
+	duration := defaultLockDuration
+	if c.Request.ContentLength > 0 {
+		if err := c.BindJSON(&body); err != nil {
+			c.AbortWithStatusJSON(400, &Error{"could not read request body", 400})
+			return
+		}
+	}
+	if body.Duration != "" {
+		d, err := time.ParseDuration(body.Duration)
+		if err != nil || d <= 0 {
+			c.AbortWithStatusJSON(400, &Error{"invalid lock duration", 400})
+			return
+		}
+		duration = d
+	}
+	a.adminUpdate(func(db *sqlx.DB, id int) error {
+		return users.Lock(db, id, time.Now().Add(duration))
+	})(c)
+}
+
+func (a *App) adminResetPassword(c *gin.Context) {
+	password, err := users.ForcePasswordReset(a.DB, c.GetInt("id"))
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{"temporary_password": password})
+	case users.ErrUserNotFound:
+		senderr(c, err, 404)
+	default:
+		senderr(c, err, 500)
+	}
+}
@@ -0,0 +1,222 @@
+package app
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ulule/limiter/v3"
+	ginlimit "github.com/ulule/limiter/v3/drivers/middleware/gin"
+
+	"github.com/mercedtime/api/users"
+)
+
+const (
+	apiKeyHeader = "X-API-Key"
+	apiKeyQuery  = "api_key"
+
+	defaultAPIKeyRateLimit  = 10
+	defaultAPIKeyDailyQuota = 10000
+)
+
+// RateLimit returns a middleware that limits anonymous clients by ip
+// address and limits clients that give an api key using the limits
+// stored with that key.
+func (a *App) RateLimit(anonymous limiter.Rate) gin.HandlerFunc {
+	anon := ginlimit.NewMiddleware(limiter.New(a.RateStore, anonymous))
+	return func(c *gin.Context) {
+		raw := apiKeyFromRequest(c)
+		if raw == "" {
+			anon(c)
+			return
+		}
+		key, err := users.GetAPIKey(a.DB, raw)
+		switch err {
+		case nil:
+			break
+		case users.ErrAPIKeyNotFound:
+			c.AbortWithStatusJSON(401, &Error{"invalid api key", 401})
+			return
+		default:
+			senderr(c, err, 500)
+			return
+		}
+		rate, err := a.RateStore.Get(c, apiKeyRateKey(key), apiKeyRate(key))
+		if err != nil {
+			senderr(c, err, 500)
+			return
+		}
+		c.Header("X-RateLimit-Limit", strconv.FormatInt(rate.Limit, 10))
+		c.Header("X-RateLimit-Remaining", strconv.FormatInt(rate.Remaining, 10))
+		c.Header("X-RateLimit-Reset", strconv.FormatInt(rate.Reset, 10))
+		if rate.Reached {
+			c.AbortWithStatusJSON(429, &Error{"rate limit exceeded", 429})
+			return
+		}
+		quota, err := a.RateStore.Get(c, apiKeyQuotaKey(key), apiKeyQuota(key))
+		if err != nil {
+			senderr(c, err, 500)
+			return
+		}
+		c.Header("X-Quota-Limit", strconv.FormatInt(quota.Limit, 10))
+		c.Header("X-Quota-Remaining", strconv.FormatInt(quota.Remaining, 10))
+		c.Header("X-Quota-Reset", strconv.FormatInt(quota.Reset, 10))
+		if quota.Reached {
+			c.AbortWithStatusJSON(429, &Error{"daily quota exceeded", 429})
+			return
+		}
+		c.Set("api-key", key)
+		c.Next()
+	}
+}
+
+func apiKeyFromRequest(c *gin.Context) string {
+	if key := c.GetHeader(apiKeyHeader); key != "" {
+		return key
+	}
+	return c.Query(apiKeyQuery)
+}
+
+func apiKeyRateKey(k *users.APIKey) string {
+	return "apikey:rate:" + strconv.Itoa(k.ID)
+}
+
+func apiKeyQuotaKey(k *users.APIKey) string {
+	return "apikey:quota:" + strconv.Itoa(k.ID)
+}
+
+func apiKeyRate(k *users.APIKey) limiter.Rate {
+	return limiter.Rate{Period: time.Second, Limit: k.RateLimit}
+}
+
+func apiKeyQuota(k *users.APIKey) limiter.Rate {
+	return limiter.Rate{Period: time.Hour * 24, Limit: k.DailyQuota}
+}
+
+func (a *App) apiKeyLimits() (rate, quota int64) {
+	rate, quota = a.Config.APIKeys.RateLimit, a.Config.APIKeys.DailyQuota
+	if rate <= 0 {
+		rate = defaultAPIKeyRateLimit
+	}
+	if quota <= 0 {
+		quota = defaultAPIKeyDailyQuota
+	}
+	return rate, quota
+}
+
+func (a *App) createAPIKey(c *gin.Context) {
+	var body struct {
+		Name       string `json:"name" binding:"required"`
+		RateLimit  int64  `json:"rate_limit"`
+		DailyQuota int64  `json:"daily_quota"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.AbortWithStatusJSON(400, &Error{"api keys need a name", 400})
+		return
+	}
+	// Users may ask for lower limits than the defaults but
+	// only admins can give out keys with higher limits.
+	rate, quota := a.apiKeyLimits()
+	admin := isAdmin(a.jwtIdentidyKey, c)
+	if body.RateLimit > 0 && (body.RateLimit < rate || admin) {
+		rate = body.RateLimit
+	}
+	if body.DailyQuota > 0 && (body.DailyQuota < quota || admin) {
+		quota = body.DailyQuota
+	}
+	key := users.APIKey{
+		UserID:     c.GetInt("id"),
+		Name:       body.Name,
+		RateLimit:  rate,
+		DailyQuota: quota,
+	}
+	raw, err := users.CreateAPIKey(a.DB, &key)
+	if err != nil {
+		senderr(c, err, 500)
+		return
+	}
+	c.JSON(201, gin.H{
+		"key":     raw,
+		"api_key": key,
+	})
+}
+
+func (a *App) listAPIKeys(c *gin.Context) {
+	keys, err := users.GetAPIKeys(a.DB, c.GetInt("id"))
+	if err != nil {
+		senderr(c, err, 500)
+		return
+	}
+	c.JSON(200, keys)
+}
+
+func (a *App) revokeAPIKey(c *gin.Context) {
+	keyID, err := strconv.Atoi(c.Param("key"))
+	if err != nil {
+		c.AbortWithStatusJSON(400, &Error{"key id is not a number", 400})
+		return
+	}
+	switch err = users.RevokeAPIKey(a.DB, c.GetInt("id"), keyID); err {
+	case nil:
+		c.JSON(200, &Msg{Msg: "api key revoked", Status: 200})
+	case users.ErrAPIKeyNotFound:
+		senderr(c, err, 404)
+	default:
+		senderr(c, err, 500)
+	}
+}
+
+// APIKeyUsage is the number of requests made with an
+// api key within the current rate limit periods.
+type APIKeyUsage struct {
+	ID     int        `json:"id"`
+	Name   string     `json:"name"`
+	Prefix string     `json:"prefix"`
+	Rate   UsageCount `json:"rate"`
+	Quota  UsageCount `json:"quota"`
+}
+
+// UsageCount is the number of requests made in one period.
+type UsageCount struct {
+	Limit    int64 `json:"limit"`
+	Requests int64 `json:"requests"`
+	Reset    int64 `json:"reset"`
+}
+
+func (a *App) apiKeyUsage(c *gin.Context) {
+	keys, err := users.GetAPIKeys(a.DB, c.GetInt("id"))
+	if err != nil {
+		senderr(c, err, 500)
+		return
+	}
+	resp := make([]APIKeyUsage, 0, len(keys))
+	for _, k := range keys {
+		rate, err := a.RateStore.Peek(c, apiKeyRateKey(k), apiKeyRate(k))
+		if err != nil {
+			senderr(c, err, 500)
+			return
+		}
+		quota, err := a.RateStore.Peek(c, apiKeyQuotaKey(k), apiKeyQuota(k))
+		if err != nil {
+			senderr(c, err, 500)
+			return
+		}
+		resp = append(resp, APIKeyUsage{
+			ID:     k.ID,
+			Name:   k.Name,
+			Prefix: k.Prefix,
+			Rate:   usageCount(rate),
+			Quota:  usageCount(quota),
+		})
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func usageCount(ctx limiter.Context) UsageCount {
+	return UsageCount{
+		Limit:    ctx.Limit,
+		Requests: ctx.Limit - ctx.Remaining,
+		Reset:    ctx.Reset,
+	}
+}
@@ -1,15 +1,18 @@
 package app
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	ginjwt "github.com/appleboy/gin-jwt/v2"
 	"github.com/gin-gonic/gin"
 	"github.com/jmoiron/sqlx"
+	"github.com/mercedtime/api/audit"
 	apidb "github.com/mercedtime/api/db"
 	"github.com/mercedtime/api/db/models"
 	"github.com/mercedtime/api/users"
@@ -27,8 +30,12 @@ type App struct {
 	Engine    *gin.Engine
 	RateStore limiter.Store
 	Protected gin.HandlerFunc
+	Mailer    Mailer
+	Audit     *audit.Log
+	Hub       *Hub
 
 	jwtIdentidyKey string
+	auth           *ginjwt.GinJWTMiddleware
 }
 
 // New creates a new app
@@ -38,15 +45,25 @@ func New(conf *Config) (*App, error) {
 		return nil, err
 	}
 	apidb.Set(db)
+	if conf.Auth.BcryptCost != 0 {
+		if err = users.SetCost(conf.Auth.BcryptCost); err != nil {
+			return nil, err
+		}
+	}
 	a := &App{
 		DB:     db,
 		Config: conf,
+		Mailer: NewMailer(conf.Mail),
+		Audit:  audit.New(db),
 	}
 	if conf.InMemoryRateStore {
 		a.RateStore = memory.NewStore()
 	} else {
 		return nil, errors.New("don't know how to create rate limit storage")
 	}
+	if a.Hub, err = newHub(conf, db); err != nil {
+		return nil, err
+	}
 	return a, nil
 }
 
@@ -171,6 +188,10 @@ func (a *App) NewJWTAuth() (*ginjwt.GinJWTMiddleware, error) {
 					"expire": expire.Format(time.RFC3339),
 				}
 			)
+			if u, ok := c.Get(loginUserKey); ok {
+				id := u.(*users.User).ID
+				a.auditAs(c, &id, audit.Login, userTarget(id))
+			}
 			if u, ok := c.Get("new-user"); ok {
 				resp["code"] = http.StatusCreated
 				resp["user"] = u
@@ -179,14 +200,105 @@ func (a *App) NewJWTAuth() (*ginjwt.GinJWTMiddleware, error) {
 				c.JSON(http.StatusOK, resp)
 			}
 		},
+		RefreshResponse: func(c *gin.Context, code int, token string, expire time.Time) {
+			a.auditToken(c, audit.TokenRefresh, token)
+			c.JSON(http.StatusOK, gin.H{
+				"code":   http.StatusOK,
+				"token":  token,
+				"expire": expire.Format(time.RFC3339),
+			})
+		},
 	})
 	if err != nil {
 		return nil, err
 	}
 	a.Protected = middleware.MiddlewareFunc()
+	a.auth = middleware
 	return middleware, nil
 }
 
+// login will issue a token to the user in the same
+// way that the login handler does.
+func (a *App) login(c *gin.Context, u *users.User) {
+	token, expire, err := a.token(c, u)
+	switch err {
+	case nil:
+	case users.ErrUserDisabled, users.ErrUserLocked:
+		a.auth.Unauthorized(c, http.StatusForbidden, err.Error())
+		return
+	default:
+		a.auth.Unauthorized(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.Set(loginUserKey, u)
+	a.auth.LoginResponse(c, http.StatusOK, token, expire)
+}
+
+// RefreshToken issues a new token for the user of a token that
+// can still be refreshed. Unlike the refresh handler from ginjwt the
+// user is loaded again so that disabled users are cut off and the
+// new token has the user's current claims.
+func (a *App) RefreshToken(c *gin.Context) {
+	claims, err := a.auth.CheckIfTokenExpire(c)
+	if err != nil {
+		a.auth.Unauthorized(c, http.StatusUnauthorized, a.auth.HTTPStatusMessageFunc(err, c))
+		return
+	}
+	id, ok := claims[a.jwtIdentidyKey].(float64)
+	if !ok {
+		a.auth.Unauthorized(c, http.StatusUnauthorized, ginjwt.ErrFailedAuthentication.Error())
+		return
+	}
+	u, err := users.GetUserByID(a.DB, int(id))
+	if err != nil {
+		a.auth.Unauthorized(c, http.StatusUnauthorized, ginjwt.ErrFailedAuthentication.Error())
+		return
+	}
+	if u.Disabled() {
+		a.auth.Unauthorized(c, http.StatusForbidden, users.ErrUserDisabled.Error())
+		return
+	}
+	token, expire, err := a.issueToken(c, u)
+	if err != nil {
+		a.auth.Unauthorized(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	a.auth.RefreshResponse(c, http.StatusOK, token, expire)
+}
+
+// token creates a token for the user and sets the token
+// cookie like the login handler does.
+func (a *App) token(c *gin.Context, u *users.User) (string, time.Time, error) {
+	if err := canLogin(u); err != nil {
+		return "", time.Time{}, err
+	}
+	return a.issueToken(c, u)
+}
+
+// issueToken creates a token and sets the cookie
+// without checking if the user can log in.
+func (a *App) issueToken(c *gin.Context, u *users.User) (string, time.Time, error) {
+	if a.auth == nil {
+		return "", time.Time{}, errors.New("jwt auth is not set up")
+	}
+	token, expire, err := a.auth.TokenGenerator(u)
+	if err != nil {
+		return "", time.Time{}, ginjwt.ErrFailedTokenCreation
+	}
+	if a.auth.SendCookie {
+		c.SetCookie(
+			a.auth.CookieName,
+			token,
+			int(a.auth.CookieMaxAge.Seconds()),
+			"/",
+			a.auth.CookieDomain,
+			a.auth.SecureCookie,
+			a.auth.CookieHTTPOnly,
+		)
+	}
+	return token, expire, nil
+}
+
 func (a *App) authenticate(c *gin.Context) (interface{}, error) {
 	newuser, ok := c.Get("new-user")
 	if ok && newuser != nil {
@@ -201,14 +313,74 @@ func (a *App) authenticate(c *gin.Context) (interface{}, error) {
 	if err != nil {
 		return nil, ginjwt.ErrMissingLoginValues
 	}
-	u, err := users.GetUserByName(a.DB, l.Name)
+	u, err := a.checkLogin(c, l.Name, l.Password)
+	if err != nil {
+		return nil, err
+	}
+	c.Set(loginUserKey, u)
+	return u, nil
+}
+
+// checkLogin checks a user's password. Failed logins are
+// counted against the client and the user, successful ones
+// should be audited once the token is sent.
+func (a *App) checkLogin(c *gin.Context, name, password string) (*users.User, error) {
+	u, err := users.GetUserByName(a.DB, name)
 	if err != nil {
+		if a.loginBlocked(c) {
+			a.auditAs(c, nil, audit.LoginThrottled, "name:"+name)
+			return nil, errTooManyLogins
+		}
+		a.auditAs(c, nil, audit.LoginFailed, "name:"+name)
+		a.loginFailed(c, nil)
 		return nil, ginjwt.ErrFailedAuthentication
 	}
-	if u.PasswordOK(l.Password) {
-		return u, nil
+	if err = a.checkPassword(c, u, password); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// checkPassword checks the password of a user that has already
+// been found. The client's throttle and the user's lock are checked
+// first so that guessing is useless while either is in place.
+func (a *App) checkPassword(c *gin.Context, u *users.User, password string) error {
+	if a.loginBlocked(c) {
+		a.auditAs(c, nil, audit.LoginThrottled, userTarget(u.ID))
+		return errTooManyLogins
+	}
+	if u.Locked() {
+		a.auditAs(c, nil, audit.LoginLocked, userTarget(u.ID))
+		c.Header("Retry-After", strconv.FormatInt(int64(time.Until(*u.LockedUntil).Seconds())+1, 10))
+		return users.ErrUserLocked
+	}
+	if !u.PasswordOK(password) {
+		a.auditAs(c, nil, audit.LoginFailed, userTarget(u.ID))
+		a.loginFailed(c, u)
+		return ginjwt.ErrFailedAuthentication
+	}
+	if err := canLogin(u); err != nil {
+		a.auditAs(c, nil, audit.LoginDisabled, userTarget(u.ID))
+		return err
+	}
+	a.loginSucceeded(u, password)
+	return nil
+}
+
+// loginUserKey is set to the user that logged in
+// so that the login response can see who it was.
+const loginUserKey = "login-user"
+
+// canLogin returns an error if the user is not
+// allowed to log in right now.
+func canLogin(u *users.User) error {
+	if u.Disabled() {
+		return users.ErrUserDisabled
 	}
-	return nil, ginjwt.ErrFailedAuthentication
+	if u.Locked() {
+		return users.ErrUserLocked
+	}
+	return nil
 }
 
 func (a *App) authorize(data interface{}, c *gin.Context) bool {
@@ -229,31 +401,29 @@ func (a *App) jwtPayload(data interface{}) ginjwt.MapClaims {
 		"name":           u.Name,
 		"email":          u.Email,
 		"is_admin":       u.IsAdmin,
+		"reset_required": u.ResetRequired,
 	}
 }
 
+// identityHandler loads the user from the token's identity. The
+// database is checked on every request so that disabled accounts
+// and temporary passwords take effect before the token expires.
 func (a *App) identityHandler(c *gin.Context) interface{} {
-	var (
-		name   string
-		admin  bool
-		claims = ginjwt.ExtractClaims(c)
-	)
-	val, ok := claims["name"]
-	if ok {
-		name = val.(string)
-	}
-	val, ok = claims["is_admin"]
-	if ok {
-		admin = val.(bool)
-	}
-	id, ok := claims[a.jwtIdentidyKey]
+	claims := ginjwt.ExtractClaims(c)
+	id, ok := claims[a.jwtIdentidyKey].(float64)
 	if !ok {
 		log.Println("claims should have the identity key")
 		return nil // should not happen
 	}
-	return &users.User{
-		ID:      int(id.(float64)),
-		Name:    name,
-		IsAdmin: admin,
+	u, err := users.GetUserByID(a.DB, int(id))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println("could not get user from token:", err)
+		}
+		return nil
+	}
+	if u.Disabled() {
+		return nil
 	}
+	return u
 }
@@ -0,0 +1,125 @@
+package app
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+
+	"github.com/mercedtime/api/audit"
+)
+
+const defaultAuditRetentionDays = 90
+
+// audit records an action done by the user making the request.
+func (a *App) audit(c *gin.Context, action, target string) {
+	var actor *int
+	if id, err := getSelfID(a.jwtIdentidyKey, c); err == nil {
+		actor = &id
+	}
+	a.auditAs(c, actor, action, target)
+}
+
+// auditAs records an action done by some user, the
+// actor should be nil if the user is not known.
+func (a *App) auditAs(c *gin.Context, actor *int, action, target string) {
+	if a.Audit == nil {
+		return
+	}
+	err := a.Audit.Write(&audit.Entry{
+		ActorID:   actor,
+		Action:    action,
+		Target:    target,
+		IP:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+	})
+	if err != nil {
+		log.Println("could not write to audit log:", err)
+	}
+}
+
+// audited returns a middleware that records the action on the
+// user set as "id" once the rest of the handlers have succeeded.
+func (a *App) audited(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		if c.IsAborted() || c.Writer.Status() >= 300 {
+			return
+		}
+		a.audit(c, action, userTarget(c.GetInt("id")))
+	}
+}
+
+// auditToken records an action done by the owner of a token.
+func (a *App) auditToken(c *gin.Context, action, token string) {
+	var actor *int
+	if t, err := a.auth.ParseTokenString(token); err == nil {
+		claims, _ := t.Claims.(jwt.MapClaims)
+		if id, ok := claims[a.jwtIdentidyKey].(float64); ok {
+			i := int(id)
+			actor = &i
+		}
+	}
+	target := ""
+	if actor != nil {
+		target = userTarget(*actor)
+	}
+	a.auditAs(c, actor, action, target)
+}
+
+func userTarget(id int) string {
+	return "user:" + strconv.Itoa(id)
+}
+
+func (a *App) queryAuditLog(c *gin.Context) {
+	var f audit.Filter
+	if err := c.BindQuery(&f); err != nil {
+		c.AbortWithStatusJSON(400, &Error{"bad parameters: " + err.Error(), 400})
+		return
+	}
+	entries, err := a.Audit.Query(&f)
+	if err != nil {
+		senderr(c, err, 500)
+		return
+	}
+	c.JSON(200, entries)
+}
+
+// StartAuditRetention will delete old audit log entries every
+// interval until the returned stop function is called.
+func (a *App) StartAuditRetention(interval time.Duration) (stop func()) {
+	days := a.Config.AuditRetentionDays
+	if days <= 0 {
+		days = defaultAuditRetentionDays
+	}
+	var (
+		retention = time.Hour * 24 * time.Duration(days)
+		ticker    = time.NewTicker(interval)
+		done      = make(chan struct{})
+	)
+	prune := func() {
+		n, err := a.Audit.Prune(retention)
+		if err != nil {
+			log.Println("could not prune audit log:", err)
+		} else if n > 0 {
+			log.Printf("pruned %d audit log entries\n", n)
+		}
+	}
+	go func() {
+		prune()
+		for {
+			select {
+			case <-ticker.C:
+				prune()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
@@ -0,0 +1,200 @@
+package app
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/mercedtime/api/catalog"
+	"github.com/mercedtime/api/publish"
+)
+
+// Broadcaster delivers catalog updates to every
+// running instance of the api.
+type Broadcaster interface {
+	// Broadcast adds a batch of entries to the update
+	// log and sends it to every instance.
+	Broadcast(entries []*catalog.Entry) error
+	// Listen sets the function called, in order, with every
+	// update broadcast by any instance.
+	Listen(fn func(*Update))
+	Close() error
+}
+
+// NewMemoryBroadcaster creates a broadcaster that
+// only delivers updates to this instance.
+func NewMemoryBroadcaster(l UpdateLog) Broadcaster {
+	return &memoryBroadcaster{log: l}
+}
+
+type memoryBroadcaster struct {
+	mu     sync.Mutex
+	log    UpdateLog
+	listen func(*Update)
+}
+
+func (b *memoryBroadcaster) Broadcast(entries []*catalog.Entry) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	seq, err := b.log.Append(entries)
+	if err != nil {
+		return err
+	}
+	if b.listen != nil {
+		b.listen(&Update{Seq: seq, Entries: entries})
+	}
+	return nil
+}
+
+func (b *memoryBroadcaster) Listen(fn func(*Update)) {
+	b.mu.Lock()
+	b.listen = fn
+	b.mu.Unlock()
+}
+
+func (b *memoryBroadcaster) Close() error { return nil }
+
+// gapTimeout is how long a missing sequence number is waited
+// for before it is assumed to have been rolled back.
+const gapTimeout = 10 * time.Second
+
+// NewPostgresBroadcaster creates a broadcaster that uses postgres
+// LISTEN/NOTIFY and the update log stored in postgres so that updates
+// reach every instance connected to the database. The dsn is used to
+// open the listener connection.
+func NewPostgresBroadcaster(db *sqlx.DB, dsn string, history int) (Broadcaster, error) {
+	if history <= 0 {
+		history = defaultReplaySize
+	}
+	b := &postgresBroadcaster{
+		db:   db,
+		log:  &postgresLog{db: db, size: history},
+		size: history,
+		done: make(chan struct{}),
+	}
+	// only updates after this are delivered, the sequence is used
+	// instead of the log so that numbers that were rolled back
+	// before starting are not waited for
+	err := db.Get(&b.last, `
+	SELECT CASE WHEN is_called THEN last_value ELSE last_value - 1 END
+	  FROM update_log_seq_seq`)
+	if err != nil {
+		return nil, err
+	}
+	b.listener = pq.NewListener(dsn, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Println("update listener:", err)
+		}
+	})
+	if err = b.listener.Listen(publish.Channel); err != nil {
+		b.listener.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+type postgresBroadcaster struct {
+	db       *sqlx.DB
+	log      UpdateLog
+	size     int
+	listener *pq.Listener
+	done     chan struct{}
+	once     sync.Once
+	last     uint64 // last update delivered
+	// when the update after last was found missing
+	gap time.Time
+}
+
+func (b *postgresBroadcaster) Broadcast(entries []*catalog.Entry) error {
+	tx, err := b.db.Beginx()
+	if err != nil {
+		return err
+	}
+	if _, err = publish.Notify(tx, entries, b.size); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Listen starts delivering updates, it should only be called once.
+func (b *postgresBroadcaster) Listen(fn func(*Update)) {
+	go func() {
+		retry := time.NewTicker(time.Second)
+		defer retry.Stop()
+		ping := time.NewTicker(time.Minute)
+		defer ping.Stop()
+		for {
+			select {
+			case n := <-b.listener.Notify:
+				// n is nil after reconnecting and
+				// we may have missed notifications
+				var seq uint64
+				if n != nil {
+					seq, _ = strconv.ParseUint(n.Extra, 10, 64)
+				}
+				b.deliver(fn, seq)
+			case <-retry.C:
+				if !b.gap.IsZero() {
+					b.deliver(fn, 0)
+				}
+			case <-ping.C:
+				go b.listener.Ping()
+			case <-b.done:
+				return
+			}
+		}
+	}()
+}
+
+// deliver reads every update after the last one delivered from
+// the update log. If some were pruned, it skips ahead to seq.
+//
+// Sequence numbers are taken when a row is inserted, not when its
+// transaction commits, so an update can show up after later ones.
+// Updates after a missing one are held back until it is committed,
+// or until gapTimeout has passed and it was most likely rolled back,
+// so that they are always delivered in order.
+func (b *postgresBroadcaster) deliver(fn func(*Update), seq uint64) {
+	if seq != 0 && seq <= b.last {
+		return
+	}
+	updates, ok, err := b.log.Since(b.last)
+	if err != nil {
+		log.Println("could not read update log:", err)
+		return
+	}
+	if !ok {
+		log.Println("missed updates after", b.last)
+		if seq == 0 {
+			return
+		}
+		updates, ok, err = b.log.Since(seq - 1)
+		if err != nil || !ok {
+			log.Println("could not read update log:", err)
+			return
+		}
+	}
+	for _, u := range updates {
+		if u.Seq > b.last+1 {
+			if b.gap.IsZero() {
+				b.gap = time.Now()
+			}
+			if time.Since(b.gap) < gapTimeout {
+				return
+			}
+			log.Printf("skipping updates %d to %d, they were never committed", b.last+1, u.Seq-1)
+		}
+		b.gap = time.Time{}
+		fn(u)
+		b.last = u.Seq
+	}
+}
+
+func (b *postgresBroadcaster) Close() error {
+	b.once.Do(func() { close(b.done) })
+	return b.listener.Close()
+}
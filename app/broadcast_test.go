@@ -0,0 +1,56 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mercedtime/api/catalog"
+)
+
+// gapLog is an update log with the updates
+// that have been committed so far.
+type gapLog struct{ updates []*Update }
+
+func (l *gapLog) Append([]*catalog.Entry) (uint64, error) { return 0, nil }
+
+func (l *gapLog) Since(seq uint64) ([]*Update, bool, error) {
+	var res []*Update
+	for _, u := range l.updates {
+		if u.Seq > seq {
+			res = append(res, u)
+		}
+	}
+	return res, true, nil
+}
+
+func TestPostgresBroadcasterGap(t *testing.T) {
+	var (
+		l         = &gapLog{}
+		b         = &postgresBroadcaster{log: l, last: 1}
+		delivered []uint64
+		fn        = func(u *Update) { delivered = append(delivered, u.Seq) }
+	)
+	// 2 was taken by a transaction that has not committed yet
+	l.updates = []*Update{{Seq: 3}}
+	b.deliver(fn, 3)
+	if len(delivered) != 0 {
+		t.Fatalf("delivered %v before the missing update", delivered)
+	}
+	l.updates = []*Update{{Seq: 2}, {Seq: 3}}
+	b.deliver(fn, 2)
+	if len(delivered) != 2 || delivered[0] != 2 || delivered[1] != 3 {
+		t.Fatalf("expected updates 2 and 3 in order, got %v", delivered)
+	}
+
+	// 4 was rolled back so 5 is sent after the timeout
+	l.updates = append(l.updates, &Update{Seq: 5})
+	b.deliver(fn, 5)
+	if len(delivered) != 2 {
+		t.Fatalf("delivered %v before the timeout", delivered)
+	}
+	b.gap = time.Now().Add(-gapTimeout)
+	b.deliver(fn, 0)
+	if len(delivered) != 3 || delivered[2] != 5 || !b.gap.IsZero() {
+		t.Errorf("expected update 5 after the timeout, got %v", delivered)
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/harrybrwn/config"
 	"github.com/spf13/pflag"
+
+	"github.com/mercedtime/api/db"
 )
 
 // Config is the application config struct
@@ -19,23 +21,96 @@ type Config struct {
 	Mode     string         `config:"mode,usage=set the gin mode ('debug'|'release')" default:"debug"`
 	Secret   string         `config:"secret,notflag" env:"JWT_SECRET"`
 	Database DatabaseConfig `config:"db" yaml:"db"`
+	APIKeys  APIKeyConfig   `config:"api_keys" yaml:"api_keys"`
+	OIDC     OIDCConfig     `config:"oidc" yaml:"oidc"`
+	Auth     AuthConfig     `config:"auth" yaml:"auth"`
+	Mail     MailConfig     `config:"mail" yaml:"mail"`
+	GraphQL  GraphQLConfig  `config:"graphql" yaml:"graphql"`
+	// UpdateSecret is shared with mtupdate to sign catalog updates
+	UpdateSecret string `config:"update_secret,notflag" yaml:"update_secret" env:"UPDATE_SECRET"`
+	// Max number of websocket connections from one ip address
+	WSMaxConnsPerIP int `config:"ws_max_conns_per_ip" yaml:"ws_max_conns_per_ip"`
+	// Number of catalog updates kept for clients that reconnect
+	UpdateHistory int `config:"update_history" yaml:"update_history"`
+	// Keep the update history in postgres so it survives restarts
+	PersistUpdates bool `config:"persist_updates" yaml:"persist_updates"`
+	// How updates reach the other instances of the api, "memory"
+	// for only this instance or "postgres" for LISTEN/NOTIFY
+	Broadcaster string `config:"broadcaster" yaml:"broadcaster"`
+	// Number of days to keep audit log entries
+	AuditRetentionDays int `config:"audit_retention_days" yaml:"audit_retention_days"`
 
 	InMemoryRateStore bool `config:"in_memory_rate_store" yaml:"in_memory_rate_store" default:"true"`
 }
 
-// DatabaseConfig is the part of the config struct that
-// handles database info
-type DatabaseConfig struct {
-	Driver   string `config:"driver,usage=database driver name"`
-	Host     string `config:"host,shorthand=h" default:"localhost"`
-	Port     int    `config:"port,shorthand=p" default:"5432" env:"POSTGRES_PORT"`
-	User     string `config:"user,shorthand=U"`
-	Password string `config:"password" env:"POSTGRES_PASSWORD"`
-	// Database name or database filename
-	Name string `config:"name,shorthand=d,usage=name of the database"`
-	SSL  string `config:"ssl" default:"disable"`
+// APIKeyConfig holds the limits given to new api keys.
+type APIKeyConfig struct {
+	// Requests per second
+	RateLimit int64 `config:"rate_limit" yaml:"rate_limit"`
+	// Requests per day
+	DailyQuota int64 `config:"daily_quota" yaml:"daily_quota"`
+}
+
+// AuthConfig configures password hashing and login throttling.
+type AuthConfig struct {
+	BcryptCost int `config:"bcrypt_cost,usage=bcrypt cost used for password hashes" yaml:"bcrypt_cost"`
+	// Failed logins allowed before an account is locked
+	MaxLoginAttempts int `config:"max_login_attempts" yaml:"max_login_attempts"`
+	// Seconds that an account is locked for once it reaches the
+	// max login attempts. This doubles with every failure after that.
+	LockoutSeconds int `config:"lockout_seconds" yaml:"lockout_seconds"`
+	// Failed logins allowed from one ip address every 15 minutes
+	IPLoginAttempts int64 `config:"ip_login_attempts" yaml:"ip_login_attempts"`
+}
+
+// GraphQLConfig limits the work a single graphql query can do
+// and which queries are run. Zero values are replaced with defaults.
+type GraphQLConfig struct {
+	// Max nesting of fields in a query
+	MaxDepth int `config:"max_depth" yaml:"max_depth"`
+	// Max complexity of a query. Every field costs one plus the
+	// cost of its fields, and connections multiply that by first.
+	MaxComplexity int `config:"max_complexity" yaml:"max_complexity"`
+	// Complexity each client can use per minute, -1 for no limit
+	ComplexityBudget int64 `config:"complexity_budget" yaml:"complexity_budget"`
+	// Number of automatic persisted queries kept in memory
+	APQCacheSize int `config:"apq_cache_size" yaml:"apq_cache_size"`
+	// Directory of .graphql files with the only queries
+	// that are run in release mode
+	PersistedQueries string `config:"persisted_queries" yaml:"persisted_queries"`
+}
+
+// MailConfig configures the smtp server used to send
+// emails. Emails are only logged if no host is given.
+type MailConfig struct {
+	Host     string `config:"host" yaml:"host"`
+	Port     int    `config:"port" yaml:"port"`
+	Username string `config:"username" yaml:"username"`
+	Password string `config:"password,notflag" yaml:"password" env:"SMTP_PASSWORD"`
+	From     string `config:"from" yaml:"from"`
+	// VerifyURL is the frontend page that verifies email
+	// changes. The token is added as a query parameter.
+	VerifyURL string `config:"verify_url" yaml:"verify_url"`
+}
+
+// OIDCConfig configures logging in with an OpenID Connect provider.
+type OIDCConfig struct {
+	Issuer       string `config:"issuer,usage=OpenID Connect issuer url" yaml:"issuer"`
+	ClientID     string `config:"client_id" yaml:"client_id"`
+	ClientSecret string `config:"client_secret,notflag" yaml:"client_secret"`
+	// RedirectURL is the full url of the callback
+	// endpoint that the provider will redirect to.
+	RedirectURL string `config:"redirect_url" yaml:"redirect_url"`
+	// AllowedDomains limits logins to emails from these
+	// domains. All domains are allowed if empty.
+	AllowedDomains []string `config:"allowed_domains,notflag" yaml:"allowed_domains"`
 }
 
+// DatabaseConfig is the part of the config struct that
+// handles database info. It is kept in the db package so
+// that the commands can use it without the api server.
+type DatabaseConfig = db.Config
+
 // Init sets up command line flags and parses command line args and gets config defaults
 func (c *Config) Init() error {
 	flag := pflag.NewFlagSet("api", pflag.ContinueOnError)
@@ -62,24 +137,6 @@ func (c *Config) GetDSN() string {
 	return c.Database.GetDSN()
 }
 
-// GetDSN builds the database dns from the database config parameters
-func (dbc *DatabaseConfig) GetDSN() string {
-	switch dbc.Driver {
-	case "postgres":
-		return fmt.Sprintf(
-			"host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
-			dbc.Host, dbc.Port, dbc.User, dbc.Password, dbc.Name, dbc.SSL,
-		)
-	case "sqlite3":
-		if !exists(dbc.Name) {
-			return fmt.Sprintf("file:%s.sqlite", dbc.Name)
-		}
-		return fmt.Sprintf("file:%s", dbc.Name)
-	default:
-		panic(fmt.Sprintf("unknown database driver %s\n", dbc.Driver))
-	}
-}
-
 // Address formats the server address:port from the app config
 func (c *Config) Address() string {
 	return net.JoinHostPort(
@@ -88,11 +145,6 @@ func (c *Config) Address() string {
 	)
 }
 
-func exists(f string) bool {
-	_, err := os.Stat(f)
-	return !os.IsNotExist(err)
-}
-
 func statusColor(status int) string {
 	var id int
 	switch {
@@ -0,0 +1,383 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jmoiron/sqlx"
+	"github.com/mercedtime/api/catalog"
+	"github.com/mercedtime/api/publish"
+)
+
+const (
+	defaultWriteWait     = time.Second * 10
+	defaultPongWait      = time.Second * 60
+	defaultKeepAlive     = time.Second * 30
+	defaultSendQueue     = 16
+	defaultMaxConnsPerIP = 10
+	defaultReplaySize    = publish.DefaultHistory
+)
+
+// HubConfig configures the update hub. Zero
+// values are replaced with defaults.
+type HubConfig struct {
+	// Time allowed to write a message to a client
+	WriteWait time.Duration
+	// Time allowed between pongs from a client before
+	// the connection is considered dead
+	PongWait time.Duration
+	// How often clients are pinged, must be less than PongWait
+	PingPeriod time.Duration
+	// How often event streams are sent a keepalive comment
+	KeepAlive time.Duration
+	// Number of messages queued for a client before it
+	// is considered too slow and is disconnected
+	SendQueue int
+	// Max number of connections from one ip address
+	MaxConnsPerIP int
+	// Number of recent updates kept for clients that
+	// reconnect, only used if there is no Log
+	ReplaySize int
+	// Log keeps recent updates, defaults to an in memory log
+	Log UpdateLog
+	// Broadcaster sends published updates to every instance of
+	// the api. Defaults to only this instance using Log.
+	Broadcaster Broadcaster
+}
+
+// Hub keeps track of the clients listening for catalog updates,
+// over websockets or event streams, and sends them the updates
+// they subscribed to.
+type Hub struct {
+	conf HubConfig
+
+	mu      sync.Mutex
+	clients map[uint64]*subscriber
+	perIP   map[string]int
+	closed  bool
+
+	// serializes delivering updates so
+	// that clients get them in order
+	pubMu sync.Mutex
+
+	nextID uint64
+	wg     sync.WaitGroup // writer goroutines
+}
+
+// NewHub creates a new update hub.
+func NewHub(conf HubConfig) *Hub {
+	if conf.WriteWait <= 0 {
+		conf.WriteWait = defaultWriteWait
+	}
+	if conf.PongWait <= 0 {
+		conf.PongWait = defaultPongWait
+	}
+	if conf.PingPeriod <= 0 || conf.PingPeriod >= conf.PongWait {
+		conf.PingPeriod = conf.PongWait * 9 / 10
+	}
+	if conf.KeepAlive <= 0 {
+		conf.KeepAlive = defaultKeepAlive
+	}
+	if conf.SendQueue <= 0 {
+		conf.SendQueue = defaultSendQueue
+	}
+	if conf.MaxConnsPerIP <= 0 {
+		conf.MaxConnsPerIP = defaultMaxConnsPerIP
+	}
+	if conf.Log == nil {
+		conf.Log = NewMemoryLog(conf.ReplaySize)
+	}
+	if conf.Broadcaster == nil {
+		conf.Broadcaster = NewMemoryBroadcaster(conf.Log)
+	}
+	h := &Hub{
+		conf:    conf,
+		clients: make(map[uint64]*subscriber),
+		perIP:   make(map[string]int),
+	}
+	conf.Broadcaster.Listen(h.deliver)
+	return h
+}
+
+func newHub(conf *Config, db *sqlx.DB) (*Hub, error) {
+	hc := HubConfig{
+		MaxConnsPerIP: conf.WSMaxConnsPerIP,
+		ReplaySize:    conf.UpdateHistory,
+	}
+	if conf.PersistUpdates {
+		hc.Log = NewPostgresLog(db, conf.UpdateHistory)
+	}
+	switch conf.Broadcaster {
+	case "", "memory":
+	case "postgres":
+		b, err := NewPostgresBroadcaster(db, conf.GetDSN(), conf.UpdateHistory)
+		if err != nil {
+			return nil, err
+		}
+		hc.Log = NewPostgresLog(db, conf.UpdateHistory)
+		hc.Broadcaster = b
+	default:
+		return nil, fmt.Errorf("unknown broadcaster %q", conf.Broadcaster)
+	}
+	return NewHub(hc), nil
+}
+
+// subscriber is one client of the hub. Messages are queued on
+// send and the client's writer stops once the hub closes it.
+type subscriber struct {
+	id   uint64
+	ip   string
+	send chan *WSMessage
+	seq  uint64 // last update sent, guarded by the hub
+
+	mu  sync.Mutex // guards sub
+	sub *subscription
+
+	// close frame sent to websockets when the send
+	// queue is closed, set by the hub before closing it
+	closeCode int
+	closeText string
+}
+
+func (h *Hub) newSubscriber(ip string, sub *subscription) *subscriber {
+	return &subscriber{
+		id:   atomic.AddUint64(&h.nextID, 1),
+		ip:   ip,
+		send: make(chan *WSMessage, h.conf.SendQueue),
+		sub:  sub,
+	}
+}
+
+// Len returns the number of connected clients.
+func (h *Hub) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients)
+}
+
+// Publish broadcasts the entries to every instance of the api.
+func (h *Hub) Publish(entries []*catalog.Entry) error {
+	return h.conf.Broadcaster.Broadcast(entries)
+}
+
+// Subscribe registers a client for the updates matching the request
+// until the context is cancelled. The channel is closed when the
+// client is removed, either because the context is done, the client
+// is too slow, or the hub is shut down.
+func (h *Hub) Subscribe(ctx context.Context, ip string, req *SubscriptionRequest) (<-chan []*catalog.Entry, error) {
+	sub := newSubscription()
+	if err := sub.apply(req); err != nil {
+		return nil, err
+	}
+	if err := h.reserve(ip); err != nil {
+		return nil, err
+	}
+	s := h.newSubscriber(ip, sub)
+	if !h.add(s, 0) {
+		return nil, errHubClosed
+	}
+	out := make(chan []*catalog.Entry, 1)
+	go func() {
+		defer func() {
+			h.unregister(s, 0, "")
+			close(out)
+			h.wg.Done()
+		}()
+		for {
+			select {
+			case msg, ok := <-s.send:
+				if !ok {
+					return
+				}
+				select {
+				case out <- msg.Entries:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// deliver sends an update to every client subscribed to it. Clients
+// with a full send queue are disconnected.
+func (h *Hub) deliver(u *Update) {
+	h.pubMu.Lock()
+	defer h.pubMu.Unlock()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, s := range h.clients {
+		h.send(s, u.Seq, u.Entries)
+	}
+}
+
+// send queues the entries that the client is subscribed to
+// unless it has already been sent them. Must hold the hub lock.
+func (h *Hub) send(s *subscriber, seq uint64, entries []*catalog.Entry) {
+	if seq <= s.seq {
+		return
+	}
+	s.seq = seq
+	s.mu.Lock()
+	matches := s.sub.filter(entries)
+	s.mu.Unlock()
+	if len(matches) == 0 {
+		return
+	}
+	var updated, cancelled []*catalog.Entry
+	for _, e := range matches {
+		if e.CancelledAt != nil {
+			cancelled = append(cancelled, e)
+		} else {
+			updated = append(updated, e)
+		}
+	}
+	if len(updated) > 0 {
+		h.enqueue(s, &WSMessage{Type: wsUpdate, Seq: seq, Entries: updated})
+	}
+	if len(cancelled) > 0 {
+		h.enqueue(s, &WSMessage{Type: wsCancelled, Seq: seq, Entries: cancelled})
+	}
+}
+
+// Shutdown closes the broadcaster and every client and waits for
+// their writers to finish or for the context to be cancelled. No
+// new connections are accepted after shutdown.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	if err := h.conf.Broadcaster.Close(); err != nil {
+		log.Println("could not close update broadcaster:", err)
+	}
+	h.mu.Lock()
+	h.closed = true
+	for _, s := range h.clients {
+		h.remove(s, websocket.CloseGoingAway, "server shutting down")
+	}
+	h.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		h.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+var (
+	errHubClosed    = &Error{"server shutting down", 503}
+	errTooManyConns = &Error{"too many update connections", 429}
+)
+
+// reserve saves a connection slot for the ip address.
+func (h *Hub) reserve(ip string) *Error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return errHubClosed
+	}
+	if h.perIP[ip] >= h.conf.MaxConnsPerIP {
+		return errTooManyConns
+	}
+	h.perIP[ip]++
+	return nil
+}
+
+func (h *Hub) release(ip string) {
+	h.mu.Lock()
+	h.releaseLocked(ip)
+	h.mu.Unlock()
+}
+
+func (h *Hub) releaseLocked(ip string) {
+	if h.perIP[ip]--; h.perIP[ip] <= 0 {
+		delete(h.perIP, ip)
+	}
+}
+
+// add registers a client that has already reserved a slot. The
+// updates published after the sequence number since are queued for
+// the client as one update, or a resync message if they are no
+// longer in the update log. Zero means the client has not seen any.
+func (h *Hub) add(s *subscriber, since uint64) bool {
+	// nothing can be delivered between reading
+	// the log and registering the client
+	h.pubMu.Lock()
+	defer h.pubMu.Unlock()
+	var (
+		missed []*Update
+		ok     = true
+		err    error
+	)
+	if since > 0 {
+		missed, ok, err = h.conf.Log.Since(since)
+		if err != nil {
+			log.Println("could not read update log:", err)
+			ok = false
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		h.releaseLocked(s.ip)
+		return false
+	}
+	h.clients[s.id] = s
+	h.wg.Add(1)
+	switch {
+	case !ok:
+		h.enqueue(s, &WSMessage{Type: wsResync})
+	case len(missed) > 0:
+		entries := make([]*catalog.Entry, 0)
+		for _, u := range missed {
+			entries = append(entries, u.Entries...)
+		}
+		h.send(s, missed[len(missed)-1].Seq, entries)
+	}
+	return true
+}
+
+// enqueue adds a message to the client's send queue without
+// blocking and disconnects the client if the queue is full.
+// Must hold the hub lock.
+func (h *Hub) enqueue(s *subscriber, msg *WSMessage) {
+	if _, ok := h.clients[s.id]; !ok {
+		return
+	}
+	select {
+	case s.send <- msg:
+	default:
+		log.Printf("update client %d is too slow, disconnecting\n", s.id)
+		h.remove(s, websocket.CloseTryAgainLater, "slow consumer")
+	}
+}
+
+// remove unregisters the client and closes its send queue so
+// that the writer stops. Must hold the hub lock.
+func (h *Hub) remove(s *subscriber, code int, text string) {
+	if _, ok := h.clients[s.id]; !ok {
+		return
+	}
+	delete(h.clients, s.id)
+	h.releaseLocked(s.ip)
+	s.closeCode, s.closeText = code, text
+	close(s.send)
+}
+
+func (h *Hub) unregister(s *subscriber, code int, text string) {
+	h.mu.Lock()
+	h.remove(s, code, text)
+	h.mu.Unlock()
+}
@@ -8,7 +8,6 @@ import (
 	"strconv"
 	"strings"
 
-	sq "github.com/Masterminds/squirrel"
 	"github.com/doug-martin/goqu/v9"
 	_ "github.com/doug-martin/goqu/v9/dialect/postgres" // need postgres dialect
 	"github.com/gin-gonic/gin"
@@ -36,56 +35,29 @@ func listParamsMiddleware(c *gin.Context) {
 }
 
 func getCatalog(db *sqlx.DB) gin.HandlerFunc {
-	var (
-		addons = map[string]string{
-			"year":    "year",
-			"term":    "term_id",
-			"subject": "subject",
-		}
-	)
-
-	// using a view for this query
-	psql := sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
-	base := psql.Select("*").From("catalog").Where(
-		"type IN ('LECT','SEM','STDO')")
-
 	return func(c *gin.Context) {
-		var (
-			result = make(catalog.Catalog, 0, 250)
-			p      = catalog.PageParams{}
-			query  = base
-		)
+		var p catalog.PageParams
 		if err := c.BindQuery(&p); err != nil {
 			c.JSON(500, &Error{err.Error(), 500})
 			return
 		}
-		for key, addon := range addons {
-			if param, ok := c.Get(key); ok && param != nil {
-				query = query.Where(sq.Eq{addon: param})
-			}
-		}
-
-		order, ok := c.GetQuery("order")
-		if ok {
-			switch order {
-			case "updated_at", "capacity", "enrolled", "remaining":
-				query = query.OrderBy(order + " DESC")
-			}
-		}
-
-		if p.Limit != nil {
-			query = query.Limit(uint64(*p.Limit))
-		}
-		if p.Offset != nil {
-			query = query.Offset(uint64(*p.Offset))
-		}
-		q, args, err := query.ToSql()
-		if err != nil {
-			senderr(c, err, 500)
-			return
-		}
-
-		err = db.Select(&result, q, args...)
+		// using a view for this query
+		q := catalog.Query{
+			From: catalog.FromCatalog,
+			Filter: catalog.Filter{
+				Subject: c.GetString("subject"),
+				Year:    c.GetInt("year"),
+				TermID:  c.GetInt("term"),
+				Types:   catalog.PrimaryTypes,
+				// ?cancelled=true includes sections that are no longer offered
+				Cancelled: c.Query("cancelled") == "true",
+			},
+			Page: p,
+		}
+		if order, ok := catalog.ParseOrder(c.Query("order")); ok {
+			q.Order = order
+		}
+		result, err := q.Courses(c, db)
 		if err != nil {
 			senderr(c, err, 500)
 			return
@@ -103,7 +75,7 @@ func (a *App) getCourseBluprints(c *gin.Context) {
 		senderr(c, err, 500)
 		return
 	}
-	resp, err := catalog.GetBlueprints(&params)
+	resp, err := params.Query().Blueprints(c, a.DB)
 	if err != nil {
 		senderr(c, err, 500)
 		return
@@ -111,8 +83,6 @@ func (a *App) getCourseBluprints(c *gin.Context) {
 	c.JSON(200, resp)
 }
 
-var listCoursesQuery = `select * from course `
-
 func (a *App) listCourses(c *gin.Context) {
 	var (
 		resp = make([]catalog.Entry, 0, 500)
@@ -127,21 +97,8 @@ func (a *App) listCourses(c *gin.Context) {
 		senderr(c, err, 400)
 		return
 	}
-	stmt := goqu.From("course").SetDialect(
-		goqu.GetDialect("postgres"),
-	).Prepared(true).Select(
-		"*",
-	).Where(
-		p.SemesterParams.Expression(),
-	)
-	stmt = p.PageParams.AppendSelect(stmt)
-	query, args, err := stmt.ToSQL()
-	if err != nil {
-		c.JSON(500, Error{Msg: "internal error"})
-		return
-	}
-	err = a.DB.Select(&resp, query, args...)
-	if err != nil {
+	q := catalog.Query{Filter: p.SemesterParams.Filter(), Page: p.PageParams}
+	if err = q.Select(c, a.DB, &resp); err != nil {
 		log.Println(err)
 		c.JSON(500, Error{Msg: "could not query database"})
 		return
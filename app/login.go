@@ -0,0 +1,120 @@
+package app
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ulule/limiter/v3"
+
+	"github.com/mercedtime/api/audit"
+	"github.com/mercedtime/api/users"
+)
+
+const (
+	defaultMaxLoginAttempts = 5
+	defaultLockoutSeconds   = 30
+	defaultIPLoginAttempts  = 50
+	maxLockout              = time.Hour * 24
+)
+
+var errTooManyLogins = ErrStatus(429, "too many failed logins, try again later")
+
+// lockoutDuration returns the amount of time that an account should
+// be locked for after some number of failed logins in a row. The
+// duration doubles with each failure past the max attempts.
+func lockoutDuration(failures, max int, base time.Duration) time.Duration {
+	if failures < max {
+		return 0
+	}
+	shift := uint(failures - max)
+	if shift > 30 {
+		return maxLockout
+	}
+	d := base << shift
+	if d > maxLockout || d <= 0 {
+		return maxLockout
+	}
+	return d
+}
+
+func (a *App) lockoutDuration(failures int) time.Duration {
+	var (
+		max  = a.Config.Auth.MaxLoginAttempts
+		base = a.Config.Auth.LockoutSeconds
+	)
+	if max <= 0 {
+		max = defaultMaxLoginAttempts
+	}
+	if base <= 0 {
+		base = defaultLockoutSeconds
+	}
+	return lockoutDuration(failures, max, time.Duration(base)*time.Second)
+}
+
+func (a *App) loginIPRate() limiter.Rate {
+	limit := a.Config.Auth.IPLoginAttempts
+	if limit <= 0 {
+		limit = defaultIPLoginAttempts
+	}
+	return limiter.Rate{Period: time.Minute * 15, Limit: limit}
+}
+
+func loginIPKey(c *gin.Context) string {
+	return "login:ip:" + c.ClientIP()
+}
+
+// loginBlocked returns true if the client's ip address
+// has too many failed logins.
+func (a *App) loginBlocked(c *gin.Context) bool {
+	ctx, err := a.RateStore.Peek(c, loginIPKey(c), a.loginIPRate())
+	if err != nil {
+		log.Println("could not check login rate:", err)
+		return false
+	}
+	if ctx.Remaining > 0 {
+		return false
+	}
+	c.Header("Retry-After", strconv.FormatInt(ctx.Reset-time.Now().Unix(), 10))
+	return true
+}
+
+// loginFailed counts a failed login against the client's ip address
+// and against the user if there is one, locking the user's account
+// if they have failed too many times.
+func (a *App) loginFailed(c *gin.Context, u *users.User) {
+	if _, err := a.RateStore.Get(c, loginIPKey(c), a.loginIPRate()); err != nil {
+		log.Println("could not count failed login:", err)
+	}
+	if u == nil {
+		return
+	}
+	n, err := users.LoginFailed(a.DB, u.ID)
+	if err != nil {
+		log.Println("could not count failed login:", err)
+		return
+	}
+	if d := a.lockoutDuration(n); d > 0 {
+		if err = users.Lock(a.DB, u.ID, time.Now().Add(d)); err != nil {
+			log.Println("could not lock account:", err)
+			return
+		}
+		a.auditAs(c, nil, audit.AccountLocked, userTarget(u.ID))
+	}
+}
+
+// loginSucceeded resets the user's failed logins and upgrades
+// the password hash if the bcrypt cost has been raised.
+func (a *App) loginSucceeded(u *users.User, password string) {
+	if u.FailedLogins > 0 {
+		if err := users.LoginSucceeded(a.DB, u.ID); err != nil {
+			log.Println("could not reset failed logins:", err)
+		}
+	}
+	if u.NeedsRehash() {
+		if err := u.Rehash(password); err != nil {
+			log.Println("could not rehash password:", err)
+		}
+	}
+}
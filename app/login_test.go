@@ -0,0 +1,314 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"github.com/ulule/limiter/v3/drivers/store/memory"
+
+	"github.com/mercedtime/api/users"
+)
+
+func TestLockoutDuration(t *testing.T) {
+	for _, tst := range []struct {
+		failures int
+		exp      time.Duration
+	}{
+		{0, 0},
+		{4, 0},
+		{5, time.Minute},
+		{6, time.Minute * 2},
+		{8, time.Minute * 8},
+		{20, maxLockout},
+		{1000, maxLockout},
+	} {
+		d := lockoutDuration(tst.failures, 5, time.Minute)
+		if d != tst.exp {
+			t.Errorf("%d failures: got %v, want %v", tst.failures, d, tst.exp)
+		}
+	}
+}
+
+func TestLoginBlocked(t *testing.T) {
+	a := &App{
+		Config:    &Config{Auth: AuthConfig{IPLoginAttempts: 3}},
+		RateStore: memory.NewStore(),
+	}
+	ctx := func(ip string) *gin.Context {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = &http.Request{RemoteAddr: ip + ":1234", Header: http.Header{}}
+		return c
+	}
+	for i := 0; i < 3; i++ {
+		if a.loginBlocked(ctx("10.0.0.1")) {
+			t.Fatalf("blocked after %d failed logins", i)
+		}
+		a.loginFailed(ctx("10.0.0.1"), nil)
+	}
+	c := ctx("10.0.0.1")
+	if !a.loginBlocked(c) {
+		t.Error("expected ip to be blocked")
+	}
+	if c.Writer.Header().Get("Retry-After") == "" {
+		t.Error("expected a Retry-After header")
+	}
+	if a.loginBlocked(ctx("10.0.0.2")) {
+		t.Error("other ip addresses should not be blocked")
+	}
+}
+
+func TestOptionalAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	conf := testConfig()
+	conf.Secret = "testing-secret"
+	a := &App{
+		DB:     sqlx.MustConnect(conf.Database.Driver, conf.GetDSN()),
+		Config: conf,
+	}
+	defer a.Close()
+	auth, err := a.NewJWTAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := gin.New()
+	r.GET("/", a.OptionalAuth, func(c *gin.Context) {
+		if u, ok := a.Identity(c); ok {
+			c.String(200, u.Name)
+			return
+		}
+		c.String(200, "anonymous")
+	})
+	get := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+	u := &users.User{Name: "optional-auth-test", Email: "optional@test.com"}
+	if err = users.Create(a.DB, u, "password"); err != nil {
+		t.Fatal(err)
+	}
+	defer users.Delete(a.DB, *u)
+	token, _, err := auth.TokenGenerator(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := get(""); rec.Code != 200 || rec.Body.String() != "anonymous" {
+		t.Errorf("no token: got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := get(token); rec.Code != 200 || rec.Body.String() != u.Name {
+		t.Errorf("valid token: got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := get(token + "x"); rec.Code != 401 {
+		t.Errorf("invalid token: got %d, want 401", rec.Code)
+	}
+
+	// the token is still valid but the user is not
+	if _, err = users.ForcePasswordReset(a.DB, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if rec := get(token); rec.Code != 403 {
+		t.Errorf("password reset: got %d, want 403", rec.Code)
+	}
+	if err = users.Disable(a.DB, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if rec := get(token); rec.Code != 403 {
+		t.Errorf("disabled user: got %d, want 403", rec.Code)
+	}
+
+	auth.TimeFunc = func() time.Time { return time.Now().Add(auth.Timeout * 2) }
+	if rec := get(token); rec.Code != 401 {
+		t.Errorf("expired token: got %d, want 401", rec.Code)
+	}
+}
+
+func TestResetRequired(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	conf := testConfig()
+	conf.Secret = "testing-secret"
+	a := &App{
+		DB:        sqlx.MustConnect(conf.Database.Driver, conf.GetDSN()),
+		Config:    conf,
+		RateStore: memory.NewStore(),
+	}
+	defer a.Close()
+	auth, err := a.NewJWTAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := gin.New()
+	r.GET("/user/:id", a.Protected, a.getUser)
+	r.PUT("/user/:id/password", a.Protected, a.userIDMiddleware, a.changePassword)
+
+	u := &users.User{Name: "reset-test", Email: "reset@test.com"}
+	if err = users.Create(a.DB, u, "password"); err != nil {
+		t.Fatal(err)
+	}
+	defer users.Delete(a.DB, *u)
+	token, _, err := auth.TokenGenerator(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	temp, err := users.ForcePasswordReset(a.DB, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	do := func(method, path, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := do("GET", "/user/self", ""); code != 403 {
+		t.Errorf("reset required: got %d, want 403", code)
+	}
+	if code := do("PUT", "/user/self/password",
+		`{"current_password":"`+temp+`","new_password":"new-password"}`); code != 200 {
+		t.Fatalf("password change: got %d, want 200", code)
+	}
+	if code := do("GET", "/user/self", ""); code != 200 {
+		t.Errorf("after password change: got %d, want 200", code)
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	conf := testConfig()
+	conf.Secret = "testing-secret"
+	a := &App{
+		DB:        sqlx.MustConnect(conf.Database.Driver, conf.GetDSN()),
+		Config:    conf,
+		RateStore: memory.NewStore(),
+	}
+	defer a.Close()
+	gin.SetMode(gin.TestMode)
+	auth, err := a.NewJWTAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := gin.New()
+	r.GET("/refresh", a.RefreshToken)
+	refresh := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/refresh", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	u := &users.User{Name: "refresh-test", Email: "refresh@test.com"}
+	if err = users.Create(a.DB, u, "password"); err != nil {
+		t.Fatal(err)
+	}
+	defer users.Delete(a.DB, *u)
+
+	// the admin claim is not copied into the new token
+	token, _, err := auth.TokenGenerator(&users.User{ID: u.ID, Name: u.Name, IsAdmin: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := refresh(token)
+	if rec.Code != 200 {
+		t.Fatalf("got %d %s, want 200", rec.Code, rec.Body.String())
+	}
+	var resp struct{ Token string }
+	if err = json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	claims, err := auth.GetClaimsFromJWT(&gin.Context{Request: &http.Request{
+		Header: http.Header{"Authorization": {"Bearer " + resp.Token}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["is_admin"] != false {
+		t.Errorf("refreshed token should not have a stale admin claim: %v", claims)
+	}
+
+	if err = users.Disable(a.DB, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if rec = refresh(token); rec.Code != http.StatusForbidden {
+		t.Errorf("disabled user: got %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+func TestChangePasswordLockout(t *testing.T) {
+	conf := testConfig()
+	conf.Auth.IPLoginAttempts = 3
+	a := &App{
+		DB:             sqlx.MustConnect(conf.Database.Driver, conf.GetDSN()),
+		Config:         conf,
+		RateStore:      memory.NewStore(),
+		jwtIdentidyKey: "identity",
+	}
+	defer a.Close()
+	// names are not unique so the password must
+	// be checked against the user from the url
+	other := &users.User{Name: "password-test", Email: "other@test.com"}
+	if err := users.Create(a.DB, other, "other-password"); err != nil {
+		t.Fatal(err)
+	}
+	defer users.Delete(a.DB, *other)
+	u := &users.User{Name: "password-test", Email: "password@test.com"}
+	if err := users.Create(a.DB, u, "password"); err != nil {
+		t.Fatal(err)
+	}
+	defer users.Delete(a.DB, *u)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.PUT("/password", func(c *gin.Context) {
+		c.Set(a.jwtIdentidyKey, &users.User{ID: u.ID})
+		c.Set("id", u.ID)
+	}, a.changePassword)
+	change := func(ip, current string) int {
+		req := httptest.NewRequest("PUT", "/password", strings.NewReader(
+			`{"current_password":"`+current+`","new_password":"password"}`))
+		req.RemoteAddr = ip + ":1234"
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if err := users.Lock(a.DB, u.ID, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if code := change("10.0.0.1", "password"); code != 403 {
+		t.Errorf("locked user: got %d, want 403", code)
+	}
+	if err := users.Unlock(a.DB, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if code := change("10.0.0.2", "wrong"); code != 403 {
+			t.Fatalf("wrong password: got %d, want 403", code)
+		}
+	}
+	if code := change("10.0.0.2", "password"); code != 429 {
+		t.Errorf("blocked ip: got %d, want 429", code)
+	}
+	if code := change("10.0.0.3", "other-password"); code != 403 {
+		t.Errorf("the other user's password: got %d, want 403", code)
+	}
+	if code := change("10.0.0.4", "password"); code != 200 {
+		t.Errorf("got %d, want 200", code)
+	}
+	other, err := users.GetUserByID(a.DB, other.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !other.PasswordOK("other-password") {
+		t.Error("changed the password of the other user with the same name")
+	}
+}
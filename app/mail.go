@@ -0,0 +1,60 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+)
+
+// Mailer sends emails.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// NewMailer creates a mailer from the mail config.
+func NewMailer(conf MailConfig) Mailer {
+	if conf.Host == "" {
+		return logMailer{}
+	}
+	return &smtpMailer{conf: conf}
+}
+
+// logMailer just logs emails, it is used
+// when there is no smtp server configured.
+type logMailer struct{}
+
+func (logMailer) Send(to, subject, body string) error {
+	log.Printf("email to %s: %s\n%s\n", to, subject, body)
+	return nil
+}
+
+type smtpMailer struct {
+	conf MailConfig
+}
+
+func (m *smtpMailer) Send(to, subject, body string) error {
+	var (
+		auth smtp.Auth
+		port = m.conf.Port
+	)
+	if port == 0 {
+		port = 587
+	}
+	if m.conf.Username != "" {
+		auth = smtp.PlainAuth("", m.conf.Username, m.conf.Password, m.conf.Host)
+	}
+	msg := fmt.Sprintf(
+		"From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		m.conf.From, to, subject, strings.Replace(body, "\n", "\r\n", -1),
+	)
+	return smtp.SendMail(
+		net.JoinHostPort(m.conf.Host, strconv.Itoa(port)),
+		auth,
+		m.conf.From,
+		[]string{to},
+		[]byte(msg),
+	)
+}
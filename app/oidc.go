@@ -0,0 +1,425 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+
+	"github.com/mercedtime/api/users"
+)
+
+const (
+	oidcCookie     = "oidc"
+	oidcCookieLife = 10 * time.Minute
+)
+
+// OIDC handles logging in with an OpenID Connect provider using
+// the authorization code flow with PKCE.
+type OIDC struct {
+	config    OIDCConfig
+	discovery oidcDiscovery
+	client    *http.Client
+	secret    []byte
+	app       *App
+
+	// link finds or creates the user for a verified
+	// set of id token claims.
+	link func(*IDClaims) (*users.User, error)
+
+	mu   sync.Mutex
+	keys map[string]*rsa.PublicKey
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// IDClaims are the claims in an OpenID Connect id token.
+type IDClaims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	ExpiresAt     int64    `json:"exp"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Name          string   `json:"name"`
+}
+
+// Valid implements the jwt.Claims interface
+func (c *IDClaims) Valid() error {
+	if time.Now().Unix() > c.ExpiresAt {
+		return errors.New("token is expired")
+	}
+	return nil
+}
+
+// The "aud" claim can be a string or a list of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+func (a audience) contains(s string) bool {
+	for _, aud := range a {
+		if aud == s {
+			return true
+		}
+	}
+	return false
+}
+
+// NewOIDC will create a new OpenID Connect login handler. The
+// jwt auth middleware must be created before calling this so that
+// logins get the same tokens as the login endpoint.
+func (a *App) NewOIDC(conf OIDCConfig) (*OIDC, error) {
+	if a.auth == nil {
+		return nil, errors.New("jwt auth must be created before oidc")
+	}
+	if conf.Issuer == "" || conf.ClientID == "" {
+		return nil, errors.New("oidc needs an issuer and a client id")
+	}
+	o := &OIDC{
+		config: conf,
+		client: &http.Client{Timeout: time.Second * 10},
+		secret: []byte(a.Config.Secret),
+		app:    a,
+		keys:   make(map[string]*rsa.PublicKey),
+	}
+	o.link = o.linkUser
+	discoveryURL := strings.TrimSuffix(conf.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := o.getJSON(discoveryURL, &o.discovery); err != nil {
+		return nil, fmt.Errorf("could not get oidc discovery document: %w", err)
+	}
+	if o.discovery.Issuer != conf.Issuer {
+		return nil, fmt.Errorf("oidc issuer %q does not match config %q", o.discovery.Issuer, conf.Issuer)
+	}
+	return o, nil
+}
+
+type oidcSession struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+}
+
+// Login redirects the client to the provider's authorization endpoint.
+func (o *OIDC) Login(c *gin.Context) {
+	var (
+		sess oidcSession
+		err  error
+	)
+	for _, s := range []*string{&sess.State, &sess.Nonce, &sess.Verifier} {
+		if *s, err = randomString(32); err != nil {
+			senderr(c, err, 500)
+			return
+		}
+	}
+	cookie, err := o.signSession(&sess)
+	if err != nil {
+		senderr(c, err, 500)
+		return
+	}
+	c.SetCookie(oidcCookie, cookie, int(oidcCookieLife.Seconds()), "/", "", c.Request.TLS != nil, true)
+
+	challenge := sha256.Sum256([]byte(sess.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {o.config.ClientID},
+		"redirect_uri":          {o.config.RedirectURL},
+		"scope":                 {"openid email profile"},
+		"state":                 {sess.State},
+		"nonce":                 {sess.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	c.Redirect(http.StatusFound, o.discovery.AuthorizationEndpoint+"?"+q.Encode())
+}
+
+// Callback handles the redirect from the provider, exchanges the
+// authorization code for an id token and logs the user in.
+func (o *OIDC) Callback(c *gin.Context) {
+	if e := c.Query("error"); e != "" {
+		c.AbortWithStatusJSON(401, &Error{"oidc login failed: " + e, 401})
+		return
+	}
+	raw, err := c.Cookie(oidcCookie)
+	if err != nil {
+		c.AbortWithStatusJSON(400, &Error{"no oidc login in progress", 400})
+		return
+	}
+	c.SetCookie(oidcCookie, "", -1, "/", "", c.Request.TLS != nil, true)
+	sess, err := o.verifySession(raw)
+	if err != nil || !hmac.Equal([]byte(sess.State), []byte(c.Query("state"))) {
+		c.AbortWithStatusJSON(400, &Error{"invalid oidc state", 400})
+		return
+	}
+	idToken, err := o.exchange(c.Query("code"), sess.Verifier)
+	if err != nil {
+		log.Println("oidc code exchange:", err)
+		c.AbortWithStatusJSON(401, &Error{"could not exchange authorization code", 401})
+		return
+	}
+	claims, err := o.verify(idToken, sess.Nonce)
+	if err != nil {
+		log.Println("oidc id token:", err)
+		c.AbortWithStatusJSON(401, &Error{"invalid id token", 401})
+		return
+	}
+	if !o.domainAllowed(claims) {
+		c.AbortWithStatusJSON(403, &Error{"email domain not allowed", 403})
+		return
+	}
+	u, err := o.link(claims)
+	if err != nil {
+		senderr(c, err, 500)
+		return
+	}
+	o.app.login(c, u)
+}
+
+func (o *OIDC) exchange(code, verifier string) (string, error) {
+	if code == "" {
+		return "", errors.New("no authorization code")
+	}
+	resp, err := o.client.PostForm(o.discovery.TokenEndpoint, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {o.config.RedirectURL},
+		"client_id":     {o.config.ClientID},
+		"client_secret": {o.config.ClientSecret},
+		"code_verifier": {verifier},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint responded with %s", resp.Status)
+	}
+	var body struct {
+		IDToken string `json:"id_token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.IDToken == "" {
+		return "", errors.New("no id token in response")
+	}
+	return body.IDToken, nil
+}
+
+func (o *OIDC) verify(idToken, nonce string) (*IDClaims, error) {
+	var claims IDClaims
+	_, err := jwt.ParseWithClaims(idToken, &claims, func(t *jwt.Token) (interface{}, error) {
+		if t.Method != jwt.SigningMethodRS256 {
+			return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+		}
+		kid, _ := t.Header["kid"].(string)
+		return o.key(kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if claims.Issuer != o.config.Issuer {
+		return nil, errors.New("wrong issuer")
+	}
+	if !claims.Audience.contains(o.config.ClientID) {
+		return nil, errors.New("wrong audience")
+	}
+	if claims.Nonce != nonce {
+		return nil, errors.New("wrong nonce")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("no subject")
+	}
+	return &claims, nil
+}
+
+// domainAllowed checks the email domain. An address that the
+// provider has not verified is never in an allowed domain.
+func (o *OIDC) domainAllowed(claims *IDClaims) bool {
+	if len(o.config.AllowedDomains) == 0 {
+		return true
+	}
+	if !claims.EmailVerified {
+		return false
+	}
+	email := claims.Email
+	i := strings.LastIndex(email, "@")
+	if i < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[i+1:])
+	for _, d := range o.config.AllowedDomains {
+		if strings.ToLower(d) == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// key will get a provider's signing key, refreshing
+// the key set if the key id is not known.
+func (o *OIDC) key(kid string) (*rsa.PublicKey, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if k, ok := o.keys[kid]; ok {
+		return k, nil
+	}
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := o.getJSON(o.discovery.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		o.keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	k, ok := o.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return k, nil
+}
+
+func (o *OIDC) getJSON(u string, v interface{}) error {
+	resp, err := o.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded with %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// linkUser will find the user linked to the identity, link an existing
+// user that has verified the same email, or create a new user. Accounts
+// with an unverified email are never linked so that nobody can sign up
+// with someone else's address and wait for them to login.
+func (o *OIDC) linkUser(claims *IDClaims) (*users.User, error) {
+	db := o.app.DB
+	u, err := users.GetUserByIdentity(db, claims.Issuer, claims.Subject)
+	if err == nil {
+		return u, nil
+	} else if err != users.ErrUserNotFound {
+		return nil, err
+	}
+	if claims.Email != "" && claims.EmailVerified {
+		u, err = users.GetVerifiedUserByEmail(db, claims.Email)
+		if err != nil && err != users.ErrUserNotFound {
+			return nil, err
+		}
+	}
+	if u == nil {
+		// Users created from an outside identity still need a password
+		// hash so they get a random one that nobody knows.
+		pw, err := randomString(32)
+		if err != nil {
+			return nil, err
+		}
+		u = &users.User{Name: claims.Name, Email: claims.Email}
+		if u.Name == "" {
+			u.Name = claims.Email
+		}
+		if u, err = o.app.CreateUser(u, pw); err != nil {
+			return nil, err
+		}
+		if claims.Email != "" && claims.EmailVerified {
+			if err = users.VerifyEmail(db, u.ID); err != nil {
+				return nil, err
+			}
+		}
+	}
+	err = users.LinkIdentity(db, &users.Identity{
+		Issuer:  claims.Issuer,
+		Subject: claims.Subject,
+		UserID:  u.ID,
+		Email:   claims.Email,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (o *OIDC) signSession(s *oidcSession) (string, error) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + o.mac(payload), nil
+}
+
+func (o *OIDC) verifySession(cookie string) (*oidcSession, error) {
+	parts := strings.Split(cookie, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(o.mac(parts[0]))) {
+		return nil, errors.New("bad session signature")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	var s oidcSession
+	return &s, json.Unmarshal(b, &s)
+}
+
+func (o *OIDC) mac(payload string) string {
+	h := hmac.New(sha256.New, o.secret)
+	h.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,268 @@
+package app
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"github.com/mercedtime/api/users"
+)
+
+// mockProvider is a tiny OpenID Connect provider that
+// logs in the same user every time.
+type mockProvider struct {
+	*httptest.Server
+	key   *rsa.PrivateKey
+	email string
+	// sends email_verified as false
+	unverified bool
+
+	mu    sync.Mutex
+	codes map[string]url.Values
+}
+
+func newMockProvider(t *testing.T, email string) *mockProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &mockProvider{key: key, email: email, codes: make(map[string]url.Values)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+			http.Error(w, "pkce required", 400)
+			return
+		}
+		p.mu.Lock()
+		p.codes["code-"+q.Get("state")] = q
+		p.mu.Unlock()
+		redirect := q.Get("redirect_uri") + "?" + url.Values{
+			"code":  {"code-" + q.Get("state")},
+			"state": {q.Get("state")},
+		}.Encode()
+		http.Redirect(w, r, redirect, http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		p.mu.Lock()
+		auth, ok := p.codes[r.Form.Get("code")]
+		delete(p.codes, r.Form.Get("code"))
+		p.mu.Unlock()
+		sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != auth.Get("code_challenge") {
+			http.Error(w, "invalid_grant", 400)
+			return
+		}
+		tok := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss":            p.URL,
+			"sub":            "12345",
+			"aud":            []string{auth.Get("client_id")},
+			"exp":            time.Now().Add(time.Minute).Unix(),
+			"nonce":          auth.Get("nonce"),
+			"email":          p.email,
+			"email_verified": !p.unverified,
+		})
+		tok.Header["kid"] = "test-key"
+		idToken, err := tok.SignedString(p.key)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idToken})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kid": "test-key",
+				"kty": "RSA",
+				"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+			}},
+		})
+	})
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+func TestOIDCLogin(t *testing.T) {
+	for _, tst := range []struct {
+		email      string
+		domains    []string
+		unverified bool
+		code       int
+	}{
+		{email: "student@ucmerced.edu", code: 200},
+		{email: "student@ucmerced.edu", domains: []string{"ucmerced.edu"}, code: 200},
+		{email: "someone@gmail.com", domains: []string{"ucmerced.edu"}, code: 403},
+		{email: "student@ucmerced.edu", domains: []string{"ucmerced.edu"}, unverified: true, code: 403},
+	} {
+		provider := newMockProvider(t, tst.email)
+		provider.unverified = tst.unverified
+		a := &App{Config: &Config{Secret: "testing-secret"}}
+		if _, err := a.NewJWTAuth(); err != nil {
+			t.Fatal(err)
+		}
+		gin.SetMode(gin.TestMode)
+		r := gin.New()
+		srv := httptest.NewServer(r)
+
+		o, err := a.NewOIDC(OIDCConfig{
+			Issuer:         provider.URL,
+			ClientID:       "mercedtime",
+			ClientSecret:   "shh",
+			RedirectURL:    srv.URL + "/callback",
+			AllowedDomains: tst.domains,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var linked *IDClaims
+		// don't need the database
+		o.link = func(claims *IDClaims) (*users.User, error) {
+			linked = claims
+			return &users.User{ID: 7, Name: "student", Email: claims.Email}, nil
+		}
+		r.GET("/login", o.Login)
+		r.GET("/callback", o.Callback)
+
+		jar, _ := cookiejar.New(nil)
+		client := &http.Client{Jar: jar}
+		resp, err := client.Get(srv.URL + "/login")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tst.code {
+			t.Errorf("expected status %d, got %s", tst.code, resp.Status)
+		}
+		if tst.code == 200 {
+			var body struct {
+				Token string `json:"token"`
+			}
+			if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			token, err := a.auth.ParseTokenString(body.Token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			claims := token.Claims.(jwt.MapClaims)
+			if claims["identity"] != float64(7) {
+				t.Errorf("wrong identity in token: %v", claims["identity"])
+			}
+			if linked == nil || linked.Subject != "12345" || linked.Email != tst.email {
+				t.Errorf("bad claims passed to link: %+v", linked)
+			}
+		}
+		resp.Body.Close()
+
+		// the login cookie is only good for one callback
+		resp, err = client.Get(srv.URL + "/callback?code=code-x&state=x")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 400 {
+			t.Errorf("expected replayed callback to fail, got %s", resp.Status)
+		}
+		srv.Close()
+		provider.Close()
+	}
+}
+
+func TestOIDCLinkUser(t *testing.T) {
+	conf := testConfig()
+	a := &App{
+		DB:     sqlx.MustConnect(conf.Database.Driver, conf.GetDSN()),
+		Config: conf,
+	}
+	defer a.Close()
+	o := &OIDC{app: a}
+
+	// someone signed up with the address before its owner
+	squatter := &users.User{Name: "oidc-squatter", Email: "oidc-link@test.com"}
+	if err := users.Create(a.DB, squatter, "password"); err != nil {
+		t.Fatal(err)
+	}
+	defer users.Delete(a.DB, *squatter)
+	claims := &IDClaims{
+		Issuer:        "https://provider.test",
+		Subject:       "link-1",
+		Email:         "oidc-link@test.com",
+		EmailVerified: true,
+	}
+	u, err := o.linkUser(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer users.Delete(a.DB, users.User{ID: u.ID})
+	if u.ID == squatter.ID {
+		t.Fatal("linked to an account with an unverified email")
+	}
+	if u, err = users.GetUserByID(a.DB, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if !u.EmailVerified() {
+		t.Error("email from the provider should be verified")
+	}
+	again, err := o.linkUser(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != u.ID {
+		t.Errorf("same identity got user %d, want %d", again.ID, u.ID)
+	}
+
+	// a second login with the same verified email links to that user
+	linked, err := o.linkUser(&IDClaims{
+		Issuer:        "https://other-provider.test",
+		Subject:       "link-2",
+		Email:         "oidc-link@test.com",
+		EmailVerified: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if linked.ID != u.ID {
+		t.Errorf("verified email got user %d, want %d", linked.ID, u.ID)
+	}
+
+	// unverified emails from the provider are never linked
+	unverified, err := o.linkUser(&IDClaims{
+		Issuer:  "https://other-provider.test",
+		Subject: "link-3",
+		Email:   "oidc-link@test.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer users.Delete(a.DB, users.User{ID: unverified.ID})
+	if unverified.ID == u.ID || unverified.ID == squatter.ID {
+		t.Error("unverified email from the provider was linked to an existing user")
+	}
+	if unverified.EmailVerified() {
+		t.Error("unverified email from the provider was marked verified")
+	}
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/jmoiron/sqlx"
+	"github.com/mercedtime/api/audit"
 	"github.com/mercedtime/api/catalog"
 )
 
@@ -31,14 +32,26 @@ func (a *App) RegisterRoutes(g *gin.RouterGroup) {
 
 	g.POST("/user", createUserRateLimit(a.RateStore), a.PostUser)
 	g.GET("/user/:id", a.Protected, a.getUser)
-	g.DELETE("/user/:id", a.Protected, idParamMiddleware, a.deleteUser)
+	g.PATCH("/user/:id", a.Protected, a.userIDMiddleware, a.audited(audit.UserUpdate), a.patchUser)
+	g.DELETE("/user/:id", a.Protected, idParamMiddleware, a.audited(audit.UserDelete), a.deleteUser)
+	g.PUT("/user/:id/password", a.Protected, a.userIDMiddleware, a.audited(audit.PasswordChange), a.changePassword)
+	g.POST("/email/verify", a.verifyEmail)
+	keys := g.Group("/user/:id/keys", a.Protected, a.userIDMiddleware)
+	keys.GET("", a.listAPIKeys)
+	keys.POST("", a.audited(audit.APIKeyCreate), a.createAPIKey)
+	keys.GET("/usage", a.apiKeyUsage)
+	keys.DELETE("/:key", a.audited(audit.APIKeyRevoke), a.revokeAPIKey)
+	a.adminGroup(g)
 	g.GET("/instructor/:id", instructorFromID(a))
 	g.GET("/instructor/:id/courses", instructorCourses(a.DB))
 	g.GET("/unauthorized", a.Protected, func(c *gin.Context) { c.Status(200) }) // for testing should always be unauthorized
 
-	ch := make(chan interface{})
-	g.GET("/updates", a.wsSub(ch))
-	g.POST("/update", a.wsPublisher(ch))
+	if a.Hub == nil {
+		a.Hub = NewHub(HubConfig{MaxConnsPerIP: a.Config.WSMaxConnsPerIP})
+	}
+	g.GET("/updates", a.Hub.ServeWS)
+	g.GET("/updates/stream", a.Hub.ServeStream)
+	g.POST("/update", a.updateAuth, a.wsPublisher)
 }
 
 // LectureGroup returns the router group for all the lecture routes.
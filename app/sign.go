@@ -0,0 +1,77 @@
+package app
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ulule/limiter/v3"
+
+	"github.com/mercedtime/api/publish"
+	"github.com/mercedtime/api/users"
+)
+
+// maxUpdateBodyLen is the largest update request body.
+const maxUpdateBodyLen = 10 << 20
+
+// updateAuth only lets requests through if they are signed with the
+// update secret or if they have an admin token.
+func (a *App) updateAuth(c *gin.Context) {
+	if c.GetHeader(publish.SignatureHeader) != "" {
+		a.verifyUpdateSignature(c)
+		return
+	}
+	claims, err := a.auth.GetClaimsFromJWT(c)
+	if err != nil {
+		c.AbortWithStatusJSON(401, &Error{"updates must be signed or use an admin token", 401})
+		return
+	}
+	id, ok := claims[a.jwtIdentidyKey].(float64)
+	if !ok {
+		c.AbortWithStatusJSON(401, &Error{"invalid token", 401})
+		return
+	}
+	u, err := users.GetUserByID(a.DB, int(id))
+	if err != nil || !u.IsAdmin || u.Disabled() {
+		c.AbortWithStatusJSON(403, &Error{"forbidden", 403})
+		return
+	}
+	c.Next()
+}
+
+func (a *App) verifyUpdateSignature(c *gin.Context) {
+	secret := a.Config.UpdateSecret
+	if secret == "" {
+		c.AbortWithStatusJSON(401, &Error{"signed updates are not enabled", 401})
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxUpdateBodyLen))
+	if err != nil {
+		c.AbortWithStatusJSON(400, &Error{"could not read request body", 400})
+		return
+	}
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	sig := c.GetHeader(publish.SignatureHeader)
+	err = publish.Verify([]byte(secret), c.GetHeader(publish.TimestampHeader), sig, body, time.Now())
+	if err != nil {
+		senderr(c, err, 401)
+		return
+	}
+	// A signature can only be used once while its timestamp is valid.
+	used, err := a.RateStore.Get(c, "update:sig:"+sig, limiter.Rate{
+		Period: publish.MaxSkew * 2,
+		Limit:  1,
+	})
+	if err != nil {
+		senderr(c, err, 500)
+		return
+	}
+	if used.Reached {
+		c.AbortWithStatusJSON(401, &Error{"signature already used", 401})
+		return
+	}
+	c.Next()
+}
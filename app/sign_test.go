@@ -0,0 +1,55 @@
+package app
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ulule/limiter/v3/drivers/store/memory"
+
+	"github.com/mercedtime/api/publish"
+)
+
+func TestSignedUpdate(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	a := &App{
+		Config:    &Config{Secret: "testing-secret", UpdateSecret: "shh"},
+		RateStore: memory.NewStore(),
+		Hub:       NewHub(HubConfig{}),
+	}
+	if _, err := a.NewJWTAuth(); err != nil {
+		t.Fatal(err)
+	}
+	r := gin.New()
+	r.POST("/update", a.updateAuth, a.wsPublisher)
+
+	body := []byte(`[{"crn":1}]`)
+	send := func(sign func(*http.Request)) int {
+		req := httptest.NewRequest("POST", "/update", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		sign(req)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	signed := httptest.NewRequest("POST", "/update", nil)
+	publish.SignRequest(signed, []byte("shh"), body)
+
+	for i, tst := range []struct {
+		sign func(*http.Request)
+		code int
+	}{
+		{func(r *http.Request) {}, 401},
+		{func(r *http.Request) { publish.SignRequest(r, []byte("wrong"), body) }, 401},
+		{func(r *http.Request) { r.Header.Set("Authorization", "Bearer not-a-token") }, 401},
+		{func(r *http.Request) { r.Header = signed.Header.Clone() }, 200},
+		// replayed
+		{func(r *http.Request) { r.Header = signed.Header.Clone() }, 401},
+	} {
+		if code := send(tst.sign); code != tst.code {
+			t.Errorf("case %d: got status %d, want %d", i, code, tst.code)
+		}
+	}
+}
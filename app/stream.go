@@ -0,0 +1,155 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ServeStream sends catalog updates as server-sent events. The
+// filters are the same as a websocket subscription but are given
+// as query parameters.
+//
+//	/updates/stream?semester=2021-spring&subject=MATH&blueprint=CSE-100&crn=31245
+//
+// Each update is sent as an "update" event with the sequence number
+// as its id so clients that reconnect with Last-Event-ID, or the
+// "since" query parameter, get the updates that they missed. Sections
+// that were removed from the schedule are sent as a "cancelled" event.
+func (h *Hub) ServeStream(c *gin.Context) {
+	req, err := subscriptionQuery(c.Request.URL.Query())
+	if err != nil {
+		c.AbortWithStatusJSON(400, &Error{err.Error(), 400})
+		return
+	}
+	sub := newSubscription()
+	if err = sub.apply(req); err != nil {
+		c.AbortWithStatusJSON(400, &Error{err.Error(), 400})
+		return
+	}
+	since, err := sinceParam(c)
+	if err != nil {
+		c.AbortWithStatusJSON(400, &Error{err.Error(), 400})
+		return
+	}
+	ip := c.ClientIP()
+	if e := h.reserve(ip); e != nil {
+		c.AbortWithStatusJSON(e.Status, e)
+		return
+	}
+	s := h.newSubscriber(ip, sub)
+	if !h.add(s, since) {
+		c.AbortWithStatusJSON(errHubClosed.Status, errHubClosed)
+		return
+	}
+	defer func() {
+		h.unregister(s, 0, "")
+		h.wg.Done()
+	}()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(200)
+	c.Writer.Flush()
+
+	ticker := time.NewTicker(h.conf.KeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg, ok := <-s.send:
+			if !ok {
+				return
+			}
+			if err = writeEvent(c, msg); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if _, err = c.Writer.WriteString(": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-c.Request.Context().Done():
+			return
+		}
+		c.Writer.Flush()
+	}
+}
+
+func writeEvent(c *gin.Context, msg *WSMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if msg.Seq > 0 {
+		if _, err = fmt.Fprintf(c.Writer, "id: %d\n", msg.Seq); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", msg.Type, data)
+	return err
+}
+
+var errBadSince = errors.New("invalid update sequence number")
+
+// sinceParam returns the sequence number of the last update that a
+// reconnecting client has seen from the Last-Event-ID header or the
+// "since" query parameter.
+func sinceParam(c *gin.Context) (uint64, error) {
+	since := c.GetHeader("Last-Event-ID")
+	if since == "" {
+		since = c.Query("since")
+	}
+	if since == "" {
+		return 0, nil
+	}
+	seq, err := strconv.ParseUint(since, 10, 64)
+	if err != nil {
+		return 0, errBadSince
+	}
+	return seq, nil
+}
+
+// subscriptionQuery reads subscription filters from query parameters.
+func subscriptionQuery(q url.Values) (*SubscriptionRequest, error) {
+	req := &SubscriptionRequest{
+		Type:     wsSubscribe,
+		Subjects: q["subject"],
+	}
+	for _, s := range q["semester"] {
+		parts := strings.SplitN(s, "-", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid semester %q, expected <year>-<term>", s)
+		}
+		year, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid semester %q, expected <year>-<term>", s)
+		}
+		req.Semesters = append(req.Semesters, Semester{Year: year, Term: parts[1]})
+	}
+	for _, b := range q["blueprint"] {
+		i := strings.LastIndex(b, "-")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid blueprint %q, expected <subject>-<course number>", b)
+		}
+		num, err := strconv.Atoi(b[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid blueprint %q, expected <subject>-<course number>", b)
+		}
+		req.Blueprints = append(req.Blueprints, Blueprint{Subject: b[:i], CourseNum: num})
+	}
+	for _, crn := range q["crn"] {
+		n, err := strconv.Atoi(crn)
+		if err != nil {
+			return nil, fmt.Errorf("invalid crn %q", crn)
+		}
+		req.CRNs = append(req.CRNs, n)
+	}
+	return req, nil
+}
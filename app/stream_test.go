@@ -0,0 +1,189 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mercedtime/api/catalog"
+)
+
+func TestSubscriptionQuery(t *testing.T) {
+	for _, tst := range []struct {
+		query string
+		exp   *SubscriptionRequest
+		err   bool
+	}{
+		{"", &SubscriptionRequest{Type: wsSubscribe}, false},
+		{
+			"semester=2021-spring&subject=MATH&subject=cse&blueprint=CSE-100&crn=31245",
+			&SubscriptionRequest{
+				Type:       wsSubscribe,
+				Semesters:  []Semester{{Year: 2021, Term: "spring"}},
+				Subjects:   []string{"MATH", "cse"},
+				Blueprints: []Blueprint{{Subject: "CSE", CourseNum: 100}},
+				CRNs:       []int{31245},
+			},
+			false,
+		},
+		{"semester=spring", nil, true},
+		{"semester=twenty-spring", nil, true},
+		{"blueprint=CSE", nil, true},
+		{"blueprint=CSE-one", nil, true},
+		{"crn=abc", nil, true},
+	} {
+		q, err := url.ParseQuery(tst.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := subscriptionQuery(q)
+		if tst.err {
+			if err == nil {
+				t.Errorf("%q: expected an error", tst.query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tst.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(req, tst.exp) {
+			t.Errorf("%q: got %+v, want %+v", tst.query, req, tst.exp)
+		}
+	}
+}
+
+type event struct {
+	id, name, data string
+}
+
+// readEvent reads the next event, skipping comments.
+func readEvent(t *testing.T, r *bufio.Reader) event {
+	t.Helper()
+	var e event
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if e.data != "" {
+				return e
+			}
+		case strings.HasPrefix(line, ":"):
+		case strings.HasPrefix(line, "id: "):
+			e.id = line[4:]
+		case strings.HasPrefix(line, "event: "):
+			e.name = line[7:]
+		case strings.HasPrefix(line, "data: "):
+			e.data = line[6:]
+		}
+	}
+}
+
+func newTestStream(t *testing.T, conf HubConfig) (*Hub, *httptest.Server) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	h := NewHub(conf)
+	r := gin.New()
+	r.GET("/updates/stream", h.ServeStream)
+	return h, httptest.NewServer(r)
+}
+
+func openStream(t *testing.T, srv *httptest.Server, query, lastID string) (*http.Response, *bufio.Reader) {
+	t.Helper()
+	req, err := http.NewRequest("GET", srv.URL+"/updates/stream?"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, bufio.NewReader(resp.Body)
+}
+
+func TestStream(t *testing.T) {
+	h, srv := newTestStream(t, HubConfig{KeepAlive: time.Millisecond * 20})
+	defer srv.Close()
+	resp, r := openStream(t, srv, "crn=2", "")
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("wrong content type %q", ct)
+	}
+	waitFor(t, func() bool { return h.Len() == 1 })
+
+	h.Publish([]*catalog.Entry{{CRN: 1}})
+	h.Publish([]*catalog.Entry{{CRN: 1}, {CRN: 2}})
+	e := readEvent(t, r)
+	if e.id != "2" || e.name != wsUpdate {
+		t.Errorf("wrong event %+v", e)
+	}
+	var msg WSMessage
+	if err := json.Unmarshal([]byte(e.data), &msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Entries) != 1 || msg.Entries[0].CRN != 2 {
+		t.Errorf("expected only crn 2, got %+v", msg.Entries)
+	}
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != ": keepalive\n" {
+		t.Errorf("expected a keepalive comment, got %q", line)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = h.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamLastEventID(t *testing.T) {
+	h, srv := newTestStream(t, HubConfig{})
+	defer srv.Close()
+	for crn := 1; crn <= 3; crn++ {
+		h.Publish([]*catalog.Entry{{CRN: crn}})
+	}
+	resp, r := openStream(t, srv, "", "1")
+	defer resp.Body.Close()
+	// missed updates are sent as one
+	e := readEvent(t, r)
+	if e.id != "3" || e.name != wsUpdate {
+		t.Errorf("expected event 3, got %+v", e)
+	}
+	var msg WSMessage
+	if err := json.Unmarshal([]byte(e.data), &msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Entries) != 2 || msg.Entries[0].CRN != 2 || msg.Entries[1].CRN != 3 {
+		t.Errorf("expected crns 2 and 3, got %+v", msg.Entries)
+	}
+
+	resp, r = openStream(t, srv, "since=10", "")
+	defer resp.Body.Close()
+	if e = readEvent(t, r); e.name != wsResync || e.id != "" {
+		t.Errorf("expected a resync event, got %+v", e)
+	}
+
+	resp, _ = openStream(t, srv, "", "last")
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Errorf("expected a 400 for a bad Last-Event-ID, got %d", resp.StatusCode)
+	}
+}
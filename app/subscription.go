@@ -0,0 +1,214 @@
+package app
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mercedtime/api/catalog"
+)
+
+// Types of messages sent over the updates websocket.
+const (
+	wsSubscribe   = "subscribe"
+	wsUnsubscribe = "unsubscribe"
+	wsAck         = "ack"
+	wsUpdate      = "update"
+	wsError       = "error"
+	// sent for sections that are no longer in the schedule
+	wsCancelled = "cancelled"
+	// sent when a client reconnects after missing more
+	// updates than are kept, it should reload the catalog
+	wsResync = "resync"
+)
+
+// SubscriptionRequest is sent by websocket clients to
+// change which catalog updates they receive.
+//
+//	{"type": "subscribe", "id": "1", "semesters": [{"year": 2021, "term": "spring"}], "crns": [31245]}
+//
+// An unsubscribe request with no filters removes
+// all of the client's filters.
+type SubscriptionRequest struct {
+	Type string `json:"type"`
+	// ID is sent back with the acknowledgement
+	ID         string      `json:"id,omitempty"`
+	Semesters  []Semester  `json:"semesters,omitempty"`
+	Subjects   []string    `json:"subjects,omitempty"`
+	Blueprints []Blueprint `json:"blueprints,omitempty"`
+	CRNs       []int       `json:"crns,omitempty"`
+}
+
+// Semester is a year and term.
+type Semester struct {
+	Year int    `json:"year"`
+	Term string `json:"term"`
+}
+
+// Blueprint identifies all the sections of one course.
+type Blueprint struct {
+	Subject   string `json:"subject"`
+	CourseNum int    `json:"course_num"`
+}
+
+// WSMessage is sent to websocket clients.
+type WSMessage struct {
+	Type string `json:"type"`
+	// Seq numbers every published update
+	Seq          uint64           `json:"seq,omitempty"`
+	ID           string           `json:"id,omitempty"`
+	Error        string           `json:"error,omitempty"`
+	Subscription *Subscriptions   `json:"subscription,omitempty"`
+	Entries      []*catalog.Entry `json:"entries,omitempty"`
+}
+
+// Subscriptions is the set of filters that a websocket client
+// has subscribed to. A client with no filters gets every update.
+type Subscriptions struct {
+	Semesters  []Semester  `json:"semesters"`
+	Subjects   []string    `json:"subjects"`
+	Blueprints []Blueprint `json:"blueprints"`
+	CRNs       []int       `json:"crns"`
+}
+
+type semesterKey struct{ year, term int }
+
+type subscription struct {
+	semesters  map[semesterKey]struct{}
+	subjects   map[string]struct{}
+	blueprints map[Blueprint]struct{}
+	crns       map[int]struct{}
+}
+
+func newSubscription() *subscription {
+	return &subscription{
+		semesters:  make(map[semesterKey]struct{}),
+		subjects:   make(map[string]struct{}),
+		blueprints: make(map[Blueprint]struct{}),
+		crns:       make(map[int]struct{}),
+	}
+}
+
+// match returns true if the client wants the entry. Semesters narrow
+// down the other filters and the subjects, blueprints and crns are
+// combined so that an entry only needs to match one of them.
+func (s *subscription) match(e *catalog.Entry) bool {
+	if len(s.semesters) > 0 {
+		if _, ok := s.semesters[semesterKey{e.Year, e.TermID}]; !ok {
+			return false
+		}
+	}
+	if len(s.subjects) == 0 && len(s.blueprints) == 0 && len(s.crns) == 0 {
+		return true
+	}
+	if _, ok := s.crns[e.CRN]; ok {
+		return true
+	}
+	if _, ok := s.subjects[e.Subject]; ok {
+		return true
+	}
+	_, ok := s.blueprints[Blueprint{Subject: e.Subject, CourseNum: e.CourseNum}]
+	return ok
+}
+
+func (s *subscription) filter(entries []*catalog.Entry) []*catalog.Entry {
+	res := make([]*catalog.Entry, 0)
+	for _, e := range entries {
+		if s.match(e) {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// apply will add or remove the filters in the request.
+func (s *subscription) apply(req *SubscriptionRequest) error {
+	var add bool
+	switch req.Type {
+	case wsSubscribe:
+		add = true
+	case wsUnsubscribe:
+		add = false
+	default:
+		return fmt.Errorf("unknown message type %q", req.Type)
+	}
+	semesters := make([]semesterKey, 0, len(req.Semesters))
+	for _, sem := range req.Semesters {
+		term := catalog.GetTermID(strings.ToLower(sem.Term))
+		if term == 0 || sem.Year == 0 {
+			return fmt.Errorf("invalid semester %d %s", sem.Year, sem.Term)
+		}
+		semesters = append(semesters, semesterKey{sem.Year, term})
+	}
+	if !add && len(semesters) == 0 && len(req.Subjects) == 0 &&
+		len(req.Blueprints) == 0 && len(req.CRNs) == 0 {
+		*s = *newSubscription()
+		return nil
+	}
+	for _, k := range semesters {
+		if add {
+			s.semesters[k] = struct{}{}
+		} else {
+			delete(s.semesters, k)
+		}
+	}
+	for _, sub := range req.Subjects {
+		sub = strings.ToUpper(sub)
+		if add {
+			s.subjects[sub] = struct{}{}
+		} else {
+			delete(s.subjects, sub)
+		}
+	}
+	for _, b := range req.Blueprints {
+		b.Subject = strings.ToUpper(b.Subject)
+		if add {
+			s.blueprints[b] = struct{}{}
+		} else {
+			delete(s.blueprints, b)
+		}
+	}
+	for _, crn := range req.CRNs {
+		if add {
+			s.crns[crn] = struct{}{}
+		} else {
+			delete(s.crns, crn)
+		}
+	}
+	return nil
+}
+
+var termNames = map[int]string{1: "spring", 2: "summer", 3: "fall"}
+
+// view returns the subscriptions in a stable order.
+func (s *subscription) view() *Subscriptions {
+	v := &Subscriptions{
+		Semesters:  make([]Semester, 0, len(s.semesters)),
+		Subjects:   make([]string, 0, len(s.subjects)),
+		Blueprints: make([]Blueprint, 0, len(s.blueprints)),
+		CRNs:       make([]int, 0, len(s.crns)),
+	}
+	for k := range s.semesters {
+		v.Semesters = append(v.Semesters, Semester{Year: k.year, Term: termNames[k.term]})
+	}
+	for sub := range s.subjects {
+		v.Subjects = append(v.Subjects, sub)
+	}
+	for b := range s.blueprints {
+		v.Blueprints = append(v.Blueprints, b)
+	}
+	for crn := range s.crns {
+		v.CRNs = append(v.CRNs, crn)
+	}
+	sort.Slice(v.Semesters, func(i, j int) bool {
+		a, b := v.Semesters[i], v.Semesters[j]
+		return a.Year < b.Year || (a.Year == b.Year && catalog.GetTermID(a.Term) < catalog.GetTermID(b.Term))
+	})
+	sort.Strings(v.Subjects)
+	sort.Slice(v.Blueprints, func(i, j int) bool {
+		a, b := v.Blueprints[i], v.Blueprints[j]
+		return a.Subject < b.Subject || (a.Subject == b.Subject && a.CourseNum < b.CourseNum)
+	})
+	sort.Ints(v.CRNs)
+	return v
+}
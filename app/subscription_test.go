@@ -0,0 +1,159 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/mercedtime/api/catalog"
+)
+
+func TestSubscriptionMatch(t *testing.T) {
+	var (
+		cse100 = &catalog.Entry{CRN: 1, Subject: "CSE", CourseNum: 100, Year: 2021, TermID: 1}
+		cse150 = &catalog.Entry{CRN: 2, Subject: "CSE", CourseNum: 150, Year: 2021, TermID: 1}
+		math21 = &catalog.Entry{CRN: 3, Subject: "MATH", CourseNum: 21, Year: 2021, TermID: 1}
+		fall   = &catalog.Entry{CRN: 4, Subject: "CSE", CourseNum: 100, Year: 2021, TermID: 3}
+		all    = []*catalog.Entry{cse100, cse150, math21, fall}
+	)
+	for i, tst := range []struct {
+		reqs []SubscriptionRequest
+		exp  []*catalog.Entry
+	}{
+		{nil, all},
+		{
+			[]SubscriptionRequest{{Type: "subscribe", Semesters: []Semester{{2021, "spring"}}}},
+			[]*catalog.Entry{cse100, cse150, math21},
+		},
+		{
+			[]SubscriptionRequest{{Type: "subscribe", Subjects: []string{"math"}}},
+			[]*catalog.Entry{math21},
+		},
+		{
+			[]SubscriptionRequest{{Type: "subscribe", Blueprints: []Blueprint{{"cse", 100}}}},
+			[]*catalog.Entry{cse100, fall},
+		},
+		{
+			[]SubscriptionRequest{{
+				Type:       "subscribe",
+				Semesters:  []Semester{{2021, "spring"}},
+				Blueprints: []Blueprint{{"CSE", 100}},
+				CRNs:       []int{3},
+			}},
+			[]*catalog.Entry{cse100, math21},
+		},
+		{
+			[]SubscriptionRequest{
+				{Type: "subscribe", CRNs: []int{1, 2}},
+				{Type: "unsubscribe", CRNs: []int{1}},
+			},
+			[]*catalog.Entry{cse150},
+		},
+		{
+			[]SubscriptionRequest{
+				{Type: "subscribe", CRNs: []int{1, 2}, Subjects: []string{"MATH"}},
+				{Type: "unsubscribe"},
+			},
+			all,
+		},
+	} {
+		s := newSubscription()
+		for _, req := range tst.reqs {
+			if err := s.apply(&req); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := s.filter(all); !reflect.DeepEqual(got, tst.exp) {
+			t.Errorf("case %d: wrong entries: got %v, want %v", i, crns(got), crns(tst.exp))
+		}
+	}
+
+	s := newSubscription()
+	for _, req := range []SubscriptionRequest{
+		{Type: "subscribe", Semesters: []Semester{{2021, "winter"}}},
+		{Type: "subscribe", Semesters: []Semester{{0, "fall"}}},
+		{Type: "what"},
+	} {
+		if err := s.apply(&req); err == nil {
+			t.Errorf("expected an error for %+v", req)
+		}
+	}
+}
+
+func crns(entries []*catalog.Entry) []int {
+	res := make([]int, len(entries))
+	for i, e := range entries {
+		res[i] = e.CRN
+	}
+	return res
+}
+
+func TestWebsocketSubscribe(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var (
+		a = &App{Hub: NewHub(HubConfig{})}
+		r = gin.New()
+	)
+	r.POST("/update", a.wsPublisher)
+	r.GET("/updates", a.Hub.ServeWS)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/updates", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var msg WSMessage
+	conn.WriteMessage(websocket.TextMessage, []byte("not json"))
+	if err = conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != wsError {
+		t.Errorf("expected an error message, got %q", msg.Type)
+	}
+
+	err = conn.WriteJSON(&SubscriptionRequest{
+		Type: "subscribe",
+		ID:   "1",
+		CRNs: []int{2, 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg = WSMessage{}
+	if err = conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != wsAck || msg.ID != "1" {
+		t.Errorf("expected ack for message 1, got %+v", msg)
+	}
+	if msg.Subscription == nil || !reflect.DeepEqual(msg.Subscription.CRNs, []int{1, 2}) {
+		t.Errorf("wrong subscription in ack: %+v", msg.Subscription)
+	}
+
+	var b bytes.Buffer
+	json.NewEncoder(&b).Encode([]*catalog.Entry{{CRN: 1}, {CRN: 3}, {CRN: 2}})
+	resp, err := srv.Client().Post(srv.URL+"/update", "application/json", &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	msg = WSMessage{}
+	if err = conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != wsUpdate {
+		t.Errorf("expected an update, got %q", msg.Type)
+	}
+	if got := crns(msg.Entries); !reflect.DeepEqual(got, []int{1, 2}) {
+		t.Errorf("got updates for %v, want [1 2]", got)
+	}
+}
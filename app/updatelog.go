@@ -0,0 +1,120 @@
+package app
+
+import (
+	"database/sql"
+	"encoding/json"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mercedtime/api/catalog"
+	"github.com/mercedtime/api/publish"
+)
+
+// Update is one batch of published catalog entries.
+type Update struct {
+	Seq     uint64
+	Entries []*catalog.Entry
+}
+
+// UpdateLog keeps the most recent catalog updates so that
+// clients that reconnect can catch up on what they missed.
+type UpdateLog interface {
+	// Append stores a batch of entries and returns its
+	// sequence number.
+	Append(entries []*catalog.Entry) (uint64, error)
+	// Since returns the updates after the sequence number, oldest
+	// first. It returns false if some of them are no longer kept.
+	Since(seq uint64) ([]*Update, bool, error)
+}
+
+// NewMemoryLog creates an update log that keeps
+// the last size updates in memory.
+func NewMemoryLog(size int) UpdateLog {
+	if size <= 0 {
+		size = defaultReplaySize
+	}
+	return &memoryLog{size: size}
+}
+
+type memoryLog struct {
+	mu   sync.Mutex
+	seq  uint64
+	size int
+	buf  []*Update // oldest first
+}
+
+func (l *memoryLog) Append(entries []*catalog.Entry) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seq++
+	l.buf = append(l.buf, &Update{Seq: l.seq, Entries: entries})
+	if len(l.buf) > l.size {
+		l.buf = l.buf[len(l.buf)-l.size:]
+	}
+	return l.seq, nil
+}
+
+func (l *memoryLog) Since(seq uint64) ([]*Update, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if seq > l.seq {
+		// from before a restart
+		return nil, false, nil
+	}
+	missed := l.seq - seq
+	if missed > uint64(len(l.buf)) {
+		return nil, false, nil
+	}
+	res := make([]*Update, missed)
+	copy(res, l.buf[len(l.buf)-int(missed):])
+	return res, true, nil
+}
+
+// NewPostgresLog creates an update log that keeps the last size
+// updates in postgres so that it is kept between restarts.
+func NewPostgresLog(db *sqlx.DB, size int) UpdateLog {
+	if size <= 0 {
+		size = defaultReplaySize
+	}
+	return &postgresLog{db: db, size: size}
+}
+
+type postgresLog struct {
+	db   *sqlx.DB
+	size int
+}
+
+func (l *postgresLog) Append(entries []*catalog.Entry) (uint64, error) {
+	return publish.Append(l.db, entries, l.size)
+}
+
+func (l *postgresLog) Since(seq uint64) ([]*Update, bool, error) {
+	var first, last sql.NullInt64
+	err := l.db.QueryRow("SELECT min(seq), max(seq) FROM update_log").Scan(&first, &last)
+	if err != nil {
+		return nil, false, err
+	}
+	if !last.Valid || seq > uint64(last.Int64) || seq+1 < uint64(first.Int64) {
+		return nil, false, nil
+	}
+	rows, err := l.db.Query("SELECT seq, entries FROM update_log WHERE seq > $1 ORDER BY seq", seq)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+	updates := make([]*Update, 0)
+	for rows.Next() {
+		var (
+			u    Update
+			data []byte
+		)
+		if err = rows.Scan(&u.Seq, &data); err != nil {
+			return nil, false, err
+		}
+		if err = json.Unmarshal(data, &u.Entries); err != nil {
+			return nil, false, err
+		}
+		updates = append(updates, &u)
+	}
+	return updates, true, rows.Err()
+}
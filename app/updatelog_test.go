@@ -0,0 +1,49 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/mercedtime/api/catalog"
+)
+
+func TestMemoryLog(t *testing.T) {
+	l := NewMemoryLog(3)
+	for crn := 1; crn <= 5; crn++ {
+		seq, err := l.Append([]*catalog.Entry{{CRN: crn}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq != uint64(crn) {
+			t.Fatalf("expected sequence number %d, got %d", crn, seq)
+		}
+	}
+	for _, tst := range []struct {
+		since uint64
+		ok    bool
+		crns  []int
+	}{
+		{5, true, nil},
+		{4, true, []int{5}},
+		{2, true, []int{3, 4, 5}},
+		{1, false, nil}, // update 2 was dropped
+		{6, false, nil}, // from before a restart
+	} {
+		updates, ok, err := l.Since(tst.since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != tst.ok {
+			t.Errorf("since %d: got ok=%v, want %v", tst.since, ok, tst.ok)
+			continue
+		}
+		if len(updates) != len(tst.crns) {
+			t.Errorf("since %d: got %d updates, want %d", tst.since, len(updates), len(tst.crns))
+			continue
+		}
+		for i, u := range updates {
+			if u.Entries[0].CRN != tst.crns[i] || u.Seq != uint64(tst.crns[i]) {
+				t.Errorf("since %d: wrong update %+v", tst.since, u)
+			}
+		}
+	}
+}
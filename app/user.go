@@ -5,31 +5,44 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/mail"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
+	ginjwt "github.com/appleboy/gin-jwt/v2"
 	"github.com/gin-gonic/gin"
 	"github.com/lib/pq"
 	"github.com/ulule/limiter/v3"
 	ginlimit "github.com/ulule/limiter/v3/drivers/middleware/gin"
 
+	"github.com/mercedtime/api/audit"
 	"github.com/mercedtime/api/users"
 )
 
 func authorize(r *http.Request, u *users.User) bool {
 	path := r.URL.Path
-	if r.Method == "POST" || r.Method == "DELETE" {
-		if strings.HasSuffix(path, fmt.Sprintf("/user/%d", u.ID)) ||
-			strings.HasSuffix(path, fmt.Sprintf("/user/%d/", u.ID)) {
+	// Users with a temporary password can only choose a new one.
+	if u.ResetRequired {
+		return r.Method == "PUT" &&
+			(strings.HasSuffix(path, fmt.Sprintf("/user/%d/password", u.ID)) ||
+				strings.HasSuffix(path, "/user/self/password"))
+	}
+	if strings.Contains(path+"/", "/admin/") {
+		return u.IsAdmin
+	}
+	switch r.Method {
+	case "POST", "DELETE", "PATCH", "PUT":
+		// userIDMiddleware checks the identity for "self"
+		if strings.Contains(path+"/", fmt.Sprintf("/user/%d/", u.ID)) ||
+			strings.Contains(path+"/", "/user/self/") {
 			return true
 		} else if strings.HasSuffix(path, "/user") {
 			return u.IsAdmin
 		}
 	}
 	switch path {
-	case "/admin":
-		return u.IsAdmin
 	case "/api/v1/unauthorized": // for testing
 		return false
 	default:
@@ -91,6 +104,48 @@ func getSelfID(key string, c *gin.Context) (int, error) {
 	return 0, errors.New("could not get identity")
 }
 
+func getIdentity(key string, c *gin.Context) (*users.User, bool) {
+	identity, ok := c.Get(key)
+	if !ok {
+		return nil, false
+	}
+	user, ok := identity.(*users.User)
+	return user, ok
+}
+
+func isAdmin(key string, c *gin.Context) bool {
+	u, ok := getIdentity(key, c)
+	return ok && u.IsAdmin
+}
+
+// userIDMiddleware sets the "id" of the user from the url
+// parameters (allowing "self") and will only let the request
+// through if it was made by that user or by an admin.
+func (a *App) userIDMiddleware(c *gin.Context) {
+	var (
+		id    int
+		err   error
+		rawid = c.Param("id")
+	)
+	self, ok := getIdentity(a.jwtIdentidyKey, c)
+	if !ok {
+		c.AbortWithStatusJSON(401, &Error{"no identity", 401})
+		return
+	}
+	if rawid == "self" {
+		id = self.ID
+	} else if id, err = strconv.Atoi(rawid); err != nil {
+		c.AbortWithStatusJSON(400, &Error{"id is not a number", 400})
+		return
+	}
+	if self.ID != id && !self.IsAdmin {
+		c.AbortWithStatusJSON(403, &Error{"forbidden", 403})
+		return
+	}
+	c.Set("id", id)
+	c.Next()
+}
+
 // PostUser handles user creation
 // TODO: should be protected, only admin
 func (a *App) PostUser(c *gin.Context) {
@@ -100,10 +155,10 @@ func (a *App) PostUser(c *gin.Context) {
 	}
 	switch e := err.(type) {
 	case *pq.Error:
-		if e.Code == "23505" {
-			c.AbortWithStatusJSON(400, &Error{"Duplicate username or email", 400})
+		if isConflict(e) {
+			c.AbortWithStatusJSON(409, errUserConflict)
 		} else {
-			c.AbortWithStatusJSON(500, &Error{e.Detail, 500})
+			c.AbortWithStatusJSON(500, &Error{"could not create user", 500})
 		}
 		return
 	case *Error:
@@ -114,6 +169,7 @@ func (a *App) PostUser(c *gin.Context) {
 	}
 	switch err {
 	case nil:
+		a.audit(c, audit.UserCreate, userTarget(u.ID))
 		c.JSON(201, u)
 		return
 	case users.ErrInvalidUser:
@@ -128,13 +184,15 @@ func (a *App) SilentCreateUser(c *gin.Context) {
 	u, err := a.createUser(c)
 	switch e := err.(type) {
 	case nil:
+		a.auditAs(c, &u.ID, audit.Signup, userTarget(u.ID))
 		c.Set("new-user", u)
 		c.Next()
 	case *pq.Error:
-		if e.Code == "23505" {
-			c.AbortWithStatusJSON(400, &Error{"Duplicate username or email", 400})
+		if isConflict(e) {
+			c.AbortWithStatusJSON(409, errUserConflict)
 		} else {
-			c.AbortWithStatusJSON(400, &Error{e.Detail, 400})
+			log.Printf("could not create user: %v\n", e)
+			c.AbortWithStatusJSON(500, &Error{"could not create user", 500})
 		}
 	case *Error:
 		c.AbortWithStatusJSON(e.Status, e)
@@ -158,14 +216,181 @@ func (a *App) createUser(c *gin.Context) (*users.User, error) {
 	if err != nil {
 		return nil, &Error{"could not read request body", 400}
 	}
+	return a.newUser(&u.User, u.Password)
+}
+
+// newUser creates a user that signed up, they cannot
+// choose their id or make themselves an admin.
+func (a *App) newUser(u *users.User, password string) (*users.User, error) {
 	// TODO check auth for permissions to set is_admin
 	u.IsAdmin = false
 	u.CreatedAt = time.Time{} // this is taken care of by postgres
 	u.ID = 0                  // database handles this
-	if u.Password == "" {
+	if password == "" {
 		return nil, ErrStatus(400, "no password for new user")
 	}
-	return a.CreateUser(&u.User, u.Password)
+	return a.CreateUser(u, password)
+}
+
+const emailVerifyTTL = time.Hour * 24
+
+var errUserConflict = &Error{"username and email are already taken", 409}
+
+// isConflict returns true if the error is
+// a unique constraint violation.
+func isConflict(err error) bool {
+	e, ok := err.(*pq.Error)
+	return ok && e.Code == "23505"
+}
+
+// UserUpdate is the response for a user update.
+type UserUpdate struct {
+	User *users.User `json:"user"`
+	// PendingEmail is set when the new email
+	// is waiting to be verified.
+	PendingEmail string `json:"pending_email,omitempty"`
+}
+
+func (a *App) patchUser(c *gin.Context) {
+	var body struct {
+		Name  *string `json:"name"`
+		Email *string `json:"email"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.AbortWithStatusJSON(400, &Error{"could not read request body", 400})
+		return
+	}
+	u, err := users.GetUserByID(a.DB, c.GetInt("id"))
+	if err != nil {
+		senderr(c, users.ErrUserNotFound, 404)
+		return
+	}
+	resp := UserUpdate{User: u}
+	if body.Name != nil && *body.Name != u.Name {
+		if *body.Name == "" {
+			c.AbortWithStatusJSON(400, &Error{"name cannot be empty", 400})
+			return
+		}
+		u.Name = *body.Name
+		if err = u.Save(); isConflict(err) {
+			c.AbortWithStatusJSON(409, errUserConflict)
+			return
+		} else if err != nil {
+			senderr(c, err, 500)
+			return
+		}
+	}
+	// Email changes are not saved until the new address has been
+	// verified. Sending the current address again will verify it.
+	if body.Email != nil && (*body.Email != u.Email || !u.EmailVerified()) {
+		addr, err := mail.ParseAddress(*body.Email)
+		if err != nil || addr.Address != *body.Email {
+			c.AbortWithStatusJSON(400, &Error{"invalid email", 400})
+			return
+		}
+		token, err := users.RequestEmailChange(a.DB, u.ID, addr.Address, emailVerifyTTL)
+		if err != nil {
+			senderr(c, err, 500)
+			return
+		}
+		if err = a.sendEmailVerification(addr.Address, token); err != nil {
+			log.Println("could not send verification email:", err)
+			c.AbortWithStatusJSON(500, &Error{"could not send verification email", 500})
+			return
+		}
+		resp.PendingEmail = addr.Address
+		a.audit(c, audit.EmailChange, userTarget(u.ID))
+	}
+	c.JSON(200, &resp)
+}
+
+func (a *App) sendEmailVerification(to, token string) error {
+	link := token
+	if verify := a.Config.Mail.VerifyURL; verify != "" {
+		sep := "?"
+		if strings.Contains(verify, "?") {
+			sep = "&"
+		}
+		link = verify + sep + "token=" + url.QueryEscape(token)
+	}
+	mailer := a.Mailer
+	if mailer == nil {
+		mailer = logMailer{}
+	}
+	return mailer.Send(to, "Verify your email", fmt.Sprintf(
+		"Someone asked to use this email for a MercedTime account. "+
+			"Use the link below to confirm, it expires in %v.\n\n%s\n\n"+
+			"If this wasn't you then you can ignore this email.",
+		emailVerifyTTL, link,
+	))
+}
+
+func (a *App) verifyEmail(c *gin.Context) {
+	var body struct {
+		Token string `json:"token" form:"token" binding:"required"`
+	}
+	if err := c.ShouldBind(&body); err != nil {
+		c.AbortWithStatusJSON(400, &Error{"no token given", 400})
+		return
+	}
+	u, err := users.ConfirmEmailChange(a.DB, body.Token)
+	switch {
+	case err == nil:
+		a.auditAs(c, &u.ID, audit.EmailVerify, userTarget(u.ID))
+		c.JSON(200, u)
+	case err == users.ErrInvalidToken:
+		senderr(c, err, 400)
+	case err == users.ErrUserNotFound:
+		senderr(c, err, 404)
+	case isConflict(err):
+		c.AbortWithStatusJSON(409, errUserConflict)
+	default:
+		senderr(c, err, 500)
+	}
+}
+
+func (a *App) changePassword(c *gin.Context) {
+	var body struct {
+		Current string `json:"current_password" binding:"required"`
+		New     string `json:"new_password" binding:"required"`
+	}
+	// Admins should use a password reset instead.
+	if self, _ := getSelfID(a.jwtIdentidyKey, c); self != c.GetInt("id") {
+		c.AbortWithStatusJSON(403, &Error{"users can only change their own password", 403})
+		return
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.AbortWithStatusJSON(400, &Error{"need the current and new password", 400})
+		return
+	}
+	u, err := users.GetUserByID(a.DB, c.GetInt("id"))
+	if err != nil {
+		senderr(c, users.ErrUserNotFound, 404)
+		return
+	}
+	// The current password is checked like a login so
+	// that it cannot be used to get around a lockout.
+	switch err = a.checkPassword(c, u, body.Current); err {
+	case nil:
+	case ginjwt.ErrFailedAuthentication:
+		c.AbortWithStatusJSON(403, &Error{"current password is incorrect", 403})
+		return
+	case errTooManyLogins:
+		senderr(c, err, 429)
+		return
+	default:
+		senderr(c, err, 403)
+		return
+	}
+	if err = u.SetPassword(body.New); err != nil {
+		senderr(c, err, 500)
+		return
+	}
+	if err = u.Save(); err != nil {
+		senderr(c, err, 500)
+		return
+	}
+	c.JSON(200, &Msg{Msg: "password changed", Status: 200})
 }
 
 func (a *App) deleteUser(c *gin.Context) {
@@ -0,0 +1,87 @@
+package app
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/mercedtime/api/users"
+)
+
+func TestAuthorize(t *testing.T) {
+	var (
+		user  = &users.User{ID: 5}
+		admin = &users.User{ID: 1, IsAdmin: true}
+		reset = &users.User{ID: 5, IsAdmin: true, ResetRequired: true}
+	)
+	for _, tst := range []struct {
+		Method, Path string
+		User         *users.User
+		Exp          bool
+	}{
+		{"GET", "/api/v1/user/5", user, true},
+		{"DELETE", "/api/v1/user/5", user, true},
+		{"DELETE", "/api/v1/user/5/", user, true},
+		{"DELETE", "/api/v1/user/55", user, false},
+		{"POST", "/api/v1/user/5/keys", user, true},
+		{"DELETE", "/api/v1/user/5/keys/3", user, true},
+		{"POST", "/api/v1/user/50/keys", user, false},
+		{"POST", "/api/v1/user/self/keys", user, true},
+		{"PATCH", "/api/v1/user/5", user, true},
+		{"PATCH", "/api/v1/user/6", user, false},
+		{"PATCH", "/api/v1/user/self", user, true},
+		{"PUT", "/api/v1/user/self/password", user, true},
+		{"PUT", "/api/v1/user/6/password", user, false},
+		{"POST", "/api/v1/user", user, false},
+		{"POST", "/api/v1/user", admin, true},
+		{"GET", "/admin", user, false},
+		{"GET", "/admin", admin, true},
+		{"GET", "/api/v1/admin/users", user, false},
+		{"GET", "/api/v1/admin/users", admin, true},
+		{"POST", "/api/v1/admin/users/5/promote", user, false},
+		{"DELETE", "/api/v1/admin/users/5", admin, true},
+		{"PUT", "/api/v1/user/5/password", reset, true},
+		{"PUT", "/api/v1/user/self/password", reset, true},
+		{"PUT", "/api/v1/user/6/password", reset, false},
+		{"GET", "/api/v1/user/5", reset, false},
+		{"PATCH", "/api/v1/user/self", reset, false},
+		{"GET", "/api/v1/admin/users", reset, false},
+	} {
+		r := &http.Request{Method: tst.Method, URL: &url.URL{Path: tst.Path}}
+		if got := authorize(r, tst.User); got != tst.Exp {
+			t.Errorf("%s %s: got %v, want %v", tst.Method, tst.Path, got, tst.Exp)
+		}
+	}
+}
+
+type testMailer struct {
+	to, subject, body string
+}
+
+func (m *testMailer) Send(to, subject, body string) error {
+	m.to, m.subject, m.body = to, subject, body
+	return nil
+}
+
+func TestSendEmailVerification(t *testing.T) {
+	for _, tst := range []struct {
+		verify, exp string
+	}{
+		{"", "tok+en"},
+		{"https://mercedtime.com/verify", "https://mercedtime.com/verify?token=tok%2Ben"},
+		{"https://mercedtime.com/verify?a=b", "https://mercedtime.com/verify?a=b&token=tok%2Ben"},
+	} {
+		m := &testMailer{}
+		a := &App{Config: &Config{Mail: MailConfig{VerifyURL: tst.verify}}, Mailer: m}
+		if err := a.sendEmailVerification("me@ucmerced.edu", "tok+en"); err != nil {
+			t.Fatal(err)
+		}
+		if m.to != "me@ucmerced.edu" {
+			t.Errorf("sent email to the wrong address: %q", m.to)
+		}
+		if !strings.Contains(m.body, "\n"+tst.exp+"\n") {
+			t.Errorf("expected %q in email body:\n%s", tst.exp, m.body)
+		}
+	}
+}
@@ -1,10 +1,10 @@
 package app
 
 import (
+	"encoding/json"
 	"log"
-	"net"
 	"net/http"
-	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
@@ -17,79 +17,144 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin:     func(r *http.Request) bool { return true },
 }
 
-type hub struct {
-	clients map[net.Addr]*websocket.Conn
-	mu      sync.Mutex
-}
+const maxWebsocketMessageLen = 4096
 
-func (h *hub) get(key net.Addr) *websocket.Conn {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	return h.clients[key]
+// wsClient is a websocket connection to the hub. Only the
+// writer goroutine writes to the connection.
+type wsClient struct {
+	*subscriber
+	hub  *Hub
+	conn *websocket.Conn
 }
 
-func (a *App) wsPublisher(ch chan<- interface{}) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		r := make([]*catalog.Entry, 0)
-		if err := c.BindJSON(&r); err != nil {
-			senderr(c, err, 400)
-			log.Println(err)
-			return
-		}
-		ch <- r
-		c.Status(200)
+// ServeWS upgrades the request to a websocket and registers the
+// connection with the hub. Clients that reconnect can use the
+// "since" query parameter to get the updates that they missed.
+func (h *Hub) ServeWS(c *gin.Context) {
+	since, err := sinceParam(c)
+	if err != nil {
+		c.AbortWithStatusJSON(400, &Error{err.Error(), 400})
+		return
+	}
+	ip := c.ClientIP()
+	if e := h.reserve(ip); e != nil {
+		c.AbortWithStatusJSON(e.Status, e)
+		return
+	}
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		h.release(ip)
+		log.Println(err)
+		return
+	}
+	client := &wsClient{
+		subscriber: h.newSubscriber(ip, newSubscription()),
+		hub:        h,
+		conn:       conn,
+	}
+	if !h.add(client.subscriber, since) {
+		conn.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+			time.Now().Add(h.conf.WriteWait),
+		)
+		conn.Close()
+		return
 	}
+	go client.writeLoop()
+	client.readLoop()
 }
 
-func (a *App) wsSub(ch <-chan interface{}) gin.HandlerFunc {
-	var (
-		// TODO Using the client address as the key limits the number of sockets
-		// to one per user. This makes it so that only one tab will have accesss
-		// to real time data.
-		clients = make(map[net.Addr]*websocket.Conn)
-		mu      sync.Mutex
-	)
-
-	// TODO Each client only cares about one semester at a time and will not want data from
-	// a bulk update from a different semester.
-	go func() {
-		for {
-			up := <-ch
-			mu.Lock()
-			for _, c := range clients {
-				c.WriteJSON(up)
+func (c *wsClient) writeLoop() {
+	ticker := time.NewTicker(c.hub.conf.PingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+		c.hub.wg.Done()
+	}()
+	for {
+		select {
+		case msg, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(c.hub.conf.WriteWait))
+			if !ok {
+				c.conn.WriteMessage(
+					websocket.CloseMessage,
+					websocket.FormatCloseMessage(c.closeCode, c.closeText),
+				)
+				return
+			}
+			if err := c.conn.WriteJSON(msg); err != nil {
+				c.hub.unregister(c.subscriber, websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(c.hub.conf.WriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.hub.unregister(c.subscriber, websocket.CloseAbnormalClosure, "")
+				return
 			}
-			mu.Unlock()
 		}
-	}()
+	}
+}
 
-	return func(c *gin.Context) {
-		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+// readLoop handles subscription requests until the connection
+// fails, the client closes it, or the client stops answering pings.
+func (c *wsClient) readLoop() {
+	defer c.hub.unregister(c.subscriber, websocket.CloseNormalClosure, "")
+	c.conn.SetReadLimit(maxWebsocketMessageLen)
+	c.conn.SetReadDeadline(time.Now().Add(c.hub.conf.PongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(c.hub.conf.PongWait))
+	})
+	for {
+		_, msg, err := c.conn.ReadMessage()
 		if err != nil {
-			log.Println(err)
-			c.AbortWithStatusJSON(500, Error{Msg: err.Error(), Status: 500})
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("websocket client %d: %v\n", c.id, err)
+			}
 			return
 		}
-		remote := conn.RemoteAddr()
-
-		mu.Lock()
-		clients[remote] = conn
-		mu.Unlock()
-		conn.SetCloseHandler(func(code int, text string) error {
-			println("closing")
-			log.Printf("closing websocket connection to %v\n", remote)
-			mu.Lock()
-			delete(clients, remote)
-			mu.Unlock()
-			return conn.Close()
-		})
-		for {
-			_, _, err = conn.NextReader()
-			if err != nil {
-				log.Println(err)
-				conn.Close()
-				break
-			}
+		var (
+			req  SubscriptionRequest
+			resp *WSMessage
+		)
+		if err = json.Unmarshal(msg, &req); err != nil {
+			resp = &WSMessage{Type: wsError, Error: "invalid message"}
+		} else {
+			resp = c.handle(&req)
 		}
+		c.hub.mu.Lock()
+		c.hub.enqueue(c.subscriber, resp)
+		c.hub.mu.Unlock()
+	}
+}
+
+// handle applies a subscription request and returns
+// the acknowledgement or an error message.
+func (c *wsClient) handle(req *SubscriptionRequest) *WSMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.sub.apply(req); err != nil {
+		return &WSMessage{Type: wsError, ID: req.ID, Error: err.Error()}
+	}
+	return &WSMessage{
+		Type:         wsAck,
+		ID:           req.ID,
+		Subscription: c.sub.view(),
+	}
+}
+
+func (a *App) wsPublisher(c *gin.Context) {
+	r := make([]*catalog.Entry, 0)
+	if err := c.BindJSON(&r); err != nil {
+		senderr(c, err, 400)
+		log.Println(err)
+		return
+	}
+	if err := a.Hub.Publish(r); err != nil {
+		senderr(c, err, 500)
+		log.Println(err)
+		return
 	}
+	c.Status(200)
 }
@@ -2,15 +2,18 @@ package app
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 	"github.com/jmoiron/sqlx"
+	"github.com/mercedtime/api/catalog"
 	"github.com/mercedtime/api/db"
 	"github.com/ulule/limiter/v3/drivers/store/memory"
 )
@@ -28,9 +31,9 @@ func TestWebsockets(t *testing.T) {
 	a.Engine = r
 	db.Set(a.DB)
 
-	ch := make(chan interface{})
-	r.POST("/update", a.wsPublisher(ch))
-	r.GET("/updates", a.wsSub(ch))
+	a.Hub = NewHub(HubConfig{})
+	r.POST("/update", a.wsPublisher)
+	r.GET("/updates", a.Hub.ServeWS)
 
 	srv := httptest.NewServer(a)
 	u, err := url.Parse(srv.URL)
@@ -65,7 +68,7 @@ func TestWebsockets(t *testing.T) {
 		UpdatedAt time.Time `json:"updated_at"`
 	}
 	b := bytes.Buffer{}
-	if err = json.NewEncoder(&b).Encode(&update{10, time.Now()}); err != nil {
+	if err = json.NewEncoder(&b).Encode([]update{{10, time.Now()}}); err != nil {
 		t.Fatal(err)
 	}
 	resp, err = srv.Client().Post(
@@ -87,3 +90,262 @@ func TestWebsockets(t *testing.T) {
 	}
 	srv.Close()
 }
+
+func newTestHub(t *testing.T, conf HubConfig) (*Hub, *httptest.Server, string) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	h := NewHub(conf)
+	r := gin.New()
+	r.GET("/updates", h.ServeWS)
+	srv := httptest.NewServer(r)
+	return h, srv, "ws" + strings.TrimPrefix(srv.URL, "http") + "/updates"
+}
+
+func TestHubMultipleTabs(t *testing.T) {
+	h, srv, wsURL := newTestHub(t, HubConfig{})
+	defer srv.Close()
+	conns := make([]*websocket.Conn, 3)
+	for i := range conns {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns[i] = conn
+	}
+	waitFor(t, func() bool { return h.Len() == 3 })
+	h.Publish([]*catalog.Entry{{CRN: 7}})
+	for i, conn := range conns {
+		var msg WSMessage
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("connection %d: %v", i, err)
+		}
+		if msg.Type != wsUpdate || len(msg.Entries) != 1 {
+			t.Errorf("connection %d: bad message %+v", i, msg)
+		}
+	}
+}
+
+func TestHubCancelled(t *testing.T) {
+	h, srv, wsURL := newTestHub(t, HubConfig{})
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	waitFor(t, func() bool { return h.Len() == 1 })
+	now := time.Now()
+	h.Publish([]*catalog.Entry{{CRN: 1}, {CRN: 2, CancelledAt: &now}})
+	for _, want := range []struct {
+		typ string
+		crn int
+	}{{wsUpdate, 1}, {wsCancelled, 2}} {
+		var msg WSMessage
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != want.typ || len(msg.Entries) != 1 || msg.Entries[0].CRN != want.crn {
+			t.Errorf("expected a %s message for crn %d, got %+v", want.typ, want.crn, msg)
+		}
+	}
+}
+
+func TestHubConnLimit(t *testing.T) {
+	h, srv, wsURL := newTestHub(t, HubConfig{MaxConnsPerIP: 2})
+	defer srv.Close()
+	for i := 0; i < 2; i++ {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err == nil {
+		t.Fatal("expected the third connection to fail")
+	}
+	if resp == nil || resp.StatusCode != 429 {
+		t.Errorf("expected a 429 response, got %v", resp)
+	}
+	if h.Len() != 2 {
+		t.Errorf("expected 2 clients, got %d", h.Len())
+	}
+}
+
+func TestHubPing(t *testing.T) {
+	_, srv, wsURL := newTestHub(t, HubConfig{
+		PingPeriod: time.Millisecond * 20,
+		PongWait:   time.Second,
+	})
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	pinged := make(chan struct{}, 1)
+	conn.SetPingHandler(func(string) error {
+		select {
+		case pinged <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	select {
+	case <-pinged:
+	case <-time.After(time.Second):
+		t.Error("no ping from the server")
+	}
+}
+
+func TestHubSlowConsumer(t *testing.T) {
+	h := NewHub(HubConfig{SendQueue: 1})
+	c := h.newSubscriber("10.0.0.1", newSubscription())
+	if err := h.reserve(c.ip); err != nil {
+		t.Fatal(err)
+	}
+	if !h.add(c, 0) {
+		t.Fatal("could not add client")
+	}
+	defer h.wg.Done() // there is no writer
+	// Nothing is reading from the queue
+	h.Publish([]*catalog.Entry{{CRN: 1}})
+	h.Publish([]*catalog.Entry{{CRN: 2}})
+	if h.Len() != 0 {
+		t.Fatal("slow client should have been removed")
+	}
+	if _, ok := h.perIP[c.ip]; ok {
+		t.Error("slow client should not count against its ip")
+	}
+	<-c.send
+	if _, ok := <-c.send; ok {
+		t.Error("send queue should be closed")
+	}
+	if c.closeCode != websocket.CloseTryAgainLater {
+		t.Errorf("wrong close code %d", c.closeCode)
+	}
+}
+
+func TestHubShutdown(t *testing.T) {
+	h, srv, wsURL := newTestHub(t, HubConfig{})
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	waitFor(t, func() bool { return h.Len() == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = h.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("expected a going away close frame, got %v", err)
+	}
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err == nil || resp == nil || resp.StatusCode != 503 {
+		t.Errorf("expected new connections to get a 503 after shutdown, got %v", resp)
+	}
+}
+
+func TestHubSince(t *testing.T) {
+	h, srv, wsURL := newTestHub(t, HubConfig{ReplaySize: 2})
+	defer srv.Close()
+	for crn := 1; crn <= 4; crn++ {
+		h.Publish([]*catalog.Entry{{CRN: crn}})
+	}
+	for _, tst := range []struct {
+		since string
+		typ   string
+		crns  []int
+	}{
+		{"3", wsUpdate, []int{4}},
+		{"2", wsUpdate, []int{3, 4}},
+		{"1", wsResync, nil}, // update 2 was dropped
+		{"9", wsResync, nil}, // from before a restart
+	} {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?since="+tst.since, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg WSMessage
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		err = conn.ReadJSON(&msg)
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != tst.typ || len(msg.Entries) != len(tst.crns) {
+			t.Errorf("since %s: got %+v", tst.since, msg)
+			continue
+		}
+		for i, e := range msg.Entries {
+			if e.CRN != tst.crns[i] {
+				t.Errorf("since %s: got crn %d, want %d", tst.since, e.CRN, tst.crns[i])
+			}
+		}
+		if msg.Type == wsUpdate && msg.Seq != 4 {
+			t.Errorf("since %s: got sequence number %d, want 4", tst.since, msg.Seq)
+		}
+	}
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL+"?since=yesterday", nil)
+	if err == nil || resp == nil || resp.StatusCode != 400 {
+		t.Errorf("expected a 400 for a bad since parameter, got %v", resp)
+	}
+}
+
+func TestHubSubscribe(t *testing.T) {
+	h := NewHub(HubConfig{})
+	ctx, cancel := context.WithCancel(context.Background())
+	updates, err := h.Subscribe(ctx, "10.0.0.1", &SubscriptionRequest{Type: wsSubscribe, CRNs: []int{2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = h.Subscribe(ctx, "10.0.0.1", &SubscriptionRequest{Type: "subscrib"}); err == nil {
+		t.Error("expected an error for a bad subscription request")
+	}
+	h.Publish([]*catalog.Entry{{CRN: 1}, {CRN: 2}})
+	select {
+	case entries := <-updates:
+		if len(entries) != 1 || entries[0].CRN != 2 {
+			t.Errorf("expected only crn 2, got %+v", entries)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no update")
+	}
+	cancel()
+	select {
+	case _, ok := <-updates:
+		if ok {
+			t.Error("expected the channel to be closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("channel was not closed")
+	}
+	waitFor(t, func() bool { return h.Len() == 0 })
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatal("timed out waiting for condition")
+}
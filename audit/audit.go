@@ -0,0 +1,156 @@
+// Package audit is an append-only log of security
+// related events like logins and admin actions.
+package audit
+
+import (
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+)
+
+// Actions that are recorded in the audit log.
+const (
+	Login          = "login"
+	LoginFailed    = "login.failed"
+	LoginLocked    = "login.locked"
+	LoginDisabled  = "login.disabled"
+	LoginThrottled = "login.throttled"
+	AccountLocked  = "account.locked"
+	TokenRefresh   = "token.refresh"
+	Signup         = "signup"
+	UserCreate     = "user.create"
+	UserUpdate     = "user.update"
+	UserDelete     = "user.delete"
+	PasswordChange = "password.change"
+	EmailChange    = "email.change"
+	EmailVerify    = "email.verify"
+	APIKeyCreate   = "apikey.create"
+	APIKeyRevoke   = "apikey.revoke"
+
+	AdminUserCreate    = "admin.user.create"
+	AdminUserDelete    = "admin.user.delete"
+	AdminPromote       = "admin.promote"
+	AdminDemote        = "admin.demote"
+	AdminDisable       = "admin.disable"
+	AdminEnable        = "admin.enable"
+	AdminLock          = "admin.lock"
+	AdminUnlock        = "admin.unlock"
+	AdminResetPassword = "admin.reset_password"
+)
+
+// Entry is one event in the audit log.
+type Entry struct {
+	ID int64 `db:"id" json:"id"`
+	// ActorID is the user that did the action,
+	// nil when the user is not known.
+	ActorID *int   `db:"actor_id" json:"actor_id"`
+	Action  string `db:"action" json:"action"`
+	// Target is what the action was done to, "user:<id>"
+	// for users and "name:<name>" for login attempts.
+	Target    string    `db:"target" json:"target"`
+	IP        string    `db:"ip" json:"ip"`
+	UserAgent string    `db:"user_agent" json:"user_agent"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// Log is the audit log stored in the database.
+type Log struct {
+	db *sqlx.DB
+}
+
+// New creates a new audit log.
+func New(db *sqlx.DB) *Log {
+	return &Log{db: db}
+}
+
+// Write will add an entry to the audit log.
+func (l *Log) Write(e *Entry) error {
+	query, args, err := l.db.BindNamed(`
+	  INSERT INTO
+	    audit_log (actor_id, action, target, ip, user_agent)
+	  VALUES (:actor_id, :action, :target, :ip, :user_agent)
+	  RETURNING id, created_at`, e)
+	if err != nil {
+		return err
+	}
+	return l.db.QueryRowx(query, args...).Scan(&e.ID, &e.CreatedAt)
+}
+
+// Filter selects entries from the audit log. Zero
+// values are ignored.
+type Filter struct {
+	ActorID *int      `form:"actor"`
+	Action  string    `form:"action"`
+	Target  string    `form:"target"`
+	IP      string    `form:"ip"`
+	Since   time.Time `form:"since" time_format:"2006-01-02T15:04:05Z07:00"`
+	Until   time.Time `form:"until" time_format:"2006-01-02T15:04:05Z07:00"`
+	Limit   uint64    `form:"limit"`
+	Offset  uint64    `form:"offset"`
+}
+
+// Query will find entries in the audit log, newest first.
+func (l *Log) Query(f *Filter) ([]*Entry, error) {
+	query, args, err := f.query().ToSql()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*Entry, 0)
+	return entries, l.db.Select(&entries, query, args...)
+}
+
+// Prune will delete entries older than the retention period
+// and returns the number of entries deleted.
+func (l *Log) Prune(retention time.Duration) (int64, error) {
+	res, err := l.db.Exec(
+		"DELETE FROM audit_log WHERE created_at < $1",
+		time.Now().Add(-retention),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+const (
+	defaultLimit = 100
+	maxLimit     = 1000
+)
+
+func (f *Filter) query() sq.SelectBuilder {
+	q := sq.StatementBuilder.
+		PlaceholderFormat(sq.Dollar).
+		Select("*").
+		From("audit_log").
+		OrderBy("id DESC")
+	if f.ActorID != nil {
+		q = q.Where(sq.Eq{"actor_id": *f.ActorID})
+	}
+	if f.Action != "" {
+		q = q.Where(sq.Eq{"action": f.Action})
+	}
+	if f.Target != "" {
+		q = q.Where(sq.Eq{"target": f.Target})
+	}
+	if f.IP != "" {
+		q = q.Where(sq.Eq{"ip": f.IP})
+	}
+	if !f.Since.IsZero() {
+		q = q.Where(sq.GtOrEq{"created_at": f.Since})
+	}
+	if !f.Until.IsZero() {
+		q = q.Where(sq.Lt{"created_at": f.Until})
+	}
+	limit := f.Limit
+	if limit == 0 {
+		limit = defaultLimit
+	} else if limit > maxLimit {
+		limit = maxLimit
+	}
+	q = q.Limit(limit)
+	if f.Offset > 0 {
+		q = q.Offset(f.Offset)
+	}
+	return q
+}
@@ -0,0 +1,53 @@
+package audit
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFilterQuery(t *testing.T) {
+	var (
+		id    = 3
+		since = time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	)
+	for _, tst := range []struct {
+		filter Filter
+		query  string
+		args   []interface{}
+	}{
+		{
+			Filter{},
+			"SELECT * FROM audit_log ORDER BY id DESC LIMIT 100",
+			nil,
+		},
+		{
+			Filter{ActorID: &id, Action: LoginFailed},
+			"SELECT * FROM audit_log WHERE actor_id = $1 AND action = $2 ORDER BY id DESC LIMIT 100",
+			[]interface{}{3, LoginFailed},
+		},
+		{
+			Filter{IP: "10.0.0.1", Since: since, Limit: 5, Offset: 10},
+			"SELECT * FROM audit_log WHERE ip = $1 AND created_at >= $2 ORDER BY id DESC LIMIT 5 OFFSET 10",
+			[]interface{}{"10.0.0.1", since},
+		},
+		{
+			Filter{Target: "user:3", Until: since, Limit: 5000},
+			"SELECT * FROM audit_log WHERE target = $1 AND created_at < $2 ORDER BY id DESC LIMIT 1000",
+			[]interface{}{"user:3", since},
+		},
+	} {
+		query, args, err := tst.filter.query().ToSql()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if query != tst.query {
+			t.Errorf("wrong query:\ngot  %s\nwant %s", query, tst.query)
+		}
+		if len(args) != 0 || len(tst.args) != 0 {
+			if !reflect.DeepEqual(args, tst.args) {
+				t.Errorf("wrong args: got %v, want %v", args, tst.args)
+			}
+		}
+	}
+}
@@ -1,12 +1,6 @@
 package catalog
 
-import (
-	"fmt"
-	"strings"
-
-	"github.com/lib/pq"
-	"github.com/mercedtime/api/db"
-)
+import "github.com/lib/pq"
 
 // CourseBlueprint is an overview of all of the instances of one course.
 // It tells what the course subject and number are and contains a list
@@ -25,31 +19,6 @@ type CourseBlueprint struct {
 	Count     int           `db:"count" json:"count"`
 }
 
-const blueprintQuery = `
-	SELECT
-		  subject,
-		  course_num,
-		  (array_agg(title))[1] AS title,
-		  min(units) AS min_units,
-		  max(units) AS max_units,
-		  sum(c.enrolled) AS enrolled,
-		  sum(c.capacity) AS capacity,
-		  sum(c.enrolled)::float / sum(c.capacity)::float AS percent,
-		  array_agg(c.crn) AS crns,
-		  array_agg(c.id) AS ids,
-		  count(*) AS count
-	  FROM
-		  course c
-	 WHERE 0 = 0
-		  %s
-  GROUP BY
-		  subject,
-		  course_num
-  ORDER BY
-		  subject ASC,
-		  course_num ASC
-  LIMIT $%d OFFSET $%d`
-
 // BlueprintParams is the set of
 // parameters for the blueprint query.
 type BlueprintParams struct {
@@ -58,35 +27,9 @@ type BlueprintParams struct {
 	Units int `query:"units" form:"units"`
 }
 
-// GetBlueprints will
-func GetBlueprints(params *BlueprintParams) ([]*CourseBlueprint, error) {
-	var (
-		where string
-		err   error
-		db    = db.Get()
-		args  = make([]interface{}, 0, 2)
-		resp  = make([]*CourseBlueprint, 0, 350)
-	)
-	if params.Subject != "" {
-		where += "AND subject = $1 "
-		args = append(args, strings.ToUpper(params.Subject))
-	}
-	if params.Term != "" {
-		where += "AND term_id = $2 "
-		args = append(args, GetTermID(params.Term))
-	}
-	if params.Year != 0 {
-		where += "AND year = $3 "
-		args = append(args, params.Year)
-	}
-	// TODO add other parameters to the query
-	l := len(args) + 1
-	err = db.Select(
-		&resp, fmt.Sprintf(blueprintQuery, where, l, l+1),
-		append(args, params.Limit, params.Offset)...,
-	)
-	if err != nil {
-		return nil, err
-	}
-	return resp, err
+// Query returns the blueprint query for the params.
+func (p *BlueprintParams) Query() *Query {
+	f := p.SemesterParams.Filter()
+	f.Units = p.Units
+	return &Query{From: FromBlueprints, Filter: f, Page: p.PageParams}
 }
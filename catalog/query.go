@@ -0,0 +1,266 @@
+package catalog
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+)
+
+// Source is the table or view that a query selects from.
+type Source int
+
+const (
+	// FromCourses selects rows of the course table.
+	FromCourses Source = iota
+	// FromCatalog selects from the catalog view, which
+	// has the subcourses and exam of every course.
+	FromCatalog
+	// FromBlueprints groups the courses by
+	// subject and course number.
+	FromBlueprints
+)
+
+// PrimaryTypes are the types of courses that are not
+// taken along side some other course.
+var PrimaryTypes = []string{"LECT", "SEM", "STDO"}
+
+// Filter selects the courses of a query. Zero values
+// do not filter anything, except that cancelled sections
+// are left out unless Cancelled is set.
+type Filter struct {
+	Subject   string
+	CourseNum int
+	Year      int
+	TermID    int
+	Units     int
+	// Course types like LECT or LAB
+	Types []string
+	CRNs  []int
+	IDs   []int
+	// Include cancelled sections
+	Cancelled bool
+}
+
+// Order is the sort order of a query.
+type Order string
+
+// Queries are sorted by id or by subject and course number for
+// blueprints. The other orders are descending.
+const (
+	OrderDefault   Order = ""
+	OrderUpdated   Order = "updated_at"
+	OrderCapacity  Order = "capacity"
+	OrderEnrolled  Order = "enrolled"
+	OrderRemaining Order = "remaining"
+)
+
+// ParseOrder returns the order with a name, it returns
+// false if there is no such order.
+func ParseOrder(name string) (Order, bool) {
+	switch o := Order(name); o {
+	case OrderDefault, OrderUpdated, OrderCapacity, OrderEnrolled, OrderRemaining:
+		return o, true
+	}
+	return OrderDefault, false
+}
+
+// Query is a query of the course catalog.
+type Query struct {
+	From   Source
+	Filter Filter
+	Order  Order
+	Page   PageParams
+	// Columns to select, every column if empty
+	Columns []string
+}
+
+var psql = sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
+
+var (
+	courseColumns  = columnsOf(Entry{})
+	catalogColumns = columnsOf(Course{})
+	// aggregates of the course table in the same order
+	// as the fields of CourseBlueprint
+	blueprintColumns = []struct{ name, expr string }{
+		{"subject", "subject"},
+		{"course_num", "course_num"},
+		{"title", "(array_agg(title))[1]"},
+		{"min_units", "min(units)"},
+		{"max_units", "max(units)"},
+		{"enrolled", "sum(enrolled)"},
+		{"capacity", "sum(capacity)"},
+		{"percent", "sum(enrolled)::float / sum(capacity)::float"},
+		{"crns", "array_agg(crn)"},
+		{"ids", "array_agg(id)"},
+		{"count", "count(*)"},
+	}
+)
+
+// ToSQL returns the sql of the query and its arguments.
+func (q *Query) ToSQL() (string, []interface{}, error) {
+	var (
+		b   sq.SelectBuilder
+		err error
+	)
+	switch q.From {
+	case FromCourses:
+		b, err = q.selectCourses("course", courseColumns)
+	case FromCatalog:
+		b, err = q.selectCourses("catalog", catalogColumns)
+	case FromBlueprints:
+		b, err = q.selectBlueprints()
+	default:
+		err = fmt.Errorf("unknown query source %d", q.From)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	b = q.Filter.where(b)
+	if q.Page.Limit != nil {
+		b = b.Limit(uint64(*q.Page.Limit))
+	}
+	if q.Page.Offset != nil {
+		b = b.Offset(uint64(*q.Page.Offset))
+	}
+	return b.ToSql()
+}
+
+// Select runs the query and scans the rows into dest.
+func (q *Query) Select(ctx context.Context, db sqlx.QueryerContext, dest interface{}) error {
+	query, args, err := q.ToSQL()
+	if err != nil {
+		return err
+	}
+	return sqlx.SelectContext(ctx, db, dest, query, args...)
+}
+
+// Courses runs a query of the course table or the catalog.
+func (q *Query) Courses(ctx context.Context, db sqlx.QueryerContext) ([]*Course, error) {
+	resp := make([]*Course, 0)
+	return resp, q.Select(ctx, db, &resp)
+}
+
+// Blueprints runs a blueprint query.
+func (q *Query) Blueprints(ctx context.Context, db sqlx.QueryerContext) ([]*CourseBlueprint, error) {
+	resp := make([]*CourseBlueprint, 0)
+	return resp, q.Select(ctx, db, &resp)
+}
+
+func (q *Query) selectCourses(table string, columns map[string]bool) (sq.SelectBuilder, error) {
+	cols := []string{"*"}
+	if len(q.Columns) > 0 {
+		for _, c := range q.Columns {
+			if !columns[c] {
+				return sq.SelectBuilder{}, fmt.Errorf("%s has no column %q", table, c)
+			}
+		}
+		cols = q.Columns
+	}
+	b := psql.Select(cols...).From(table)
+	switch q.Order {
+	case OrderDefault:
+		return b.OrderBy("id"), nil
+	case OrderUpdated, OrderCapacity, OrderEnrolled, OrderRemaining:
+		return b.OrderBy(string(q.Order)+" DESC", "id"), nil
+	}
+	return b, fmt.Errorf("cannot order courses by %q", q.Order)
+}
+
+func (q *Query) selectBlueprints() (sq.SelectBuilder, error) {
+	cols := make([]string, 0, len(blueprintColumns))
+	for _, c := range blueprintColumns {
+		if len(q.Columns) > 0 && !contains(q.Columns, c.name) {
+			continue
+		}
+		if c.expr == c.name {
+			cols = append(cols, c.name)
+		} else {
+			cols = append(cols, c.expr+" AS "+c.name)
+		}
+	}
+	if len(cols) < len(q.Columns) {
+		return sq.SelectBuilder{}, fmt.Errorf("unknown blueprint columns in %v", q.Columns)
+	}
+	b := psql.Select(cols...).From("course").GroupBy("subject", "course_num")
+	switch q.Order {
+	case OrderDefault:
+		return b.OrderBy("subject", "course_num"), nil
+	case OrderCapacity, OrderEnrolled:
+		// Order by the aggregate because the
+		// column might not have been selected.
+		return b.OrderBy(blueprintExpr(string(q.Order))+" DESC", "subject", "course_num"), nil
+	}
+	return b, fmt.Errorf("cannot order blueprints by %q", q.Order)
+}
+
+func blueprintExpr(name string) string {
+	for _, c := range blueprintColumns {
+		if c.name == name {
+			return c.expr
+		}
+	}
+	return name
+}
+
+func (f *Filter) where(b sq.SelectBuilder) sq.SelectBuilder {
+	if f.Subject != "" {
+		b = b.Where(sq.Eq{"subject": strings.ToUpper(f.Subject)})
+	}
+	if f.CourseNum != 0 {
+		b = b.Where(sq.Eq{"course_num": f.CourseNum})
+	}
+	if f.Year != 0 {
+		b = b.Where(sq.Eq{"year": f.Year})
+	}
+	if f.TermID != 0 {
+		b = b.Where(sq.Eq{"term_id": f.TermID})
+	}
+	if f.Units != 0 {
+		b = b.Where(sq.Eq{"units": f.Units})
+	}
+	if len(f.Types) > 0 {
+		b = b.Where(sq.Eq{"type": f.Types})
+	}
+	if len(f.CRNs) > 0 {
+		b = b.Where(sq.Eq{"crn": f.CRNs})
+	}
+	if len(f.IDs) > 0 {
+		b = b.Where(sq.Eq{"id": f.IDs})
+	}
+	if !f.Cancelled {
+		b = b.Where(sq.Eq{"cancelled_at": nil})
+	}
+	return b
+}
+
+// columnsOf returns the db columns of a struct's fields.
+func columnsOf(v interface{}) map[string]bool {
+	cols := make(map[string]bool)
+	t := reflect.TypeOf(v)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			for c := range columnsOf(reflect.Zero(f.Type).Interface()) {
+				cols[c] = true
+			}
+			continue
+		}
+		if name := f.Tag.Get("db"); name != "" && name != "-" {
+			cols[name] = true
+		}
+	}
+	return cols
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
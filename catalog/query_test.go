@@ -0,0 +1,190 @@
+package catalog
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// filterFields are the filters in the order that they are added to
+// the where clause. The sql has one placeholder for every argument,
+// it is in the query when the filter is set, or when it is not set for
+// the unset filters.
+var filterFields = []struct {
+	set   func(*Filter)
+	sql   string
+	args  []interface{}
+	unset bool
+}{
+	{func(f *Filter) { f.Subject = "cse" }, "subject = ?", []interface{}{"CSE"}, false},
+	{func(f *Filter) { f.CourseNum = 31 }, "course_num = ?", []interface{}{31}, false},
+	{func(f *Filter) { f.Year = 2021 }, "year = ?", []interface{}{2021}, false},
+	{func(f *Filter) { f.TermID = 3 }, "term_id = ?", []interface{}{3}, false},
+	{func(f *Filter) { f.Units = 4 }, "units = ?", []interface{}{4}, false},
+	{func(f *Filter) { f.Types = PrimaryTypes }, "type IN (?,?,?)", []interface{}{"LECT", "SEM", "STDO"}, false},
+	{func(f *Filter) { f.CRNs = []int{10, 11} }, "crn IN (?,?)", []interface{}{10, 11}, false},
+	{func(f *Filter) { f.IDs = []int{1} }, "id IN (?)", []interface{}{1}, false},
+	{func(f *Filter) { f.Cancelled = true }, "cancelled_at IS NULL", nil, true},
+}
+
+func TestQueryFilters(t *testing.T) {
+	sources := []struct {
+		from     Source
+		sel, end string
+	}{
+		{FromCourses, "SELECT * FROM course", " ORDER BY id"},
+		{FromCatalog, "SELECT * FROM catalog", " ORDER BY id"},
+		{FromBlueprints, "SELECT " + blueprintSelect() + " FROM course", " GROUP BY subject, course_num ORDER BY subject, course_num"},
+	}
+	for _, src := range sources {
+		// every combination of filters
+		for mask := 0; mask < 1<<len(filterFields); mask++ {
+			var (
+				q       = Query{From: src.from}
+				clauses []string
+				args    []interface{}
+			)
+			for i, field := range filterFields {
+				set := mask&(1<<i) != 0
+				if set {
+					field.set(&q.Filter)
+				}
+				if set == field.unset {
+					continue
+				}
+				clauses = append(clauses, field.sql)
+				args = append(args, field.args...)
+			}
+			want := src.sel
+			if len(clauses) > 0 {
+				want += " WHERE " + strings.Join(clauses, " AND ")
+			}
+			want = dollars(want + src.end)
+
+			query, qargs, err := q.ToSQL()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if query != want {
+				t.Errorf("source %d filter %+v:\ngot  %s\nwant %s", src.from, q.Filter, query, want)
+			}
+			if len(args) == 0 {
+				args = nil
+			}
+			if !reflect.DeepEqual(qargs, args) {
+				t.Errorf("source %d filter %+v: got args %v, want %v", src.from, q.Filter, qargs, args)
+			}
+		}
+	}
+}
+
+func TestQuery(t *testing.T) {
+	limit, offset := uint(10), uint(20)
+	for _, tt := range []struct {
+		q    Query
+		sql  string
+		args []interface{}
+	}{
+		{
+			Query{Page: PageParams{Limit: &limit, Offset: &offset}},
+			"SELECT * FROM course WHERE cancelled_at IS NULL ORDER BY id LIMIT 10 OFFSET 20", nil,
+		},
+		{
+			Query{From: FromCatalog, Order: OrderRemaining, Page: PageParams{Limit: &limit}, Filter: Filter{Cancelled: true}},
+			"SELECT * FROM catalog ORDER BY remaining DESC, id LIMIT 10", nil,
+		},
+		{
+			Query{From: FromCatalog, Columns: []string{"crn", "subcourses"}, Filter: Filter{Year: 2021}},
+			"SELECT crn, subcourses FROM catalog WHERE year = $1 AND cancelled_at IS NULL ORDER BY id", []interface{}{2021},
+		},
+		{
+			Query{From: FromBlueprints, Columns: []string{"subject", "ids"}, Order: OrderEnrolled},
+			"SELECT subject, array_agg(id) AS ids FROM course WHERE cancelled_at IS NULL GROUP BY subject, course_num " +
+				"ORDER BY sum(enrolled) DESC, subject, course_num", nil,
+		},
+	} {
+		query, args, err := tt.q.ToSQL()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if query != tt.sql {
+			t.Errorf("got %s, want %s", query, tt.sql)
+		}
+		if !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("got args %v, want %v", args, tt.args)
+		}
+	}
+
+	for _, q := range []Query{
+		{From: Source(10)},
+		{Order: Order("title")},
+		{From: FromBlueprints, Order: OrderRemaining},
+		{Columns: []string{"exam"}},
+		{From: FromCatalog, Columns: []string{"crn; DROP TABLE course"}},
+		{From: FromBlueprints, Columns: []string{"crn"}},
+	} {
+		if _, _, err := q.ToSQL(); err == nil {
+			t.Errorf("expected an error for %+v", q)
+		}
+	}
+}
+
+func TestParseOrder(t *testing.T) {
+	if o, ok := ParseOrder("enrolled"); !ok || o != OrderEnrolled {
+		t.Error("could not parse enrolled")
+	}
+	if _, ok := ParseOrder("title"); ok {
+		t.Error("should not parse an unknown order")
+	}
+}
+
+func TestBlueprintParams(t *testing.T) {
+	var p BlueprintParams
+	p.Subject, p.Term, p.Units = "math", "fall", 4
+	query, args, err := p.Query().ToSQL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the subject filter can be left out without
+	// breaking the placeholders of the other filters
+	if !strings.Contains(query, "WHERE subject = $1 AND term_id = $2 AND units = $3") {
+		t.Errorf("wrong where clause in %s", query)
+	}
+	if !reflect.DeepEqual(args, []interface{}{"MATH", 3, 4}) {
+		t.Errorf("wrong args %v", args)
+	}
+	p.Subject = ""
+	query, args, _ = p.Query().ToSQL()
+	if !strings.Contains(query, "WHERE term_id = $1 AND units = $2 AND cancelled_at IS NULL") || len(args) != 2 {
+		t.Errorf("wrong query without subject %s %v", query, args)
+	}
+}
+
+func blueprintSelect() string {
+	cols := make([]string, len(blueprintColumns))
+	for i, c := range blueprintColumns {
+		cols[i] = c.expr
+		if c.expr != c.name {
+			cols[i] += " AS " + c.name
+		}
+	}
+	return strings.Join(cols, ", ")
+}
+
+// dollars numbers the ? placeholders of a query.
+func dollars(query string) string {
+	var (
+		b strings.Builder
+		n int
+	)
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/harrybrwn/config"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/mercedtime/api/users"
+)
+
+const adminUsage = `Usage: mt admin <command> [flags]
+
+Commands:
+  create-user   create a new user, use --admin to make them an admin`
+
+// runAdmin runs the admin subcommands that
+// manage the api without going through http.
+func runAdmin(args []string) error {
+	if len(args) == 0 {
+		return errors.New(adminUsage)
+	}
+	switch args[0] {
+	case "create-user":
+		return adminCreateUser(args[1:])
+	case "-h", "--help", "help":
+		fmt.Println(adminUsage)
+		return nil
+	default:
+		return errors.Errorf("unknown admin command %q\n\n%s", args[0], adminUsage)
+	}
+}
+
+func adminCreateUser(args []string) error {
+	var (
+		u        users.User
+		password string
+		flag     = pflag.NewFlagSet("create-user", pflag.ContinueOnError)
+	)
+	flag.StringVarP(&u.Name, "name", "n", "", "username of the new user")
+	flag.StringVarP(&u.Email, "email", "e", "", "email of the new user")
+	flag.StringVar(&password, "password", "", "password of the new user (prompted for if empty)")
+	flag.BoolVar(&u.IsAdmin, "admin", false, "give the new user admin privileges")
+	switch err := flag.Parse(args); err {
+	case nil:
+		break
+	case pflag.ErrHelp:
+		return nil
+	default:
+		return err
+	}
+	if u.Name == "" {
+		return errors.New("the new user needs a --name")
+	}
+
+	var conf = &Config{}
+	if err := conf.load(); err != nil {
+		return err
+	}
+	if conf.Auth.BcryptCost != 0 {
+		if err := users.SetCost(conf.Auth.BcryptCost); err != nil {
+			return err
+		}
+	}
+	db, err := sqlx.Connect(conf.Database.Driver, conf.GetDSN())
+	if err != nil {
+		return errors.Wrap(err, "could not connect to database")
+	}
+	defer db.Close()
+
+	if password == "" {
+		if password, err = readPassword(); err != nil {
+			return err
+		}
+	}
+	if err = users.Create(db, &u, password); err != nil {
+		return errors.Wrap(err, "could not create user")
+	}
+	role := "user"
+	if u.IsAdmin {
+		role = "admin"
+	}
+	fmt.Printf("created %s %q with id %d\n", role, u.Name, u.ID)
+	return nil
+}
+
+// load reads the config file without parsing command line flags.
+func (c *Config) load() error {
+	c.bind()
+	if err := config.ReadConfigFile(); err != nil {
+		log.Println("Warning:", err)
+	}
+	return config.InitDefaults()
+}
+
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return "", errors.New("no --password given and stdin is not a terminal")
+	}
+	fmt.Print("Password: ")
+	pw, err := terminal.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+	fmt.Print("Confirm password: ")
+	confirm, err := terminal.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+	if !bytes.Equal(pw, confirm) {
+		return "", errors.New("passwords do not match")
+	}
+	if len(pw) == 0 {
+		return "", errors.New("empty password")
+	}
+	return string(pw), nil
+}
@@ -1,14 +1,17 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -21,11 +24,16 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/pkg/errors"
 	"github.com/ulule/limiter/v3"
-	ginlimit "github.com/ulule/limiter/v3/drivers/middleware/gin"
 )
 
 func main() {
-	if err := run(); err != nil {
+	var err error
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		err = runAdmin(os.Args[2:])
+	} else {
+		err = run()
+	}
+	if err != nil {
 		log.Println(err)
 	}
 }
@@ -40,11 +48,15 @@ type Config struct {
 }
 
 func (c *Config) setup() error {
+	c.bind()
+	return c.Init()
+}
+
+func (c *Config) bind() {
 	config.SetFilename("mt.yml")
 	config.SetType("yml")
 	config.AddPath(".")
 	config.SetConfig(c)
-	return c.Init()
 }
 
 func run() error {
@@ -66,6 +78,8 @@ func run() error {
 	}
 	defer a.Close()
 	a.Engine = r
+	stopRetention := a.StartAuditRetention(time.Hour)
+	defer stopRetention()
 
 	logrus.SetOutput(os.Stdout)
 	l := logrus.New()
@@ -77,13 +91,10 @@ func run() error {
 		return errors.Wrap(err, "could not create auth middleware")
 	}
 
-	r.Use(ginlimit.NewMiddleware(limiter.New(
-		a.RateStore,
-		limiter.Rate{
-			Period: time.Second,
-			Limit:  5,
-		}),
-	))
+	r.Use(a.RateLimit(limiter.Rate{
+		Period: time.Second,
+		Limit:  5,
+	}))
 	v1 := r.Group("/api/v1")
 	if config.GetString("mode") == "debug" || true {
 		r.Use(cors)
@@ -93,9 +104,16 @@ func run() error {
 		fmt.Println(c)
 	})
 	v1.OPTIONS("/user", func(c *gin.Context) { c.Status(204) })
+	v1.OPTIONS("/user/:id", func(c *gin.Context) { c.Status(204) })
+	v1.OPTIONS("/user/:id/password", func(c *gin.Context) { c.Status(204) })
 	a.RegisterRoutes(v1)
 
-	r.POST("/graphql", gql.Handler(a.DB))
+	graphql, err := gql.Handler(a)
+	if err != nil {
+		return errors.Wrap(err, "could not create graphql handler")
+	}
+	r.POST("/graphql", a.OptionalAuth, graphql)
+	r.GET("/graphql", a.OptionalAuth, graphql) // subscriptions
 	r.GET("/graphql/playground", gql.Playground("/graphql"))
 
 	v1.OPTIONS("/auth/login", func(c *gin.Context) { c.Status(204) })
@@ -106,22 +124,25 @@ func run() error {
 	v1.GET("/auth/logout", auth.LogoutHandler)
 
 	v1.OPTIONS("/auth/refresh", func(c *gin.Context) { c.Status(204) })
-	v1.GET("/auth/refresh", auth.RefreshHandler)
+	v1.GET("/auth/refresh", a.RefreshToken)
+
+	if conf.OIDC.Issuer != "" {
+		oidc, err := a.NewOIDC(conf.OIDC)
+		if err != nil {
+			return errors.Wrap(err, "could not create oidc login")
+		}
+		v1.GET("/auth/oidc/login", oidc.Login)
+		v1.GET("/auth/oidc/callback", oidc.Callback)
+	}
 
 	r.OPTIONS("/signup", func(c *gin.Context) { c.Status(204) })
 	r.POST("/signup", a.SilentCreateUser, auth.LoginHandler)
 
-	r.GET("/admin", auth.MiddlewareFunc(), func(c *gin.Context) {
-		c.JSON(200, map[string]interface{}{
-			"success": "yay",
-		})
-	})
-
 	logrus.Debug("testing logger")
 	return listen(conf, a)
 }
 
-func listen(conf *Config, h http.Handler) error {
+func listen(conf *Config, a *app.App) error {
 	var addr = net.JoinHostPort(conf.Host, strconv.FormatInt(conf.Port, 10))
 
 	cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
@@ -131,7 +152,7 @@ func listen(conf *Config, h http.Handler) error {
 	}
 	srv := http.Server{
 		Addr:           addr,
-		Handler:        h,
+		Handler:        a,
 		ReadTimeout:    time.Minute * 5,
 		WriteTimeout:   time.Minute * 5,
 		MaxHeaderBytes: http.DefaultMaxHeaderBytes,
@@ -142,13 +163,34 @@ func listen(conf *Config, h http.Handler) error {
 		// TLSNextProto: map[string]func(s *http.Server, conn *tls.Conn, h http.Handler){},
 	}
 
-	fmt.Printf("\n\nRunning on ")
-	if conf.TLS {
-		fmt.Printf("\x1b[32;4mhttps://%s\x1b[0m\n", addr)
-		return srv.ListenAndServeTLS("", "")
+	errs := make(chan error, 1)
+	go func() {
+		fmt.Printf("\n\nRunning on ")
+		if conf.TLS {
+			fmt.Printf("\x1b[32;4mhttps://%s\x1b[0m\n", addr)
+			errs <- srv.ListenAndServeTLS("", "")
+		} else {
+			fmt.Printf("\x1b[32;4mhttp://%s\x1b[0m\n", addr)
+			errs <- srv.ListenAndServe()
+		}
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err = <-errs:
+		return err
+	case sig := <-sigs:
+		log.Printf("got %v, shutting down\n", sig)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	// http.Server.Shutdown does not close hijacked connections
+	// and waits for event streams so the hub is closed first.
+	if err = a.Hub.Shutdown(ctx); err != nil {
+		log.Println("could not close websockets:", err)
 	}
-	fmt.Printf("\x1b[32;4mhttp://%s\x1b[0m\n", addr)
-	return srv.ListenAndServe()
+	return srv.Shutdown(ctx)
 }
 
 var upgrader = websocket.Upgrader{
@@ -165,10 +207,11 @@ func unauthorized(c *gin.Context, mw *ginjwt.GinJWTMiddleware, msg string) {
 
 func cors(c *gin.Context) {
 	c.Header("Access-Control-Allow-Origin", "*")
-	c.Header("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
+	c.Header("Access-Control-Allow-Methods", "POST, GET, PUT, PATCH, OPTIONS")
 	c.Header("Access-Control-Allow-Headers", strings.Join([]string{
 		"Content-Type",
 		"Authorization",
+		"X-API-Key",
 	}, ","))
 	c.Next()
 }
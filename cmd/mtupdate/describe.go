@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/harrybrwn/edu/school/ucmerced/ucm"
+)
+
+const (
+	defaultDescriptionTTL  = 7 * 24 * time.Hour
+	defaultDescriptionRate = 20 // requests per second
+	descriptionAttempts    = 4
+	descriptionBackoff     = 500 * time.Millisecond
+)
+
+// describer gets course descriptions. Descriptions are shared by every
+// section of a course and rarely change so they are cached by subject
+// and course number and only fetched again when they expire or when
+// the title of the course changes.
+type describer struct {
+	path string // cache file, the cache is not saved if empty
+	ttl  time.Duration
+
+	mu      sync.Mutex // guards entries and dirty
+	entries map[string]*descEntry
+	dirty   bool
+
+	rateMu   sync.Mutex
+	interval time.Duration // time between requests
+	next     time.Time
+
+	src   ScheduleSource
+	sleep func(time.Duration) // replaced in tests
+}
+
+type descEntry struct {
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	FetchedAt   time.Time `json:"fetched_at"`
+}
+
+// newDescriber creates a describer that gets descriptions
+// from src and loads the cache file named in the config.
+func newDescriber(conf *updateConfig, src ScheduleSource) (*describer, error) {
+	d := &describer{
+		path:     conf.DescriptionCache,
+		ttl:      time.Duration(conf.DescriptionTTLHours) * time.Hour,
+		entries:  make(map[string]*descEntry),
+		interval: time.Second / defaultDescriptionRate,
+		src:      src,
+		sleep:    time.Sleep,
+	}
+	if d.ttl <= 0 {
+		d.ttl = defaultDescriptionTTL
+	}
+	if conf.DescriptionRate > 0 {
+		d.interval = time.Second / time.Duration(conf.DescriptionRate)
+	}
+	if d.path == "" {
+		return d, nil
+	}
+	b, err := ioutil.ReadFile(d.path)
+	if os.IsNotExist(err) {
+		return d, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, &d.entries); err != nil {
+		return nil, fmt.Errorf("could not read description cache %s: %w", d.path, err)
+	}
+	return d, nil
+}
+
+func descKey(c *ucm.Course) string {
+	return fmt.Sprintf("%s %d", c.Subject, c.Number)
+}
+
+// fresh returns true if the course has a cached description
+// that has not expired and has the same title.
+func (d *describer) fresh(c *ucm.Course) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e, ok := d.entries[descKey(c)]
+	return ok && e.Title == c.Title && time.Since(e.FetchedAt) < d.ttl
+}
+
+// get returns the cached description of a course,
+// which may be expired.
+func (d *describer) get(c *ucm.Course) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e, ok := d.entries[descKey(c)]; ok {
+		return e.Description
+	}
+	return ""
+}
+
+// refresh fetches the description of a course and caches it. When
+// every attempt fails the cached description is kept if there is
+// one. No more attempts are made once the context is done.
+func (d *describer) refresh(ctx context.Context, c *ucm.Course) error {
+	var (
+		desc    string
+		err     error
+		backoff = descriptionBackoff
+	)
+	for i := 0; i < descriptionAttempts; i++ {
+		if i > 0 {
+			d.sleep(backoff)
+			backoff *= 2
+		}
+		d.wait()
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if desc, err = d.src.Description(c); err == nil && desc != "" {
+			break
+		}
+		if err == nil {
+			err = fmt.Errorf("empty description for %s", descKey(c))
+		}
+	}
+	if err != nil {
+		if d.get(c) != "" {
+			log.Printf("could not get description for %s, using the cached one: %v", descKey(c), err)
+			return nil
+		}
+		return err
+	}
+	d.mu.Lock()
+	d.entries[descKey(c)] = &descEntry{
+		Title:       c.Title,
+		Description: desc,
+		FetchedAt:   time.Now(),
+	}
+	d.dirty = true
+	d.mu.Unlock()
+	return nil
+}
+
+// wait blocks until another request can be made so that
+// concurrent workers stay under the request rate.
+func (d *describer) wait() {
+	d.rateMu.Lock()
+	now := time.Now()
+	if d.next.Before(now) {
+		d.next = now
+	}
+	delay := d.next.Sub(now)
+	d.next = d.next.Add(d.interval)
+	d.rateMu.Unlock()
+	if delay > 0 {
+		d.sleep(delay)
+	}
+}
+
+// save writes the cache file if there are new descriptions.
+func (d *describer) save() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.path == "" || !d.dirty {
+		return nil
+	}
+	b, err := json.Marshal(d.entries)
+	if err != nil {
+		return err
+	}
+	// write then rename so that a crash does not leave half a file
+	tmp := d.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, d.path); err != nil {
+		return err
+	}
+	d.dirty = false
+	return nil
+}
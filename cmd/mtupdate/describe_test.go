@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/harrybrwn/edu/school/ucmerced/ucm"
+)
+
+type fakeInfo struct {
+	mu    sync.Mutex
+	calls map[string]int
+	fail  bool
+}
+
+func (f *fakeInfo) Schedule(int, string) (ucm.Schedule, error) {
+	return nil, errors.New("no schedule")
+}
+
+func (f *fakeInfo) Description(c *ucm.Course) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls[descKey(c)]++
+	if f.fail {
+		return "", errors.New("registrar is down")
+	}
+	return "About " + c.Title, nil
+}
+
+func testDescriber(t *testing.T, conf *updateConfig) (*describer, *fakeInfo) {
+	t.Helper()
+	f := &fakeInfo{calls: make(map[string]int)}
+	d, err := newDescriber(conf, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.sleep = func(time.Duration) {}
+	return d, f
+}
+
+func TestGetCourseTableCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mtupdate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := &updateConfig{DescriptionCache: filepath.Join(dir, "descriptions.json")}
+	courses := []*ucm.Course{
+		{CRN: 1, Subject: "CSE", Number: 100, Title: "Algorithms", Activity: "LECT"},
+		{CRN: 2, Subject: "CSE", Number: 100, Title: "Algorithms", Activity: "LAB"},
+		{CRN: 3, Subject: "MATH", Number: 21, Title: "Calculus", Activity: "LECT"},
+	}
+	d, f := testDescriber(t, conf)
+	table, err := GetCourseTable(context.Background(), courses, d, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(table) != 3 || f.calls["CSE 100"] != 1 || f.calls["MATH 21"] != 1 {
+		t.Fatalf("expected one request per course, got %v for %d entries", f.calls, len(table))
+	}
+
+	// a new run reads the cache file and only asks
+	// for the course with a different title
+	courses[2].Title = "Calculus I"
+	d, f = testDescriber(t, conf)
+	table, err = GetCourseTable(context.Background(), courses, d, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.calls["CSE 100"] != 0 || f.calls["MATH 21"] != 1 {
+		t.Errorf("expected only the changed course to be requested, got %v", f.calls)
+	}
+	for _, e := range table {
+		if e.CRN == 3 && e.Description != "About Calculus I" {
+			t.Errorf("wrong description %q", e.Description)
+		}
+	}
+
+	// expired descriptions are kept when the registrar fails
+	d, f = testDescriber(t, conf)
+	d.ttl = time.Nanosecond
+	f.fail = true
+	table, err = GetCourseTable(context.Background(), courses, d, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(table) != 3 || f.calls["CSE 100"] != descriptionAttempts {
+		t.Errorf("expected %d attempts and the cached descriptions, got %v for %d entries",
+			descriptionAttempts, f.calls, len(table))
+	}
+
+	// courses without any description are left out
+	courses = append(courses, &ucm.Course{CRN: 4, Subject: "PHYS", Number: 8, Title: "Physics"})
+	table, err = GetCourseTable(context.Background(), courses, d, 4)
+	if err == nil || len(table) != 3 {
+		t.Errorf("expected an error and 3 entries, got %v and %d entries", err, len(table))
+	}
+}
+
+func TestGetCourseTableCancelled(t *testing.T) {
+	d, f := testDescriber(t, &updateConfig{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	courses := []*ucm.Course{{CRN: 1, Subject: "CSE", Number: 100, Title: "Algorithms"}}
+	if _, err := GetCourseTable(ctx, courses, d, 4); err != context.Canceled {
+		t.Errorf("expected the context error, got %v", err)
+	}
+	if len(f.calls) != 0 {
+		t.Errorf("expected no requests, got %v", f.calls)
+	}
+}
+
+func TestDescriberRate(t *testing.T) {
+	d, _ := testDescriber(t, &updateConfig{DescriptionRate: 10})
+	var slept time.Duration
+	d.sleep = func(s time.Duration) { slept += s }
+	for i := 0; i < 5; i++ {
+		d.wait()
+	}
+	// nothing really sleeps so the requests queue up
+	// 100ms apart, the first one does not wait
+	if slept < 900*time.Millisecond || slept > time.Second {
+		t.Errorf("expected to wait about 1s in total, waited %v", slept)
+	}
+}
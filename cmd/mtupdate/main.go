@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"hash/fnv"
@@ -11,9 +12,10 @@ import (
 	"sync"
 	"time"
 
-	"github.com/mercedtime/api/app"
 	"github.com/mercedtime/api/catalog"
+	"github.com/mercedtime/api/db"
 	"github.com/mercedtime/api/db/models"
+	"github.com/mercedtime/api/publish"
 
 	"github.com/agnivade/levenshtein"
 	"github.com/harrybrwn/config"
@@ -33,12 +35,35 @@ type updateConfig struct {
 	Host string `config:"host"`
 	Port int    `config:"port"`
 
-	Database app.DatabaseConfig `config:"db" yaml:"db"`
-	Year     int                `config:"year"`
-	Term     string             `config:"term"`
+	Database db.Config `config:"db" yaml:"db"`
+	Year     int       `config:"year"`
+	Term     string    `config:"term"`
 
 	SkipCourses bool   `config:"skipcourses"`
 	Logfile     string `config:"logfile" default:"mtupdate.log"`
+
+	// Course descriptions are cached in a file and requested again
+	// after the ttl or when a course's title changes. The rate is the
+	// most description requests made per second.
+	DescriptionCache    string `config:"description_cache"`
+	DescriptionTTLHours int    `config:"description_ttl_hours"`
+	DescriptionRate     int    `config:"description_rate"`
+
+	// Used to sign requests to the update endpoint,
+	// UpdateToken is an admin token used as a fallback.
+	UpdateSecret string `config:"update_secret" env:"UPDATE_SECRET"`
+	UpdateToken  string `config:"update_token" env:"MT_UPDATE_TOKEN"`
+
+	// Same as the api config, with "postgres" the api is
+	// notified from the database instead of over http.
+	Broadcaster   string `config:"broadcaster"`
+	UpdateHistory int    `config:"update_history"`
+
+	// The most courses of a term, as a percent, that
+	// one update will cancel. The default is 20.
+	MaxCancelPercent int `config:"max_cancel_percent"`
+
+	Serve serveConfig `config:"serve" yaml:"serve"`
 }
 
 func (conf *updateConfig) init() {
@@ -59,9 +84,12 @@ func run() error {
 	var (
 		dbOpsOnly, csvOps            = false, false
 		noEnrollment, enrollmentOnly = false, false
+		dry, report                  = false, "text"
+		record, replay               string
+		massCancel                   bool
 
 		conf = updateConfig{
-			Database: app.DatabaseConfig{
+			Database: db.Config{
 				Driver: "postgres",
 				User:   "mt",
 				Name:   "mercedtime",
@@ -69,6 +97,8 @@ func run() error {
 			Year:        2021,
 			Term:        "spring",
 			SkipCourses: false,
+
+			DescriptionCache: "descriptions.json",
 		}
 	)
 
@@ -83,30 +113,61 @@ func run() error {
 	}
 	config.ReadConfigFile() // ignore error if not there
 
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		return serve(&conf, os.Args[2:])
+	}
+
 	flag.BoolVar(&dbOpsOnly, "db", dbOpsOnly, "only perform database updates")
 	flag.BoolVar(&csvOps, "csv", csvOps, "write the tables to csv files")
 	flag.BoolVar(&enrollmentOnly, "enrollment-only", enrollmentOnly, "only updated the db with enrollmenet data")
 	flag.BoolVar(&noEnrollment, "no-enrollment", noEnrollment, "do not update the enrollment table")
+	flag.BoolVar(&dry, "dry-run", dry, "report the database updates without making them (needs -db)")
+	flag.StringVar(&report, "report", report, "format of the dry run report (text or json)")
+	flag.StringVar(&record, "record", record, "save the registrar's responses to a directory")
+	flag.StringVar(&replay, "replay", replay, "use the responses saved with -record instead of the registrar")
+	flag.BoolVar(&massCancel, "allow-mass-cancel", massCancel, "cancel the missing courses even if it is most of the term")
 	conf.init()
 	flag.Parse()
 
+	if massCancel {
+		conf.MaxCancelPercent = 100
+	}
+
 	if !dbOpsOnly && !csvOps && !enrollmentOnly {
 		flag.Usage()
 		println("\n")
 		return errors.New("nothing to be done. use '-db' or '-csv' or '--enrollment-only'")
 	}
+	if dry && !dbOpsOnly {
+		return errors.New("-dry-run only works with -db")
+	}
+	if report != "text" && report != "json" {
+		return fmt.Errorf("unknown report format %q", report)
+	}
 
-	// ucm.SetHTTPClient(http.Client{Timeout: time.Second * 2})
-	var out io.Writer = os.Stdout
-	sch, err := ucm.NewSchedule(ucm.ScheduleConfig{
-		Year:    conf.Year,
-		Term:    conf.Term,
-		Open:    false,
-		Subject: "",
-	})
+	var (
+		out io.Writer = os.Stdout
+		src ScheduleSource
+		err error
+	)
+	switch {
+	case record != "" && replay != "":
+		return errors.New("cannot use -record and -replay together")
+	case record != "":
+		src, err = newRecorder(record)
+	case replay != "":
+		src, err = newReplayer(replay)
+	default:
+		src = newLiveSource()
+	}
+	if err != nil {
+		return err
+	}
+	sch, err := src.Schedule(conf.Year, conf.Term)
 	if err != nil {
 		return err
 	}
+	ctx := context.Background()
 
 	if enrollmentOnly {
 		db, err := sqlx.Connect("postgres", conf.Database.GetDSN())
@@ -115,7 +176,7 @@ func run() error {
 		}
 		defer db.Close()
 		err = recordHistoricalEnrollment(
-			db.DB, conf.Year, termcodeMap[conf.Term], sch.Ordered())
+			ctx, db.DB, conf.Year, termcodeMap[conf.Term], sch.Ordered())
 		if err != nil {
 			return err
 		}
@@ -123,11 +184,28 @@ func run() error {
 		return nil
 	}
 
-	tab, err := PopulateTables(sch, &conf)
+	descs, err := newDescriber(&conf, src)
+	if err != nil {
+		return err
+	}
+	tab, err := PopulateTables(ctx, sch, &conf, descs)
 	if err != nil {
 		return err
 	}
 
+	if dry {
+		db, err := sqlx.Connect("postgres", conf.Database.GetDSN())
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		r, err := dryRun(ctx, db, tab)
+		if err != nil {
+			return fmt.Errorf("DB Error: %w", err)
+		}
+		return writeReport(out, r, report)
+	}
+
 	defer fmt.Println()
 	if dbOpsOnly {
 		db, err := sqlx.Connect("postgres", conf.Database.GetDSN())
@@ -135,13 +213,13 @@ func run() error {
 			return err
 		}
 		defer closeDB(db)
-		err = updates(os.Stdout, db, tab)
+		err = updates(ctx, os.Stdout, db, tab)
 		if err != nil {
 			return fmt.Errorf("DB Error: %w", err)
 		}
 		if !noEnrollment {
 			err = recordHistoricalEnrollment(
-				db.DB, conf.Year, termcodeMap[conf.Term],
+				ctx, db.DB, conf.Year, termcodeMap[conf.Term],
 				sch.Ordered(),
 			)
 			if err != nil {
@@ -161,7 +239,7 @@ func run() error {
 }
 
 func closeDB(db *sqlx.DB) (err error) {
-	_, err = db.Exec("REFRESH MATERIALIZED VIEW CONCURRENTLY catalog")
+	err = refreshCatalog(context.Background(), db)
 	if err != nil {
 		log.Println("could not refresh materialized view:", err)
 	}
@@ -171,6 +249,11 @@ func closeDB(db *sqlx.DB) (err error) {
 	return err
 }
 
+func refreshCatalog(ctx context.Context, db *sqlx.DB) error {
+	_, err := db.ExecContext(ctx, "REFRESH MATERIALIZED VIEW CONCURRENTLY catalog")
+	return err
+}
+
 // Tables holds table data
 type Tables struct {
 	course     []*catalog.Entry
@@ -183,7 +266,7 @@ type Tables struct {
 }
 
 // PopulateTables will get table data
-func PopulateTables(sch ucm.Schedule, conf *updateConfig) (*Tables, error) {
+func PopulateTables(ctx context.Context, sch ucm.Schedule, conf *updateConfig, descs *describer) (*Tables, error) {
 	var (
 		courses = sch.Ordered()
 		tab     = &Tables{
@@ -194,7 +277,7 @@ func PopulateTables(sch ucm.Schedule, conf *updateConfig) (*Tables, error) {
 		err error
 	)
 
-	tab.course, err = GetCourseTable(courses, 150)
+	tab.course, err = GetCourseTable(ctx, courses, descs, 150)
 	if err != nil {
 		return nil, err
 	}
@@ -230,7 +313,40 @@ func PopulateTables(sch ucm.Schedule, conf *updateConfig) (*Tables, error) {
 	return tab, tab.populateLabsLectures(courses, sch)
 }
 
-func updates(w io.Writer, db *sqlx.DB, tab *Tables) (err error) {
+func updates(ctx context.Context, w io.Writer, db *sqlx.DB, tab *Tables) error {
+	u := updater{ctx: ctx, w: w, db: db}
+	return u.run(tab)
+}
+
+// updater runs the table updates. Every table is updated in its own
+// transaction unless there is a dry run transaction, which is shared
+// by all of the tables and never committed. Transactions are rolled
+// back when the context is done.
+type updater struct {
+	ctx context.Context
+	w   io.Writer
+	db  *sqlx.DB
+	dry *sqlx.Tx
+}
+
+// tx runs fn in a transaction.
+func (u *updater) tx(fn func(tx *sqlx.Tx) error) error {
+	if u.dry != nil {
+		return fn(u.dry)
+	}
+	tx, err := u.db.BeginTxx(u.ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (u *updater) run(tab *Tables) (err error) {
+	w := u.w
 	t := time.Now()
 	fmt.Fprintf(w, "[%s] ", t.Format(time.Stamp))
 	t = time.Now()
@@ -239,7 +355,9 @@ func updates(w io.Writer, db *sqlx.DB, tab *Tables) (err error) {
 	fmt.Fprintf(w, "instructor:")
 
 	instructors := instructorMapToInterfaceSlice(tab.instructor)
-	err = updateInstructorsTable("instructor", db.DB, instructors)
+	err = u.tx(func(tx *sqlx.Tx) error {
+		return updateInstructorsTable("instructor", tx.Tx, instructors)
+	})
 	if err != nil {
 		log.Println(err)
 		return err
@@ -251,26 +369,43 @@ func updates(w io.Writer, db *sqlx.DB, tab *Tables) (err error) {
 	// CRNs because other tables depend on this table
 	// via foreign key constrains.
 
-	updates, err := updateCourseTable(db, tab.course)
+	// With the postgres broadcaster the api servers are
+	// notified when the course updates are committed.
+	var notify func(sqlx.Ext, []*catalog.Entry) error
+	if tab.config.Broadcaster == "postgres" && u.dry == nil {
+		notify = func(tx sqlx.Ext, updates []*catalog.Entry) error {
+			_, err := publish.Notify(tx, updates, tab.config.UpdateHistory)
+			return err
+		}
+	}
+	var updates []*catalog.Entry
+	err = u.tx(func(tx *sqlx.Tx) (err error) {
+		updates, err = updateCourseTable(tx, tab.course, tab.config.MaxCancelPercent, notify)
+		return err
+	})
 	if err != nil {
 		return errors.Wrap(err, "update course failed")
 	}
-	if len(updates) > 0 {
-		println()
+	if len(updates) > 0 && u.dry == nil {
+		fmt.Fprintln(w)
 		for _, u := range updates {
-			fmt.Printf("%+v\n", u)
+			fmt.Fprintf(w, "%+v\n", u)
 		}
-		resp, err := postUpdatedCourses(tab.config, updates)
-		if err != nil {
-			log.Println("could not send updates to server:", err)
-		} else {
-			resp.Body.Close()
+		if notify == nil {
+			resp, err := postUpdatedCourses(u.ctx, tab.config, updates)
+			if err != nil {
+				log.Println("could not send updates to server:", err)
+			} else {
+				resp.Body.Close()
+			}
 		}
 	}
 	fmt.Fprintf(w, "%v ok|lectures:", time.Now().Sub(t))
 	t = time.Now()
 
-	err = updateLectureTable(db, tab.lectures)
+	err = u.tx(func(tx *sqlx.Tx) error {
+		return updateLectureTable(tx.Tx, tab.lectures)
+	})
 	if err != nil {
 		log.Println(err)
 		return err
@@ -278,7 +413,9 @@ func updates(w io.Writer, db *sqlx.DB, tab *Tables) (err error) {
 	fmt.Fprintf(w, "%v ok|labs:", time.Now().Sub(t))
 	t = time.Now()
 
-	err = updateLabsTable(db.DB, tab.aux)
+	err = u.tx(func(tx *sqlx.Tx) error {
+		return updateLabsTable(tx.Tx, tab.aux)
+	})
 	if err != nil {
 		log.Println(err)
 		return err
@@ -287,14 +424,15 @@ func updates(w io.Writer, db *sqlx.DB, tab *Tables) (err error) {
 	t = time.Now()
 
 	if len(tab.exam) > 0 {
-		err = updateExamTable(db.DB, tab.exam)
+		err = u.tx(func(tx *sqlx.Tx) error {
+			return updateExamTable(tx.Tx, tab.exam)
+		})
 		if err != nil {
 			log.Println("Error update exam table:", err)
 			return err
 		}
 		fmt.Fprintf(w, "%v ok|", time.Now().Sub(t))
 	}
-	t = time.Now()
 	return nil
 }
 
@@ -432,62 +570,54 @@ func getDiscussionLecture(disc *ucm.Course, sch ucm.Schedule) (*ucm.Course, erro
 // GetCourseTable will get all the updated info needed by course table.
 // Parameter courses is just a full list of raw courses and workers is the
 // number of goroutines spawned that will be making requests to get the
-// course description. The number of workers should be fairly high to get
-// the most performance and should be limited to the number of connections
-// that your computer can have open at one time.
+// course descriptions. Only the descriptions that are not cached or have
+// expired are requested, once for each course number, and the requests
+// are limited to the describer's rate.
 //
-// Side note: performance drops if the number of workers is too high
-func GetCourseTable(courses []*ucm.Course, workers int) ([]*catalog.Entry, error) {
+// Courses without any description are left out and
+// the first error getting one is returned.
+func GetCourseTable(ctx context.Context, courses []*ucm.Course, descs *describer, workers int) ([]*catalog.Entry, error) {
 	var (
-		mu     sync.Mutex
 		wg     sync.WaitGroup
 		errs   = make(chan error)
 		ch     = make(chan *ucm.Course)
+		stale  = make([]*ucm.Course, 0)
+		seen   = make(map[string]bool)
 		result = make([]*catalog.Entry, 0, len(courses))
 	)
+	for _, c := range courses {
+		key := descKey(c)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if !descs.fresh(c) {
+			stale = append(stale, c)
+		}
+	}
 
-	// The last worker will not finish until
-	// the goroutine above finishes and will
-	// not free the waitgroup so this function
-	// will not return before all the courses
-	// are processed.
 	wg.Add(workers)
 	for i := 0; i < workers; i++ {
-		go func(worker int) {
+		go func() {
 			defer wg.Done()
-			var innerRes []*catalog.Entry
 			for c := range ch {
-				info, err := c.Info()
-				if err != nil {
-					log.Println("could not get course description:", err, "skipping...")
+				if err := descs.refresh(ctx, c); err != nil {
+					if ctx.Err() == nil {
+						log.Println("could not get course description:", err, "skipping...")
+					}
 					errs <- err
-					continue
-				}
-				crs := catalog.Entry{
-					CRN:         c.CRN,
-					Subject:     c.Subject,
-					CourseNum:   c.Number,
-					Type:        c.Activity,
-					Title:       cleanTitle(c.Title),
-					Units:       c.Units,
-					Days:        catalog.NewWeekdays(c.Days),
-					Description: info,
-					Capacity:    c.Capacity,
-					Enrolled:    c.Enrolled,
-					Remaining:   c.SeatsOpen(),
 				}
-				innerRes = append(innerRes, &crs)
 			}
-			mu.Lock()
-			result = append(result, innerRes...)
-			mu.Unlock()
-		}(i)
+		}()
 	}
 	go func() {
-		// Convert the course list to
-		// a channel in the background
-		for _, c := range courses {
-			ch <- c
+	send:
+		for _, c := range stale {
+			select {
+			case ch <- c:
+			case <-ctx.Done():
+				break send
+			}
 		}
 		close(ch)
 		// Wait for all the workers to
@@ -503,6 +633,37 @@ func GetCourseTable(courses []*ucm.Course, workers int) ([]*catalog.Entry, error
 			err = e
 		}
 	}
+	// the descriptions that were fetched are
+	// saved even if the job was cancelled
+	if e := descs.save(); e != nil {
+		log.Println("could not save description cache:", e)
+	}
+	if e := ctx.Err(); e != nil {
+		return nil, e
+	}
+	if len(stale) > 0 {
+		log.Printf("requested %d of %d course descriptions", len(stale), len(seen))
+	}
+
+	for _, c := range courses {
+		info := descs.get(c)
+		if info == "" {
+			continue
+		}
+		result = append(result, &catalog.Entry{
+			CRN:         c.CRN,
+			Subject:     c.Subject,
+			CourseNum:   c.Number,
+			Type:        c.Activity,
+			Title:       cleanTitle(c.Title),
+			Units:       c.Units,
+			Days:        catalog.NewWeekdays(c.Days),
+			Description: info,
+			Capacity:    c.Capacity,
+			Enrolled:    c.Enrolled,
+			Remaining:   c.SeatsOpen(),
+		})
+	}
 	return result, err
 }
 
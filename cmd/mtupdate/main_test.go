@@ -1,16 +1,22 @@
 package main
 
 import (
+	"context"
 	"math/rand"
+	"os"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/harrybrwn/edu/school/ucmerced/ucm"
+	"github.com/jmoiron/sqlx"
+	"github.com/mercedtime/api/catalog"
+	"github.com/mercedtime/api/db"
 )
 
 var (
 	testingSchedule ucm.Schedule
+	testingSource   ScheduleSource
 	scheduleOnce    sync.Once
 	scheduleMu      sync.Mutex
 
@@ -25,11 +31,13 @@ func testSchedule(t *testing.T) ucm.Schedule {
 	)
 	scheduleOnce.Do(func() {
 		rand.Seed(time.Now().Unix())
-		testingSchedule, err = ucm.NewSchedule(ucm.ScheduleConfig{
-			Year: 2021,
-			Term: "spring",
-			// Subject: subjects[rand.Intn(len(subjects))],
-		})
+		// the fixture is a small hand-written schedule saved in
+		// the same format as "mtupdate -record" so it can be replayed
+		testingSource, err = newReplayer(fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testingSchedule, err = testingSource.Schedule(2021, "spring")
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -77,7 +85,11 @@ func TestGetDiscussionLecture(t *testing.T) {
 func TestGetCourseTable(t *testing.T) {
 	sch := testSchedule(t)
 	list := sch.Ordered()
-	courses, err := GetCourseTable(list, 200)
+	descs, err := newDescriber(&updateConfig{}, testingSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	courses, err := GetCourseTable(context.Background(), list, descs, 200)
 	if err != nil {
 		t.Error(err)
 	}
@@ -91,7 +103,11 @@ func TestGetCourseTable(t *testing.T) {
 
 func TestPopulateTables(t *testing.T) {
 	sch := testSchedule(t)
-	tab, err := PopulateTables(sch, &updateConfig{})
+	descs, err := newDescriber(&updateConfig{}, testingSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tab, err := PopulateTables(context.Background(), sch, &updateConfig{}, descs)
 	if err != nil {
 		t.Error(err)
 	}
@@ -100,9 +116,110 @@ func TestPopulateTables(t *testing.T) {
 	}
 }
 
+// TestReplayUpdates runs the database updates for the fixture
+// schedule in a dry run so nothing is committed.
+func TestReplayUpdates(t *testing.T) {
+	// the test database may not have the same courses
+	conf := &updateConfig{Year: 2021, Term: "spring", MaxCancelPercent: 100}
+	db := testDB(t)
+	defer db.Close()
+	sch := testSchedule(t) // sets the testing source
+	descs, err := newDescriber(conf, testingSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tab, err := PopulateTables(context.Background(), sch, conf, descs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := dryRun(context.Background(), db, tab)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Tables) == 0 || r.Tables[0].Table != "course" {
+		t.Fatalf("wrong report %+v", r)
+	}
+	scraped := make(map[int64]bool)
+	for _, c := range tab.course {
+		scraped[int64(c.CRN)] = true
+	}
+	for _, ins := range r.Tables[0].Inserts {
+		if !scraped[ins["crn"].(int64)] {
+			t.Errorf("inserted a course that was not scraped: %v", ins)
+		}
+	}
+	for _, del := range r.Tables[0].Deletes {
+		if scraped[del["crn"].(int64)] {
+			t.Errorf("removed a course that was scraped: %v", del)
+		}
+	}
+}
+
+func TestCancelMissing(t *testing.T) {
+	db := testDB(t)
+	defer db.Close()
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	// a term that is not in the test data
+	courses := make([]*catalog.Entry, 10)
+	for i := range courses {
+		courses[i] = &catalog.Entry{CRN: 900000 + i, Year: 1999, TermID: 1}
+		_, err = tx.Exec("INSERT INTO course (crn, year, term_id) VALUES ($1, $2, $3)",
+			courses[i].CRN, courses[i].Year, courses[i].TermID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err = cancelMissing(tx, courses[:5], 0); err == nil {
+		t.Fatal("expected an error for cancelling half of the term")
+	}
+	cancelled, _, err := cancelMissing(tx, courses[:5], 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cancelled) != 5 {
+		t.Errorf("cancelled %d courses, want 5", len(cancelled))
+	}
+	cancelled, restored, err := cancelMissing(tx, courses, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cancelled) != 0 || len(restored) != 5 {
+		t.Errorf("got %d cancelled and %d restored, want 0 and 5", len(cancelled), len(restored))
+	}
+}
+
 func TestDetectSemester(t *testing.T) {
 	// var tm time.Time
 	// // tm = time.Date(2020, time.January, 4, 1, 1, 1, 1, time.FixedZone("America/Los_Angeles", 0))
 	// tm = time.Date(2020, time.January, 4, 1, 1, 1, 1, time.UTC)
 	// fmt.Println(tm)
 }
+
+func testDB(t *testing.T) *sqlx.DB {
+	t.Helper()
+	conf := db.Config{
+		Driver:   "postgres",
+		Host:     "localhost",
+		Port:     25432,
+		User:     env("POSTGRES_USER", "mt"),
+		Password: env("POSTGRES_PASSWORD", "test"),
+		Name:     env("POSTGRES_DB", "mercedtime"),
+		SSL:      "disable",
+	}
+	d, err := sqlx.Connect("postgres", conf.GetDSN())
+	if err != nil {
+		t.Skip("no test database:", err)
+	}
+	return d
+}
+
+func env(name, deflt string) string {
+	if e := os.Getenv(name); e != "" {
+		return e
+	}
+	return deflt
+}
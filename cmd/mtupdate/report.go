@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// Report is the set of changes that a dry run would have made.
+type Report struct {
+	Year   int            `json:"year"`
+	Term   string         `json:"term"`
+	Tables []*TableReport `json:"tables"`
+}
+
+// TableReport lists the changes to one table. Deletes are the rows of
+// the term that are no longer in the schedule. They are not deleted,
+// the courses are marked as cancelled which is also an update.
+type TableReport struct {
+	Table   string       `json:"table"`
+	Inserts []row        `json:"inserts"`
+	Updates []*RowUpdate `json:"updates"`
+	Deletes []row        `json:"deletes"`
+}
+
+// RowUpdate is an updated row and the columns that changed.
+type RowUpdate struct {
+	Key     int64                   `json:"key"`
+	Columns map[string]ColumnChange `json:"columns"`
+}
+
+// ColumnChange is the value of a column before and after an update.
+type ColumnChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+type row map[string]interface{}
+
+// reportTables are the tables in a report and the
+// column that identifies their rows.
+var reportTables = []struct{ name, key string }{
+	{"course", "crn"},
+	{"lectures", "crn"},
+	{"aux", "crn"},
+	{"exam", "crn"},
+	{"instructor", "id"},
+}
+
+// dryRun runs the updates in a transaction that is rolled
+// back and reports the changes that they would have made.
+func dryRun(ctx context.Context, db *sqlx.DB, tab *Tables) (*Report, error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	keys := tab.keys()
+	before := make(map[string]map[int64]row, len(reportTables))
+	for _, t := range reportTables {
+		if before[t.name], err = snapshot(tx, t.name, t.key, keys[t.name], &tab.config); err != nil {
+			return nil, errors.Wrapf(err, "could not read %s", t.name)
+		}
+	}
+	u := updater{ctx: ctx, w: ioutil.Discard, db: db, dry: tx}
+	if err = u.run(tab); err != nil {
+		return nil, err
+	}
+	r := &Report{Year: tab.config.Year, Term: tab.config.Term}
+	for _, t := range reportTables {
+		after, err := snapshot(tx, t.name, t.key, keys[t.name], &tab.config)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not read %s", t.name)
+		}
+		scraped := make(map[int64]bool, len(keys[t.name]))
+		for _, k := range keys[t.name] {
+			scraped[k] = true
+		}
+		// instructors are shared between terms
+		if t.name == "instructor" {
+			scraped = nil
+		}
+		r.Tables = append(r.Tables, diffTable(t.name, before[t.name], after, scraped))
+	}
+	return r, nil
+}
+
+// keys returns the keys of the rows in each table.
+func (t *Tables) keys() map[string][]int64 {
+	keys := make(map[string][]int64, len(reportTables))
+	for _, c := range t.course {
+		keys["course"] = append(keys["course"], int64(c.CRN))
+	}
+	for _, l := range t.lectures {
+		keys["lectures"] = append(keys["lectures"], int64(l.CRN))
+	}
+	for _, l := range t.aux {
+		keys["aux"] = append(keys["aux"], int64(l.CRN))
+	}
+	for _, e := range t.exam {
+		keys["exam"] = append(keys["exam"], int64(e.CRN))
+	}
+	for _, in := range t.instructor {
+		keys["instructor"] = append(keys["instructor"], in.ID)
+	}
+	return keys
+}
+
+// snapshot reads the rows of a table that have one of the keys
+// or belong to a course in the term being updated.
+func snapshot(tx *sqlx.Tx, table, key string, keys []int64, conf *updateConfig) (map[int64]row, error) {
+	var (
+		rows *sqlx.Rows
+		err  error
+	)
+	if key == "crn" {
+		rows, err = tx.Queryx(fmt.Sprintf(`
+		SELECT t.* FROM %s t
+		 WHERE t.crn = ANY($1)
+		    OR t.crn IN (SELECT crn FROM course WHERE year = $2 AND term_id = $3)`, table),
+			pq.Array(keys), conf.Year, termcodeMap[conf.Term])
+	} else {
+		rows, err = tx.Queryx(fmt.Sprintf(`SELECT * FROM %s WHERE %s = ANY($1)`, table, key), pq.Array(keys))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	snap := make(map[int64]row)
+	for rows.Next() {
+		r := make(row)
+		if err = rows.MapScan(r); err != nil {
+			return nil, err
+		}
+		for col, v := range r {
+			if b, ok := v.([]byte); ok {
+				r[col] = string(b)
+			}
+		}
+		k, ok := r[key].(int64)
+		if !ok {
+			return nil, fmt.Errorf("%s.%s is not an integer", table, key)
+		}
+		snap[k] = r
+	}
+	return snap, rows.Err()
+}
+
+// diffTable compares the rows of a table before and after the updates.
+// Rows that are not in the scraped set of keys are reported as deleted
+// unless scraped is nil.
+func diffTable(table string, before, after map[int64]row, scraped map[int64]bool) *TableReport {
+	r := &TableReport{
+		Table:   table,
+		Inserts: []row{},
+		Updates: []*RowUpdate{},
+		Deletes: []row{},
+	}
+	for _, k := range sortedKeys(after) {
+		old, ok := before[k]
+		if !ok {
+			r.Inserts = append(r.Inserts, after[k])
+			continue
+		}
+		var cols map[string]ColumnChange
+		for col, v := range after[k] {
+			if col == "updated_at" || reflect.DeepEqual(old[col], v) {
+				continue
+			}
+			if cols == nil {
+				cols = make(map[string]ColumnChange)
+			}
+			cols[col] = ColumnChange{Before: old[col], After: v}
+		}
+		if cols != nil {
+			r.Updates = append(r.Updates, &RowUpdate{Key: k, Columns: cols})
+		}
+	}
+	if scraped == nil {
+		return r
+	}
+	for _, k := range sortedKeys(before) {
+		// already cancelled by an earlier update
+		if c, ok := before[k]["cancelled_at"]; ok && c != nil {
+			continue
+		}
+		if !scraped[k] {
+			r.Deletes = append(r.Deletes, before[k])
+		}
+	}
+	return r
+}
+
+func sortedKeys(m map[int64]row) []int64 {
+	keys := make([]int64, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+func writeReport(w io.Writer, r *Report, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	case "text":
+		fmt.Fprintf(w, "dry run for %s %d\n", r.Term, r.Year)
+		for _, t := range r.Tables {
+			fmt.Fprintf(w, "%s: %d inserts, %d updates, %d deletes\n",
+				t.Table, len(t.Inserts), len(t.Updates), len(t.Deletes))
+			key := keyColumn(t.Table)
+			for _, ins := range t.Inserts {
+				fmt.Fprintf(w, "  + %s %v\n", key, ins[key])
+			}
+			for _, u := range t.Updates {
+				fmt.Fprintf(w, "  ~ %s %d", key, u.Key)
+				for _, col := range sortedColumns(u.Columns) {
+					c := u.Columns[col]
+					fmt.Fprintf(w, " %s: %v -> %v", col, c.Before, c.After)
+				}
+				fmt.Fprintln(w)
+			}
+			for _, del := range t.Deletes {
+				fmt.Fprintf(w, "  - %s %v\n", key, del[key])
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown report format %q", format)
+}
+
+func keyColumn(table string) string {
+	for _, t := range reportTables {
+		if t.name == table {
+			return t.key
+		}
+	}
+	return ""
+}
+
+func sortedColumns(m map[string]ColumnChange) []string {
+	cols := make([]string, 0, len(m))
+	for c := range m {
+		cols = append(cols, c)
+	}
+	sort.Strings(cols)
+	return cols
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDiffTable(t *testing.T) {
+	before := map[int64]row{
+		1: {"crn": int64(1), "enrolled": int64(10), "title": "Intro", "updated_at": "a"},
+		2: {"crn": int64(2), "enrolled": int64(5), "title": "Labs", "updated_at": "a"},
+		3: {"crn": int64(3), "enrolled": int64(0), "title": "Old", "updated_at": "a"},
+		5: {"crn": int64(5), "cancelled_at": "a"},
+	}
+	after := map[int64]row{
+		1: {"crn": int64(1), "enrolled": int64(12), "title": "Intro", "updated_at": "b"},
+		2: {"crn": int64(2), "enrolled": int64(5), "title": "Labs", "updated_at": "b"},
+		3: {"crn": int64(3), "enrolled": int64(0), "title": "Old", "updated_at": "a"},
+		4: {"crn": int64(4), "enrolled": int64(0), "title": "New", "updated_at": "b"},
+		5: {"crn": int64(5), "cancelled_at": "a"},
+	}
+	r := diffTable("course", before, after, map[int64]bool{1: true, 2: true, 4: true})
+	if len(r.Inserts) != 1 || r.Inserts[0]["crn"] != int64(4) {
+		t.Errorf("wrong inserts %v", r.Inserts)
+	}
+	if len(r.Updates) != 1 || r.Updates[0].Key != 1 || len(r.Updates[0].Columns) != 1 {
+		t.Fatalf("wrong updates %v", r.Updates)
+	}
+	if c := r.Updates[0].Columns["enrolled"]; c.Before != int64(10) || c.After != int64(12) {
+		t.Errorf("wrong column change %+v", c)
+	}
+	if len(r.Deletes) != 1 || r.Deletes[0]["crn"] != int64(3) {
+		t.Errorf("wrong deletes %v", r.Deletes)
+	}
+
+	r = diffTable("instructor", before, after, nil)
+	if len(r.Deletes) != 0 {
+		t.Error("should not delete without scraped keys")
+	}
+
+	var buf bytes.Buffer
+	report := &Report{Year: 2021, Term: "fall", Tables: []*TableReport{
+		diffTable("course", before, after, map[int64]bool{1: true, 2: true, 4: true}),
+	}}
+	if err := writeReport(&buf, report, "json"); err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		Tables []struct {
+			Updates []struct {
+				Columns map[string]struct{ Before, After int }
+			}
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if c := decoded.Tables[0].Updates[0].Columns["enrolled"]; c.Before != 10 || c.After != 12 {
+		t.Errorf("wrong json column change %+v", c)
+	}
+	buf.Reset()
+	if err := writeReport(&buf, report, "text"); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"course: 1 inserts, 1 updates, 1 deletes",
+		"+ crn 4", "~ crn 1 enrolled: 10 -> 12", "- crn 3",
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("text report is missing %q:\n%s", line, buf.String())
+		}
+	}
+	if err := writeReport(&buf, report, "xml"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultServeAddr  = ":8081"
+	defaultJobTimeout = 10 * time.Minute
+
+	// Job kinds, full updates do not record enrollment.
+	updateJob     = "update"
+	enrollmentJob = "enrollment"
+)
+
+// serveConfig configures the long running "mtupdate serve" mode.
+type serveConfig struct {
+	Addr              string       `config:"addr" yaml:"addr"`
+	JitterSeconds     int          `config:"jitter_seconds" yaml:"jitter_seconds"`
+	JobTimeoutSeconds int          `config:"job_timeout_seconds" yaml:"job_timeout_seconds"` // longer runs are cancelled
+	Terms             []termConfig `config:"terms" yaml:"terms"`
+}
+
+// termConfig is a term that is kept up to date. Jobs with
+// an interval of zero are not run.
+type termConfig struct {
+	Year              int    `yaml:"year"`
+	Term              string `yaml:"term"`
+	UpdateSeconds     int    `yaml:"update_seconds"`
+	EnrollmentSeconds int    `yaml:"enrollment_seconds"`
+}
+
+func (t termConfig) String() string {
+	return t.Term + " " + strconv.Itoa(t.Year)
+}
+
+func serve(conf *updateConfig, args []string) error {
+	conf.init()
+	flag.StringVar(&conf.Serve.Addr, "addr", conf.Serve.Addr, "address of the status server")
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return err
+	}
+	db, err := sqlx.Connect("postgres", conf.Database.GetDSN())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	d, err := newDaemon(conf, db, newLiveSource())
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		s := <-sig
+		log.Printf("got %v, stopping running jobs", s)
+		cancel()
+	}()
+
+	srv := &http.Server{Addr: conf.Serve.Addr, Handler: d.handler()}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Println("status server:", err)
+			cancel()
+		}
+	}()
+	log.Printf("running %d jobs, status on %s", len(d.jobs), conf.Serve.Addr)
+	d.start(ctx)
+	d.wait()
+
+	shutdown, done := context.WithTimeout(context.Background(), 10*time.Second)
+	defer done()
+	return srv.Shutdown(shutdown)
+}
+
+// daemon runs the update jobs of every term on an interval.
+type daemon struct {
+	conf    updateConfig
+	db      *sqlx.DB
+	src     ScheduleSource
+	descs   *describer // shared by every term
+	jitter  time.Duration
+	timeout time.Duration // deadline of each run
+	jobs    []*job
+	started time.Time
+
+	mu sync.Mutex // guards job status
+	wg sync.WaitGroup
+	// a term's lock is held while one of its jobs is running
+	locks map[string]chan struct{}
+	// runs a job, it is replaced in tests
+	run func(context.Context, *job) error
+}
+
+type job struct {
+	term     termConfig
+	kind     string
+	interval time.Duration
+	status   jobStatus
+}
+
+type jobStatus struct {
+	Year         int       `json:"year"`
+	Term         string    `json:"term"`
+	Kind         string    `json:"kind"`
+	Interval     float64   `json:"interval_seconds"`
+	Running      bool      `json:"running"`
+	Runs         int       `json:"runs"`
+	Failures     int       `json:"failures"`
+	Skipped      int       `json:"skipped"`
+	LastStart    time.Time `json:"last_start"`
+	LastDuration float64   `json:"last_duration_seconds"`
+	LastSuccess  time.Time `json:"last_success"`
+	LastError    string    `json:"last_error,omitempty"`
+	NextRun      time.Time `json:"next_run"`
+}
+
+func newDaemon(conf *updateConfig, db *sqlx.DB, src ScheduleSource) (*daemon, error) {
+	d := &daemon{
+		conf:    *conf,
+		db:      db,
+		src:     src,
+		jitter:  time.Duration(conf.Serve.JitterSeconds) * time.Second,
+		timeout: time.Duration(conf.Serve.JobTimeoutSeconds) * time.Second,
+		started: time.Now(),
+		locks:   make(map[string]chan struct{}),
+	}
+	var err error
+	if d.descs, err = newDescriber(conf, src); err != nil {
+		return nil, err
+	}
+	d.run = d.runJob
+	if d.timeout <= 0 {
+		d.timeout = defaultJobTimeout
+	}
+	if d.conf.Serve.Addr == "" {
+		d.conf.Serve.Addr = defaultServeAddr
+	}
+	for _, t := range conf.Serve.Terms {
+		if _, ok := termcodeMap[t.Term]; !ok || t.Year == 0 {
+			return nil, fmt.Errorf("invalid term %q", t)
+		}
+		if _, ok := d.locks[t.String()]; ok {
+			return nil, fmt.Errorf("term %q is listed twice", t)
+		}
+		d.locks[t.String()] = make(chan struct{}, 1)
+		for kind, secs := range map[string]int{
+			updateJob:     t.UpdateSeconds,
+			enrollmentJob: t.EnrollmentSeconds,
+		} {
+			if secs <= 0 {
+				continue
+			}
+			interval := time.Duration(secs) * time.Second
+			d.jobs = append(d.jobs, &job{
+				term:     t,
+				kind:     kind,
+				interval: interval,
+				status: jobStatus{
+					Year:     t.Year,
+					Term:     t.Term,
+					Kind:     kind,
+					Interval: interval.Seconds(),
+				},
+			})
+		}
+	}
+	if len(d.jobs) == 0 {
+		return nil, errors.New("no jobs to run, add terms to the serve config")
+	}
+	sort.Slice(d.jobs, func(i, j int) bool {
+		a, b := d.jobs[i], d.jobs[j]
+		if a.term != b.term {
+			return a.term.String() < b.term.String()
+		}
+		return a.kind < b.kind
+	})
+	return d, nil
+}
+
+// start runs every job in the background until
+// the context is done.
+func (d *daemon) start(ctx context.Context) {
+	for _, j := range d.jobs {
+		d.wg.Add(1)
+		go d.loop(ctx, j)
+	}
+}
+
+// wait blocks until the jobs have stopped.
+func (d *daemon) wait() { d.wg.Wait() }
+
+func (d *daemon) loop(ctx context.Context, j *job) {
+	defer d.wg.Done()
+	// the first run only waits for the jitter so
+	// that a restart does not skip an interval
+	wait := d.jitterDuration()
+	for {
+		d.mu.Lock()
+		j.status.NextRun = time.Now().Add(wait)
+		d.mu.Unlock()
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		d.tryRun(ctx, j)
+		wait = j.interval + d.jitterDuration()
+	}
+}
+
+func (d *daemon) jitterDuration() time.Duration {
+	if d.jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d.jitter)))
+}
+
+// tryRun runs a job unless another job for the same term is still
+// running. The job is cancelled at its deadline or when ctx is done.
+func (d *daemon) tryRun(ctx context.Context, j *job) {
+	lock := d.locks[j.term.String()]
+	select {
+	case lock <- struct{}{}:
+	default:
+		d.mu.Lock()
+		j.status.Skipped++
+		d.mu.Unlock()
+		log.Printf("skipping %s job for %s, the term is still being updated", j.kind, j.term)
+		return
+	}
+	defer func() { <-lock }()
+
+	start := time.Now()
+	d.mu.Lock()
+	j.status.Running = true
+	j.status.LastStart = start
+	d.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	err := d.run(ctx, j)
+	cancel()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	j.status.Running = false
+	j.status.Runs++
+	j.status.LastDuration = time.Since(start).Seconds()
+	if err != nil {
+		j.status.Failures++
+		j.status.LastError = err.Error()
+		log.Printf("%s job for %s failed: %v", j.kind, j.term, err)
+		return
+	}
+	j.status.LastError = ""
+	j.status.LastSuccess = time.Now()
+	log.Printf("%s job for %s done in %v", j.kind, j.term, time.Since(start))
+}
+
+func (d *daemon) runJob(ctx context.Context, j *job) error {
+	conf := d.conf
+	conf.Year, conf.Term = j.term.Year, j.term.Term
+	sch, err := d.src.Schedule(conf.Year, conf.Term)
+	if err != nil {
+		return err
+	}
+	// the schedule request cannot be cancelled
+	// so check before going any further
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	switch j.kind {
+	case enrollmentJob:
+		return recordHistoricalEnrollment(
+			ctx, d.db.DB, conf.Year, termcodeMap[conf.Term], sch.Ordered())
+	case updateJob:
+		tab, err := PopulateTables(ctx, sch, &conf, d.descs)
+		if err != nil {
+			return err
+		}
+		if err = updates(ctx, ioutil.Discard, d.db, tab); err != nil {
+			return err
+		}
+		return refreshCatalog(ctx, d.db)
+	}
+	return fmt.Errorf("unknown job %q", j.kind)
+}
+
+func (d *daemon) statuses() []jobStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	list := make([]jobStatus, len(d.jobs))
+	for i, j := range d.jobs {
+		list[i] = j.status
+	}
+	return list
+}
+
+func (d *daemon) handler() http.Handler {
+	m := http.NewServeMux()
+	m.HandleFunc("/status", d.serveStatus)
+	m.HandleFunc("/health", d.serveHealth)
+	m.HandleFunc("/metrics", d.serveMetrics)
+	return m
+}
+
+func (d *daemon) serveStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"started": d.started,
+		"jobs":    d.statuses(),
+	})
+}
+
+func (d *daemon) serveHealth(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	if err := d.db.PingContext(ctx); err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{
+			"status": "database unavailable: " + err.Error(),
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// serveMetrics writes the job statuses in the
+// prometheus text format.
+func (d *daemon) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	var (
+		list    = d.statuses()
+		metrics = []struct {
+			name, typ, help string
+			value           func(s *jobStatus) float64
+		}{
+			{"mtupdate_job_runs_total", "counter", "Number of finished job runs.",
+				func(s *jobStatus) float64 { return float64(s.Runs) }},
+			{"mtupdate_job_failures_total", "counter", "Number of failed job runs.",
+				func(s *jobStatus) float64 { return float64(s.Failures) }},
+			{"mtupdate_job_skipped_total", "counter", "Number of runs skipped because the term was busy.",
+				func(s *jobStatus) float64 { return float64(s.Skipped) }},
+			{"mtupdate_job_running", "gauge", "Whether the job is running.",
+				func(s *jobStatus) float64 {
+					if s.Running {
+						return 1
+					}
+					return 0
+				}},
+			{"mtupdate_job_last_duration_seconds", "gauge", "Duration of the last job run.",
+				func(s *jobStatus) float64 { return s.LastDuration }},
+			{"mtupdate_job_last_success_timestamp_seconds", "gauge", "Unix time of the last successful run.",
+				func(s *jobStatus) float64 {
+					if s.LastSuccess.IsZero() {
+						return 0
+					}
+					return float64(s.LastSuccess.Unix())
+				}},
+		}
+	)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+		for i := range list {
+			s := &list[i]
+			fmt.Fprintf(w, "%s{year=\"%d\",term=%q,job=%q} %v\n",
+				m.name, s.Year, s.Term, s.Kind, m.value(s))
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("could not write response:", err)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testDaemon(t *testing.T, terms ...termConfig) *daemon {
+	t.Helper()
+	d, err := newDaemon(&updateConfig{Serve: serveConfig{Terms: terms}}, nil, ucmSource{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestNewDaemon(t *testing.T) {
+	d := testDaemon(t,
+		termConfig{Year: 2021, Term: "spring", UpdateSeconds: 120, EnrollmentSeconds: 300},
+		termConfig{Year: 2021, Term: "fall", EnrollmentSeconds: 300},
+	)
+	if len(d.jobs) != 3 {
+		t.Fatalf("expected 3 jobs, got %d", len(d.jobs))
+	}
+	if j := d.jobs[0]; j.term.Term != "fall" || j.kind != enrollmentJob || j.interval != 5*time.Minute {
+		t.Errorf("wrong first job %+v", j)
+	}
+	if d.conf.Serve.Addr != defaultServeAddr {
+		t.Errorf("expected the default address, got %q", d.conf.Serve.Addr)
+	}
+	for _, terms := range [][]termConfig{
+		nil,
+		{{Year: 2021, Term: "winter", UpdateSeconds: 1}},
+		{{Term: "fall", UpdateSeconds: 1}},
+		{{Year: 2021, Term: "fall"}},
+		{{Year: 2021, Term: "fall", UpdateSeconds: 1}, {Year: 2021, Term: "fall", EnrollmentSeconds: 1}},
+	} {
+		if _, err := newDaemon(&updateConfig{Serve: serveConfig{Terms: terms}}, nil, ucmSource{}); err == nil {
+			t.Errorf("expected an error for %+v", terms)
+		}
+	}
+}
+
+func TestDaemonSkipsBusyTerm(t *testing.T) {
+	d := testDaemon(t, termConfig{Year: 2021, Term: "fall", UpdateSeconds: 1, EnrollmentSeconds: 1})
+	var (
+		started = make(chan struct{})
+		release = make(chan struct{})
+		calls   int32
+	)
+	d.run = func(ctx context.Context, j *job) error {
+		atomic.AddInt32(&calls, 1)
+		close(started)
+		<-release
+		return errors.New("scrape failed")
+	}
+	done := make(chan struct{})
+	go func() {
+		d.tryRun(context.Background(), d.jobs[0])
+		close(done)
+	}()
+	<-started
+	d.tryRun(context.Background(), d.jobs[1])
+	close(release)
+	<-done
+
+	list := d.statuses()
+	if atomic.LoadInt32(&calls) != 1 || list[1].Skipped != 1 || list[1].Runs != 0 {
+		t.Errorf("the second job should have been skipped: %+v", list[1])
+	}
+	if list[0].Runs != 1 || list[0].Failures != 1 || list[0].LastError != "scrape failed" || list[0].Running {
+		t.Errorf("wrong status for the failed job: %+v", list[0])
+	}
+}
+
+func TestDaemonJobTimeout(t *testing.T) {
+	d := testDaemon(t, termConfig{Year: 2021, Term: "fall", UpdateSeconds: 60})
+	if d.timeout != defaultJobTimeout {
+		t.Errorf("expected the default timeout, got %v", d.timeout)
+	}
+	d.timeout = 10 * time.Millisecond
+	d.run = func(ctx context.Context, j *job) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	d.tryRun(context.Background(), d.jobs[0])
+	if s := d.statuses()[0]; s.Failures != 1 || s.LastError != context.DeadlineExceeded.Error() {
+		t.Errorf("expected the job to time out: %+v", s)
+	}
+
+	// stopping the daemon cancels running jobs
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d.timeout = time.Hour
+	d.tryRun(ctx, d.jobs[0])
+	if s := d.statuses()[0]; s.Failures != 2 || s.LastError != context.Canceled.Error() {
+		t.Errorf("expected the job to be cancelled: %+v", s)
+	}
+}
+
+func TestDaemonLoop(t *testing.T) {
+	d := testDaemon(t,
+		termConfig{Year: 2021, Term: "fall", UpdateSeconds: 1, EnrollmentSeconds: 1},
+		termConfig{Year: 2021, Term: "spring", UpdateSeconds: 1},
+	)
+	d.jitter = time.Millisecond
+	for _, j := range d.jobs {
+		j.interval = time.Millisecond
+	}
+	var (
+		mu      sync.Mutex
+		running = make(map[string]bool)
+		runs    int32
+	)
+	d.run = func(ctx context.Context, j *job) error {
+		mu.Lock()
+		if running[j.term.String()] {
+			t.Errorf("two jobs for %s ran at once", j.term)
+		}
+		running[j.term.String()] = true
+		mu.Unlock()
+		time.Sleep(2 * time.Millisecond)
+		mu.Lock()
+		running[j.term.String()] = false
+		mu.Unlock()
+		atomic.AddInt32(&runs, 1)
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d.start(ctx)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	d.wait()
+	n := atomic.LoadInt32(&runs)
+	if n < 3 {
+		t.Errorf("expected jobs to run a few times, got %d runs", n)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if atomic.LoadInt32(&runs) != n {
+		t.Error("jobs ran after the daemon stopped")
+	}
+}
+
+func TestDaemonHandler(t *testing.T) {
+	d := testDaemon(t, termConfig{Year: 2021, Term: "fall", UpdateSeconds: 60})
+	d.run = func(context.Context, *job) error { return nil }
+	d.tryRun(context.Background(), d.jobs[0])
+	h := d.handler()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/status", nil))
+	var status struct{ Jobs []jobStatus }
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Jobs) != 1 || status.Jobs[0].Runs != 1 || status.Jobs[0].Interval != 60 {
+		t.Errorf("wrong status %+v", status)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE mtupdate_job_runs_total counter",
+		`mtupdate_job_runs_total{year="2021",term="fall",job="update"} 1`,
+		`mtupdate_job_running{year="2021",term="fall",job="update"} 0`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("metrics are missing %q:\n%s", line, body)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/harrybrwn/edu/school/ucmerced/ucm"
+)
+
+// ScheduleSource is where the updates get the
+// schedule of a term and the course descriptions.
+type ScheduleSource interface {
+	Schedule(year int, term string) (ucm.Schedule, error)
+	Description(c *ucm.Course) (string, error)
+}
+
+// ucmSource gets the schedule from the registrar. Its requests
+// are sent with rt.
+type ucmSource struct {
+	rt http.RoundTripper
+}
+
+func (s ucmSource) Schedule(year int, term string) (ucm.Schedule, error) {
+	defer ucmRouter.use(s.rt)()
+	return ucm.NewSchedule(ucm.ScheduleConfig{Year: year, Term: term})
+}
+
+func (s ucmSource) Description(c *ucm.Course) (string, error) {
+	defer ucmRouter.use(s.rt)()
+	return c.Info()
+}
+
+// transport is shared by the requests that the sources make to the
+// registrar and by the requests to the api so that connections are
+// reused.
+var transport = &http.Transport{
+	Proxy:               http.ProxyFromEnvironment,
+	MaxIdleConns:        200,
+	MaxIdleConnsPerHost: 150, // the number of GetCourseTable workers
+	IdleConnTimeout:     90 * time.Second,
+}
+
+// The ucm package sends every request with one package level client
+// and has no way to give it another one per call. The client is set
+// once to send each request with the transport of the source that is
+// making it so that sources never change each other's transport.
+var ucmRouter = newRouter()
+
+func init() {
+	ucm.SetHTTPClient(http.Client{Timeout: 15 * time.Second, Transport: ucmRouter})
+}
+
+// router sends requests with the transport currently in use.
+// Any number of calls can use the same transport at once, calls
+// with a different transport wait for them to finish.
+type router struct {
+	mu    sync.Mutex
+	free  *sync.Cond
+	rt    http.RoundTripper
+	users int
+}
+
+func newRouter() *router {
+	r := &router{}
+	r.free = sync.NewCond(&r.mu)
+	return r
+}
+
+// use sends requests with rt until release is called.
+func (r *router) use(rt http.RoundTripper) (release func()) {
+	r.mu.Lock()
+	for r.users > 0 && r.rt != rt {
+		r.free.Wait()
+	}
+	r.rt = rt
+	r.users++
+	r.mu.Unlock()
+	return func() {
+		r.mu.Lock()
+		if r.users--; r.users == 0 {
+			r.free.Broadcast()
+		}
+		r.mu.Unlock()
+	}
+}
+
+func (r *router) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.mu.Lock()
+	rt := r.rt
+	r.mu.Unlock()
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return rt.RoundTrip(req)
+}
+
+// newLiveSource returns a source that requests the registrar.
+func newLiveSource() ScheduleSource {
+	return ucmSource{rt: transport}
+}
+
+// recorder is a live source that saves every response from the
+// registrar so that the same run can be replayed later.
+type recorder struct {
+	ucmSource
+	dir string
+	rt  http.RoundTripper
+}
+
+func newRecorder(dir string) (ScheduleSource, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	r := &recorder{dir: dir, rt: transport}
+	r.ucmSource = ucmSource{rt: r}
+	return r, nil
+}
+
+func (r *recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := r.rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	// the body is read and replaced when dumped
+	dump, err := httputil.DumpResponse(resp, true)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s\n", req.Method, req.URL)
+	buf.Write(dump)
+	if err = ioutil.WriteFile(snapshotFile(r.dir, req), buf.Bytes(), 0644); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// replayer is a source that only reads the responses saved
+// by a recorder and never makes a request.
+type replayer struct {
+	ucmSource
+	dir string
+}
+
+func newReplayer(dir string) (ScheduleSource, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	r := &replayer{dir: dir}
+	r.ucmSource = ucmSource{rt: r}
+	return r, nil
+}
+
+func (r *replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	f, err := os.Open(snapshotFile(r.dir, req))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no recorded response for %s %s", req.Method, req.URL)
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rd := bufio.NewReader(f)
+	if _, err = rd.ReadString('\n'); err != nil {
+		return nil, err
+	}
+	resp, err := http.ReadResponse(rd, req)
+	if err != nil {
+		return nil, err
+	}
+	// read the body before the file is closed
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+// snapshotFile is the name of the file that a response
+// is saved to. Files start with the request that they
+// are the response for.
+func snapshotFile(dir string, req *http.Request) string {
+	// the url is hashed since the info pages have long queries
+	h := sha1.Sum([]byte(req.Method + " " + req.URL.String()))
+	return filepath.Join(dir, hex.EncodeToString(h[:8])+".http")
+}
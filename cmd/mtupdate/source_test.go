@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const fixture = "testdata/spring-2021"
+
+func TestRecordReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mtupdate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src, err := newRecorder(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// record the fixture as if it were the registrar
+	src.(*recorder).rt = &replayer{dir: fixture}
+	recorded, err := src.Schedule(2021, "spring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lect := recorded.Ordered()[0]
+	desc, err := src.Description(lect)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if src, err = newReplayer(dir); err != nil {
+		t.Fatal(err)
+	}
+	replayed, err := src.Schedule(2021, "spring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed) != len(recorded) || len(replayed) == 0 {
+		t.Fatalf("replayed %d courses, recorded %d", len(replayed), len(recorded))
+	}
+	for i, c := range replayed.Ordered() {
+		r := recorded.Ordered()[i]
+		if c.CRN != r.CRN || c.Title != r.Title || c.Enrolled != r.Enrolled || (c.Exam == nil) != (r.Exam == nil) {
+			t.Errorf("replayed %+v, recorded %+v", c, r)
+		}
+	}
+	if d, err := src.Description(replayed[lect.CRN]); err != nil || d != desc {
+		t.Errorf("wrong replayed description %q: %v", d, err)
+	}
+
+	// only the first lecture's description was recorded
+	_, err = src.Description(replayed.Ordered()[1])
+	if err == nil || !strings.Contains(err.Error(), "no recorded response") {
+		t.Errorf("expected a missing response error, got %v", err)
+	}
+	if _, err = newReplayer(dir + "/missing"); err == nil {
+		t.Error("expected an error for a missing snapshot")
+	}
+}
+
+type countingTransport struct {
+	mu    sync.Mutex
+	calls int
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	c.calls++
+	c.mu.Unlock()
+	return &http.Response{
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
+
+func TestRouter(t *testing.T) {
+	var (
+		r    = newRouter()
+		a, b = &countingTransport{}, &countingTransport{}
+		req  = httptest.NewRequest("GET", "/", nil)
+	)
+	releaseA := r.use(a)
+	// the same transport can be used more than once at a time
+	releaseA2 := r.use(a)
+	usingB := make(chan func())
+	go func() { usingB <- r.use(b) }()
+	r.RoundTrip(req)
+	releaseA()
+	r.RoundTrip(req)
+	select {
+	case <-usingB:
+		t.Fatal("another transport was used before the first was released")
+	case <-time.After(20 * time.Millisecond):
+	}
+	releaseA2()
+	releaseB := <-usingB
+	r.RoundTrip(req)
+	releaseB()
+	if a.calls != 2 || b.calls != 1 {
+		t.Errorf("got %d and %d requests, want 2 and 1", a.calls, b.calls)
+	}
+}
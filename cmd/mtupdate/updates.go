@@ -7,7 +7,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"html/template"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
@@ -23,6 +22,7 @@ import (
 	"github.com/lib/pq"
 	"github.com/mercedtime/api/catalog"
 	"github.com/mercedtime/api/db/models"
+	"github.com/mercedtime/api/publish"
 	"github.com/pkg/errors"
 )
 
@@ -58,66 +58,11 @@ FROM (
   )
 ) new
 WHERE "{{ .Target }}"."crn" = "new"."crn"`
-	tableDiffTempl = `
-	SELECT * FROM {{ .Tmp }} tmp {{ $n := sub (len .Vars) 1 }}
-	WHERE NOT EXISTS (
-	  SELECT * FROM {{ .Target }} target
-	  WHERE
-	    tmp.crn = target.crn AND
-		{{- range $i, $v := .Vars }}
-		tmp.{{ $v }} = target.{{ . }}{{if ne $i $n }} AND{{end}}
-		{{- end }}
-	)`
 	tmplFuncs = template.FuncMap{
 		"sub": func(a, b int) int { return a - b },
 	}
 )
 
-func printTableDiff(tx *sql.Tx, data genquery) error {
-	tmpl, err := template.New("debug").Funcs(tmplFuncs).Parse(tableDiffTempl)
-	if err != nil {
-		log.Fatal(err)
-	}
-	b := bytes.Buffer{}
-	if err = tmpl.Execute(&b, data); err != nil {
-		return err
-	}
-	rows, err := tx.Query(b.String())
-	if err != nil {
-		return err
-	}
-	if err = printQueryRows(rows); err != nil {
-		return err
-	}
-	return rows.Close()
-}
-
-func printQueryRows(rows *sql.Rows) error {
-	cols, err := rows.Columns()
-	if err != nil {
-		return err
-	}
-	fmt.Println(cols)
-	i := 0
-	for rows.Next() {
-		columns := make([]interface{}, len(cols))
-		ptrs := make([]interface{}, len(cols))
-		for i := 0; i < len(cols); i++ {
-			ptrs[i] = &columns[i]
-		}
-		if err = rows.Scan(ptrs...); err != nil {
-			return err
-		}
-		for i, col := range cols {
-			fmt.Printf("%v: %v, ", col, columns[i])
-		}
-		fmt.Println()
-		i++
-	}
-	fmt.Println(i, "updated rows")
-	return nil
-}
-
 func updatequery(data genquery) (string, error) {
 	var buf bytes.Buffer
 	if err := execUpdateQueryGen(updateTmpl, data, &buf); err != nil {
@@ -237,7 +182,7 @@ func createTmpTable(from string, tx execable, tmp string, rows []interface{}) (d
 	return drop, nil
 }
 
-func recordHistoricalEnrollment(db *sql.DB, year, termcode int, crs []*ucm.Course) error {
+func recordHistoricalEnrollment(ctx context.Context, db *sql.DB, year, termcode int, crs []*ucm.Course) error {
 	var rows = make([]interface{}, 0, len(crs))
 	for _, c := range crs {
 		rows = append(rows, map[string]interface{}{
@@ -252,21 +197,23 @@ func recordHistoricalEnrollment(db *sql.DB, year, termcode int, crs []*ucm.Cours
 	if err != nil {
 		return err
 	}
-	_, err = db.Exec(q)
+	_, err = db.ExecContext(ctx, q)
 	return err
 }
 
-func updateCourseTable(db *sqlx.DB, courses []*catalog.Entry) (updates []*catalog.Entry, err error) {
+// updateCourseTable returns the courses that changed. If notify is
+// not nil it is called with them in the same transaction. See
+// cancelMissing for maxCancel.
+func updateCourseTable(
+	tx *sqlx.Tx,
+	courses []*catalog.Entry,
+	maxCancel int,
+	notify func(tx sqlx.Ext, updates []*catalog.Entry) error,
+) (updates []*catalog.Entry, err error) {
 	var (
 		target   = "course"
 		tmpTable = "_tmp_" + target
 	)
-	tx, err := db.BeginTxx(context.Background(), &sql.TxOptions{
-		Isolation: sql.LevelDefault, ReadOnly: false,
-	})
-	if err != nil {
-		return nil, err
-	}
 	tmp, err := newtmptable(target, tx.Tx)
 	if err != nil {
 		return nil, err
@@ -275,9 +222,6 @@ func updateCourseTable(db *sqlx.DB, courses []*catalog.Entry) (updates []*catalo
 		if e := tmp.close(); e != nil {
 			log.Println("Warning (could not delete tmp table): ", e)
 		}
-		if err == nil {
-			err = tx.Commit()
-		}
 	}()
 
 	cols := []string{
@@ -366,11 +310,101 @@ func updateCourseTable(db *sqlx.DB, courses []*catalog.Entry) (updates []*catalo
 	if _, err = tx.Exec(q); err != nil {
 		return nil, errors.Wrap(err, "could not perform updates from temp course table")
 	}
+	cancelled, restored, err := cancelMissing(tx, courses, maxCancel)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not mark cancelled courses")
+	}
+	updates = append(updates, cancelled...)
+	for _, r := range restored {
+		if !containsCRN(updates, r.CRN) {
+			updates = append(updates, r)
+		}
+	}
+	if notify != nil && len(updates) > 0 {
+		if err = notify(tx, updates); err != nil {
+			return nil, errors.Wrap(err, "could not notify course updates")
+		}
+	}
 	return updates, nil
 }
 
+// defaultMaxCancel is the most courses of a term, as a
+// percent, that one update will mark as cancelled.
+const defaultMaxCancel = 20
+
+// cancelMissing marks the courses of the term that are not in the
+// scraped courses as cancelled and clears the mark for courses that
+// are back in the schedule. The rows are kept because the other
+// tables and the enrollment history refer to them. More than
+// maxCancel percent of the term is never cancelled at once since
+// that is more likely a partial scrape, 100 turns off the check.
+func cancelMissing(tx *sqlx.Tx, courses []*catalog.Entry, maxCancel int) (cancelled, restored []*catalog.Entry, err error) {
+	if len(courses) == 0 {
+		// most likely a failed scrape, not a cancelled term
+		return nil, nil, nil
+	}
+	if maxCancel <= 0 {
+		maxCancel = defaultMaxCancel
+	}
+	crns := make([]int64, len(courses))
+	for i, c := range courses {
+		crns[i] = int64(c.CRN)
+	}
+	year, term := courses[0].Year, courses[0].TermID
+	var count struct {
+		Total   int `db:"total"`
+		Missing int `db:"missing"`
+	}
+	err = tx.Get(&count, `
+	SELECT count(*) AS total,
+	       count(*) FILTER (WHERE NOT (crn = ANY($3))) AS missing
+	  FROM course
+	 WHERE year = $1 AND term_id = $2
+	   AND cancelled_at IS NULL`, year, term, pq.Array(crns))
+	if err != nil {
+		return nil, nil, err
+	}
+	if maxCancel < 100 && count.Missing*100 > count.Total*maxCancel {
+		return nil, nil, fmt.Errorf(
+			"%d of %d courses would be cancelled, more than %d%% (use -allow-mass-cancel if this is right)",
+			count.Missing, count.Total, maxCancel)
+	}
+	cancelled = make([]*catalog.Entry, 0)
+	err = tx.Select(&cancelled, `
+	UPDATE course
+	   SET cancelled_at = now(), updated_at = now()
+	 WHERE year = $1 AND term_id = $2
+	   AND cancelled_at IS NULL
+	   AND NOT (crn = ANY($3))
+	RETURNING *`, year, term, pq.Array(crns))
+	if err != nil {
+		return nil, nil, err
+	}
+	restored = make([]*catalog.Entry, 0)
+	err = tx.Select(&restored, `
+	UPDATE course
+	   SET cancelled_at = NULL, updated_at = now()
+	 WHERE cancelled_at IS NOT NULL
+	   AND crn = ANY($1)
+	   AND year = $2 AND term_id = $3
+	RETURNING *`, pq.Array(crns), year, term)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cancelled, restored, nil
+}
+
+func containsCRN(list []*catalog.Entry, crn int) bool {
+	for _, e := range list {
+		if e.CRN == crn {
+			return true
+		}
+	}
+	return false
+}
+
 func updateLectureTable(
-	db *sqlx.DB,
+	tx *sql.Tx,
 	lectures []*models.Lecture,
 ) (err error) {
 	var (
@@ -378,21 +412,13 @@ func updateLectureTable(
 		tmpTable = "_tmp_" + target
 		rows     = interfaceSlice(lectures)
 	)
-	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{
-		Isolation: sql.LevelDefault, ReadOnly: false,
-	})
-	if err != nil {
-		return err
-	}
 	droptmp, err := createTmpTable(target, tx, tmpTable, rows)
 	defer func() {
 		e := droptmp()
 		if e != nil && err == nil {
 			err = e
 		}
-		if err == nil {
-			err = tx.Commit()
-		} else {
+		if err != nil {
 			log.Println(err)
 		}
 	}()
@@ -424,7 +450,7 @@ func updateLectureTable(
 }
 
 func updateLabsTable(
-	db *sql.DB,
+	tx *sql.Tx,
 	labs []*models.LabDisc,
 ) (err error) {
 	var (
@@ -432,23 +458,13 @@ func updateLabsTable(
 		tmpTable = "_tmp_" + target
 		rows     = interfaceSlice(labs)
 	)
-	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{
-		Isolation: sql.LevelDefault,
-		ReadOnly:  false,
-	})
-	if err != nil {
-		return err
-	}
-
 	droptmp, err := createTmpTable(target, tx, tmpTable, rows)
 	defer func() {
 		e := droptmp()
 		if e != nil && err == nil {
 			err = e
 		}
-		if err == nil {
-			err = tx.Commit()
-		} else {
+		if err != nil {
 			log.Println(err)
 		}
 	}()
@@ -484,25 +500,15 @@ func updateLabsTable(
 	return nil
 }
 
-func updateInstructorsTable(table string, db *sql.DB, instructors []interface{}) (err error) {
+func updateInstructorsTable(table string, tx *sql.Tx, instructors []interface{}) (err error) {
 	var tmpTable = "_tmp_" + table
-	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{
-		Isolation: sql.LevelDefault,
-		ReadOnly:  false,
-	})
-	if err != nil {
-		return err
-	}
-
 	droptmp, err := createTmpTable(table, tx, tmpTable, instructors)
 	defer func() {
 		e := droptmp()
 		if e != nil && err == nil {
 			err = e
 		}
-		if err == nil {
-			err = tx.Commit()
-		} else {
+		if err != nil {
 			log.Println(err)
 		}
 	}()
@@ -523,28 +529,19 @@ func updateInstructorsTable(table string, db *sql.DB, instructors []interface{})
 	return nil
 }
 
-func updateExamTable(db *sql.DB, exams []*models.Exam) error {
+func updateExamTable(tx *sql.Tx, exams []*models.Exam) (err error) {
 	var (
 		target   = "exam"
 		tmpTable = "_tmp_" + target
 		rows     = interfaceSlice(exams)
 	)
-	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{
-		Isolation: sql.LevelDefault,
-		ReadOnly:  false,
-	})
-	if err != nil {
-		return err
-	}
 	droptmp, err := createTmpTable(target, tx, tmpTable, rows)
 	defer func() {
 		e := droptmp()
 		if e != nil && err == nil {
 			err = e
 		}
-		if err == nil {
-			err = tx.Commit()
-		} else {
+		if err != nil {
 			log.Println(err)
 		}
 	}()
@@ -569,27 +566,32 @@ func updateExamTable(db *sql.DB, exams []*models.Exam) error {
 	return err
 }
 
-func postUpdatedCourses(conf updateConfig, updates []*catalog.Entry) (*http.Response, error) {
+func postUpdatedCourses(ctx context.Context, conf updateConfig, updates []*catalog.Entry) (*http.Response, error) {
 	var (
-		c   = http.Client{Timeout: time.Second * 5}
+		c   = http.Client{Timeout: time.Second * 5, Transport: transport}
 		buf bytes.Buffer
 	)
 
 	if err := json.NewEncoder(&buf).Encode(updates); err != nil {
 		return nil, err
 	}
-	return c.Do(&http.Request{
-		Proto:  "HTTP/1.1",
-		Method: "POST",
-		URL: &url.URL{
-			Scheme: "http",
-			Host:   net.JoinHostPort(conf.Host, strconv.Itoa(conf.Port)),
-			Path:   "/api/v1/update",
-		},
-		Body:          ioutil.NopCloser(&buf),
-		ContentLength: int64(buf.Len()),
-		Header: http.Header{
-			"Content-Type": {"application/json"},
-		},
-	})
+	u := url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(conf.Host, strconv.Itoa(conf.Port)),
+		Path:   "/api/v1/update",
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	switch {
+	case conf.UpdateSecret != "":
+		publish.SignRequest(req, []byte(conf.UpdateSecret), buf.Bytes())
+	case conf.UpdateToken != "":
+		req.Header.Set("Authorization", "Bearer "+conf.UpdateToken)
+	default:
+		return nil, errors.New("no update_secret or update_token to authenticate updates")
+	}
+	return c.Do(req)
 }
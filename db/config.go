@@ -0,0 +1,42 @@
+package db
+
+import (
+	"fmt"
+	"os"
+)
+
+// Config is the part of the config struct that
+// handles database info
+type Config struct {
+	Driver   string `config:"driver,usage=database driver name"`
+	Host     string `config:"host,shorthand=h" default:"localhost"`
+	Port     int    `config:"port,shorthand=p" default:"5432" env:"POSTGRES_PORT"`
+	User     string `config:"user,shorthand=U"`
+	Password string `config:"password" env:"POSTGRES_PASSWORD"`
+	// Database name or database filename
+	Name string `config:"name,shorthand=d,usage=name of the database"`
+	SSL  string `config:"ssl" default:"disable"`
+}
+
+// GetDSN builds the database dns from the database config parameters
+func (dbc *Config) GetDSN() string {
+	switch dbc.Driver {
+	case "postgres":
+		return fmt.Sprintf(
+			"host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+			dbc.Host, dbc.Port, dbc.User, dbc.Password, dbc.Name, dbc.SSL,
+		)
+	case "sqlite3":
+		if !exists(dbc.Name) {
+			return fmt.Sprintf("file:%s.sqlite", dbc.Name)
+		}
+		return fmt.Sprintf("file:%s", dbc.Name)
+	default:
+		panic(fmt.Sprintf("unknown database driver %s\n", dbc.Driver))
+	}
+}
+
+func exists(f string) bool {
+	_, err := os.Stat(f)
+	return !os.IsNotExist(err)
+}
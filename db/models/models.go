@@ -20,6 +20,13 @@ const (
 	TheOtherWierdCourseType = "INI"
 )
 
+// Term ids for each term of the year
+const (
+	Spring = 1
+	Summer = 2
+	Fall   = 3
+)
+
 // Scanable is an sql.Row or sql.Rows
 type Scanable interface {
 	Scan(...interface{}) error
@@ -95,6 +102,16 @@ type Instructor struct {
 	Name string `db:"name" json:"name"`
 }
 
+// Enrollment is the enrollment of a course at one point in time.
+type Enrollment struct {
+	CRN      int       `db:"crn" json:"crn"`
+	Year     int       `db:"year" json:"year"`
+	Term     int       `db:"term" json:"term"`
+	Time     time.Time `db:"ts" json:"ts"`
+	Enrolled int       `db:"enrolled" json:"enrolled"`
+	Capacity int       `db:"capacity" json:"capacity"`
+}
+
 // LabDisc is a lab or a discussion
 //
 // ONLY HERE FOR COMPATIBILITY
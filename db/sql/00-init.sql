@@ -54,6 +54,9 @@ CREATE TABLE course (
     updated_at   TIMESTAMPTZ DEFAULT now(),
     year         INT NOT NULL,
     term_id      INT NOT NULL,
+    -- set when the section is no longer in the schedule,
+    -- the row is kept for the enrollment history
+    cancelled_at TIMESTAMPTZ,
 
     PRIMARY KEY (id, crn)
 );
@@ -128,12 +131,95 @@ CREATE TABLE users (
     created_at TIMESTAMP    DEFAULT now(),
     hash       VARCHAR(72)  UNIQUE NOT NULL, -- password hash
 
+    disabled_at    TIMESTAMP,
+    locked_until   TIMESTAMP,
+    reset_required BOOLEAN NOT NULL DEFAULT 'f',
+    failed_logins  INTEGER NOT NULL DEFAULT 0,
+
+    email_verified_at TIMESTAMP,
+
     UNIQUE(name, email),
     PRIMARY KEY(id)
 );
 
+CREATE TABLE user_identities (
+    issuer     VARCHAR(255) NOT NULL,
+    subject    VARCHAR(255) NOT NULL,
+    user_id    INTEGER      NOT NULL,
+    email      VARCHAR(128),
+    created_at TIMESTAMP    DEFAULT now(),
+
+    PRIMARY KEY(issuer, subject),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Email changes waiting to be verified
+CREATE TABLE email_verifications (
+    token_hash CHAR(64)     NOT NULL, -- sha256 of the token
+    user_id    INTEGER      NOT NULL,
+    email      VARCHAR(128) NOT NULL,
+    created_at TIMESTAMP    DEFAULT now(),
+    expires_at TIMESTAMP    NOT NULL,
+
+    PRIMARY KEY(token_hash),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE api_keys (
+    id          SERIAL       NOT NULL,
+    user_id     INTEGER      NOT NULL,
+    name        VARCHAR(255) NOT NULL,
+    prefix      VARCHAR(16)  NOT NULL,
+    hash        CHAR(64)     UNIQUE NOT NULL, -- sha256 of the key
+    rate_limit  BIGINT       NOT NULL, -- requests per second
+    daily_quota BIGINT       NOT NULL, -- requests per day
+    created_at  TIMESTAMP    DEFAULT now(),
+    revoked_at  TIMESTAMP,
+
+    PRIMARY KEY(id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Append-only log of logins and admin actions. There is no foreign
+-- key on actor_id so that entries outlive deleted users.
+CREATE TABLE audit_log (
+    id         BIGSERIAL    NOT NULL,
+    actor_id   INTEGER,
+    action     VARCHAR(64)  NOT NULL,
+    target     VARCHAR(255),
+    ip         VARCHAR(64),
+    user_agent TEXT,
+    created_at TIMESTAMPTZ  DEFAULT now() NOT NULL,
+
+    PRIMARY KEY(id)
+);
+
+CREATE INDEX audit_log_created_at_idx ON audit_log (created_at);
+CREATE INDEX audit_log_actor_id_idx ON audit_log (actor_id);
+
+-- Recent catalog updates for clients that reconnect
+-- to the update stream, only the newest are kept.
+CREATE TABLE update_log (
+    seq        BIGSERIAL    NOT NULL,
+    entries    JSONB        NOT NULL,
+    created_at TIMESTAMPTZ  DEFAULT now() NOT NULL,
+
+    PRIMARY KEY(seq)
+);
+
 -- Triggers and Views
 
+CREATE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+-- Entries can only be deleted by the retention policy
+CREATE TRIGGER audit_log_no_update
+    BEFORE UPDATE ON audit_log
+    FOR EACH ROW EXECUTE PROCEDURE audit_log_append_only();
+
 CREATE VIEW counts AS
   SELECT 'course'        AS name, COUNT(*) FROM course
    UNION
@@ -0,0 +1,3 @@
+-- Accounts are only linked to an OpenID Connect login
+-- once their email address has been verified.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMP;
@@ -0,0 +1,55 @@
+-- Sections missing from the schedule are marked as cancelled. The
+-- catalog view is made again since its columns are fixed when it is
+-- created and it needs to leave out the cancelled subcourses.
+BEGIN;
+
+ALTER TABLE course ADD COLUMN IF NOT EXISTS cancelled_at TIMESTAMPTZ;
+
+DROP MATERIALIZED VIEW IF EXISTS catalog;
+
+CREATE MATERIALIZED VIEW catalog AS
+SELECT
+    c.*,
+    array_to_json(sub) AS subcourses,
+    row_to_json(exam) as exam
+FROM
+    course c
+    LEFT OUTER JOIN (
+        SELECT
+            array_agg(
+                json_build_object(
+                    'id',                course.id,
+                    'crn',               aux.crn,
+                    'course_crn',        aux.course_crn,
+                    'section',           aux.section,
+                    'type',              course.type,
+                    'days',              course.days,
+                    'enrolled',          course.enrolled,
+                    'capacity',          course.capacity,
+                    'remaining',         course.remaining,
+                    'start_time',        aux.start_time,
+                    'end_time',          aux.end_time,
+                    'building_room',     aux.building_room,
+                    'instructor_id',     aux.instructor_id,
+                    'updated_at',        aux.updated_at,
+                    'course_updated_at', course.updated_at
+                )
+            ) AS sub,
+            course_crn
+        FROM
+            aux
+            JOIN course ON aux.crn = course.crn
+        WHERE
+            aux.course_crn != 0
+            AND course.cancelled_at IS NULL
+        GROUP BY
+            aux.course_crn
+    ) a ON c.crn = a.course_crn
+    LEFT OUTER JOIN exam on c.crn = exam.crn
+ORDER BY
+    c.subject,
+    c.course_num;
+
+CREATE UNIQUE INDEX ON catalog (id);
+
+COMMIT;
@@ -44,6 +44,7 @@ FROM
             JOIN course ON aux.crn = course.crn
         WHERE
             aux.course_crn != 0
+            AND course.cancelled_at IS NULL
         GROUP BY
             aux.course_crn
     ) a ON c.crn = a.course_crn
@@ -7,6 +7,7 @@ require (
 	github.com/Masterminds/squirrel v1.5.0
 	github.com/agnivade/levenshtein v1.1.0
 	github.com/appleboy/gin-jwt/v2 v2.6.4
+	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/doug-martin/goqu/v9 v9.10.0
 	github.com/gin-gonic/gin v1.6.3
 	github.com/gorilla/websocket v1.4.2
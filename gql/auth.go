@@ -0,0 +1,69 @@
+package gql
+
+import (
+	"context"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/99designs/gqlgen/graphql/errcode"
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"github.com/mercedtime/api/gql/internal/graph"
+	"github.com/mercedtime/api/users"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+const (
+	errUnauthenticated = "UNAUTHENTICATED"
+	errForbidden       = "FORBIDDEN"
+)
+
+type (
+	userKey struct{}
+	ginKey  struct{}
+)
+
+// currentUser returns the logged in user, only the fields
+// in the token are set. It is nil if the user is anonymous.
+func currentUser(ctx context.Context) *users.User {
+	u, _ := ctx.Value(userKey{}).(*users.User)
+	return u
+}
+
+// ginContext returns the context of the http request
+// for the app methods that use it.
+func ginContext(ctx context.Context) *gin.Context {
+	c, _ := ctx.Value(ginKey{}).(*gin.Context)
+	return c
+}
+
+func authDirective(ctx context.Context, obj interface{}, next graphql.Resolver) (interface{}, error) {
+	if currentUser(ctx) == nil {
+		return nil, authError("you must be logged in", errUnauthenticated)
+	}
+	return next(ctx)
+}
+
+// hasRoleDirective returns the @hasRole directive. The admin
+// claim in the token may be stale so admins are looked up in
+// the database the same way app's adminOnly does it.
+func hasRoleDirective(db *sqlx.DB) func(context.Context, interface{}, graphql.Resolver, graph.Role) (interface{}, error) {
+	return func(ctx context.Context, obj interface{}, next graphql.Resolver, role graph.Role) (interface{}, error) {
+		self := currentUser(ctx)
+		if self == nil {
+			return nil, authError("you must be logged in", errUnauthenticated)
+		}
+		if role == graph.RoleAdmin {
+			u, err := users.GetUserByID(db, self.ID)
+			if err != nil || !u.IsAdmin || u.Disabled() {
+				return nil, authError("you must be an admin", errForbidden)
+			}
+		}
+		return next(ctx)
+	}
+}
+
+func authError(msg, code string) *gqlerror.Error {
+	err := gqlerror.Errorf("%s", msg)
+	errcode.Set(err, code)
+	return err
+}
@@ -0,0 +1,227 @@
+package gql
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+	"github.com/mercedtime/api/catalog"
+	"github.com/mercedtime/api/db/models"
+	"github.com/mercedtime/api/gql/internal/graph"
+	"github.com/mercedtime/api/gql/relay"
+	"github.com/mercedtime/api/users"
+)
+
+// Type names used in global ids
+const (
+	courseNode    = "Course"
+	lectureNode   = "Lecture"
+	subcourseNode = "SubCourse"
+	examNode      = "Exam"
+	instrNode     = "Instructor"
+	blueprintNode = "CourseBlueprint"
+	userNode      = "User"
+)
+
+func blueprintID(b *catalog.CourseBlueprint) string {
+	return relay.ID(blueprintNode, b.Subject+":"+strconv.Itoa(b.CourseNum))
+}
+
+// nodeID parses a global id that must be of the given
+// type and returns its numeric key.
+func nodeID(id, typ string) (int64, error) {
+	t, key, err := relay.ParseID(id)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(key, 10, 64)
+	if t != typ || err != nil {
+		return 0, relay.ErrInvalidID
+	}
+	return n, nil
+}
+
+// node finds the object with a global id, it
+// returns nil if the object does not exist.
+func node(ctx context.Context, db *sqlx.DB, id string) (relay.Node, error) {
+	typ, key, err := relay.ParseID(id)
+	if err != nil {
+		return nil, err
+	}
+	if typ == blueprintNode {
+		return blueprintByKey(ctx, db, key)
+	}
+	n, err := strconv.ParseInt(key, 10, 64)
+	if err != nil {
+		return nil, relay.ErrInvalidID
+	}
+	l := loadersFrom(ctx)
+	switch typ {
+	case courseNode:
+		if c, err := courseByID(ctx, db, int(n)); c != nil || err != nil {
+			return c, err
+		}
+	case lectureNode:
+		if lect, err := l.Lecture(int(n)); lect != nil || err != nil {
+			return lect, err
+		}
+	case subcourseNode:
+		subs, err := selectSubcourses(ctx, db, subcourseSelect.Where(sq.Eq{"aux.crn": n}))
+		if err != nil {
+			return nil, err
+		}
+		if len(subs) > 0 {
+			return subs[0], nil
+		}
+	case examNode:
+		if e, err := l.Exam(int(n)); e != nil || err != nil {
+			return e, err
+		}
+	case instrNode:
+		if in, err := l.Instructor(n); in != nil || err != nil {
+			return in, err
+		}
+	case userNode:
+		// users can only see themselves unless they are an admin
+		self := currentUser(ctx)
+		if self == nil || (int64(self.ID) != n && !self.IsAdmin) {
+			return nil, nil
+		}
+		u, err := users.GetUserByID(db, n)
+		if err == nil {
+			return u, nil
+		} else if err != sql.ErrNoRows {
+			return nil, err
+		}
+	default:
+		return nil, relay.ErrInvalidID
+	}
+	return nil, nil
+}
+
+func courseByID(ctx context.Context, db *sqlx.DB, id int) (*catalog.Course, error) {
+	q := catalog.Query{Filter: catalog.Filter{IDs: []int{id}, Cancelled: true}}
+	list, err := q.Courses(ctx, db)
+	if err != nil || len(list) == 0 {
+		return nil, err
+	}
+	return list[0], nil
+}
+
+// blueprintByKey finds a blueprint from the subject
+// and course number in its global id.
+func blueprintByKey(ctx context.Context, db *sqlx.DB, key string) (*catalog.CourseBlueprint, error) {
+	i := strings.LastIndex(key, ":")
+	if i < 0 {
+		return nil, relay.ErrInvalidID
+	}
+	num, err := strconv.Atoi(key[i+1:])
+	if err != nil {
+		return nil, relay.ErrInvalidID
+	}
+	q := catalog.Query{
+		From:   catalog.FromBlueprints,
+		Filter: catalog.Filter{Subject: key[:i], CourseNum: num},
+	}
+	list, err := q.Blueprints(ctx, db)
+	if err != nil || len(list) == 0 {
+		return nil, err
+	}
+	return list[0], nil
+}
+
+// The connection functions take the items fetched from the
+// page offset, which may be one more than the page size.
+
+func courseConnection(list []*catalog.Course, p relay.Page) *graph.CourseConnection {
+	n, info := p.Edges(len(list))
+	c := &graph.CourseConnection{Edges: make([]*graph.CourseEdge, n), PageInfo: info}
+	for i, node := range list[:n] {
+		c.Edges[i] = &graph.CourseEdge{Cursor: p.Cursor(i), Node: node}
+	}
+	return c
+}
+
+func blueprintConnection(list []*catalog.CourseBlueprint, p relay.Page) *graph.CourseBlueprintConnection {
+	n, info := p.Edges(len(list))
+	c := &graph.CourseBlueprintConnection{Edges: make([]*graph.CourseBlueprintEdge, n), PageInfo: info}
+	for i, node := range list[:n] {
+		c.Edges[i] = &graph.CourseBlueprintEdge{Cursor: p.Cursor(i), Node: node}
+	}
+	return c
+}
+
+func lectureConnection(list []*models.PrimaryCourse, p relay.Page) *graph.LectureConnection {
+	n, info := p.Edges(len(list))
+	c := &graph.LectureConnection{Edges: make([]*graph.LectureEdge, n), PageInfo: info}
+	for i, node := range list[:n] {
+		c.Edges[i] = &graph.LectureEdge{Cursor: p.Cursor(i), Node: node}
+	}
+	return c
+}
+
+func subcourseConnection(list []*catalog.SubCourse, p relay.Page) *graph.SubCourseConnection {
+	n, info := p.Edges(len(list))
+	c := &graph.SubCourseConnection{Edges: make([]*graph.SubCourseEdge, n), PageInfo: info}
+	for i, node := range list[:n] {
+		c.Edges[i] = &graph.SubCourseEdge{Cursor: p.Cursor(i), Node: node}
+	}
+	return c
+}
+
+func examConnection(list []*models.Exam, p relay.Page) *graph.ExamConnection {
+	n, info := p.Edges(len(list))
+	c := &graph.ExamConnection{Edges: make([]*graph.ExamEdge, n), PageInfo: info}
+	for i, node := range list[:n] {
+		c.Edges[i] = &graph.ExamEdge{Cursor: p.Cursor(i), Node: node}
+	}
+	return c
+}
+
+func instructorConnection(list []*models.Instructor, p relay.Page) *graph.InstructorConnection {
+	n, info := p.Edges(len(list))
+	c := &graph.InstructorConnection{Edges: make([]*graph.InstructorEdge, n), PageInfo: info}
+	for i, node := range list[:n] {
+		c.Edges[i] = &graph.InstructorEdge{Cursor: p.Cursor(i), Node: node}
+	}
+	return c
+}
+
+func enrollmentConnection(list []*models.Enrollment, p relay.Page) *graph.EnrollmentConnection {
+	n, info := p.Edges(len(list))
+	c := &graph.EnrollmentConnection{Edges: make([]*graph.EnrollmentEdge, n), PageInfo: info}
+	for i, node := range list[:n] {
+		c.Edges[i] = &graph.EnrollmentEdge{Cursor: p.Cursor(i), Node: node}
+	}
+	return c
+}
+
+func subjectConnection(list []*graph.Subject, p relay.Page) *graph.SubjectConnection {
+	n, info := p.Edges(len(list))
+	c := &graph.SubjectConnection{Edges: make([]*graph.SubjectEdge, n), PageInfo: info}
+	for i, node := range list[:n] {
+		c.Edges[i] = &graph.SubjectEdge{Cursor: p.Cursor(i), Node: node}
+	}
+	return c
+}
+
+func semesterConnection(list []*graph.Semester, p relay.Page) *graph.SemesterConnection {
+	n, info := p.Edges(len(list))
+	c := &graph.SemesterConnection{Edges: make([]*graph.SemesterEdge, n), PageInfo: info}
+	for i, node := range list[:n] {
+		c.Edges[i] = &graph.SemesterEdge{Cursor: p.Cursor(i), Node: node}
+	}
+	return c
+}
+
+func userConnection(list []*users.User, p relay.Page) *graph.UserConnection {
+	n, info := p.Edges(len(list))
+	c := &graph.UserConnection{Edges: make([]*graph.UserEdge, n), PageInfo: info}
+	for i, node := range list[:n] {
+		c.Edges[i] = &graph.UserEdge{Cursor: p.Cursor(i), Node: node}
+	}
+	return c
+}
@@ -7,68 +7,149 @@ import (
 	"context"
 
 	"github.com/mercedtime/api/catalog"
+	"github.com/mercedtime/api/db/models"
 	"github.com/mercedtime/api/gql/internal/graph"
+	"github.com/mercedtime/api/gql/relay"
 )
 
+func (r *courseResolver) ID(ctx context.Context, obj *catalog.Course) (string, error) {
+	return relay.IntID(courseNode, int64(obj.ID)), nil
+}
+
 func (r *courseResolver) Days(ctx context.Context, obj *catalog.Course) ([]*string, error) {
 	return resolveDaysOptional(obj.Days), nil
 }
 
-func (r *courseResolver) UpdatedAt(ctx context.Context, obj *catalog.Course) (*string, error) {
-	d := obj.UpdatedAt.String()
-	return &d, nil
+func (r *courseResolver) Exam(ctx context.Context, obj *catalog.Course) (*models.Exam, error) {
+	if !obj.Exam.Date.IsZero() {
+		return &models.Exam{
+			CRN:       obj.CRN,
+			Date:      obj.Exam.Date,
+			StartTime: obj.Exam.StartTime,
+			EndTime:   obj.Exam.EndTime,
+		}, nil
+	}
+	return loadersFrom(ctx).Exam(obj.CRN)
+}
+
+func (r *courseResolver) Subcourses(ctx context.Context, obj *catalog.Course, first *int, after *string) (*graph.SubCourseConnection, error) {
+	p, err := relay.NewPage(first, after)
+	if err != nil {
+		return nil, err
+	}
+	var sub []*catalog.SubCourse
+	if obj.Subcourses == nil {
+		// not from the catalog view
+		if sub, err = loadersFrom(ctx).Subcourses(obj.CRN); err != nil {
+			return nil, err
+		}
+	} else {
+		sub = make([]*catalog.SubCourse, len(obj.Subcourses))
+		for i := range obj.Subcourses {
+			sub[i] = &obj.Subcourses[i]
+		}
+	}
+	start, end := p.Slice(len(sub))
+	return subcourseConnection(sub[start:end], p), nil
 }
 
-func (r *courseResolver) Subcourses(ctx context.Context, obj *catalog.Course) ([]*catalog.SubCourse, error) {
-	var sub = make([]*catalog.SubCourse, len(obj.Subcourses))
-	for i, s := range obj.Subcourses {
-		sub[i] = &s
+func (r *courseResolver) Instructor(ctx context.Context, obj *catalog.Course) (*models.Instructor, error) {
+	l := loadersFrom(ctx)
+	lect, err := l.Lecture(obj.CRN)
+	if err != nil || lect == nil {
+		return nil, err
 	}
-	return sub, nil
+	return l.Instructor(lect.InstructorID)
 }
 
-func (r *examResolver) Date(ctx context.Context, obj *catalog.Exam) (string, error) {
-	return obj.Date.String(), nil
+func (r *courseResolver) Enrollment(ctx context.Context, obj *catalog.Course, first *int, after *string) (*graph.EnrollmentConnection, error) {
+	p, err := relay.NewPage(first, after)
+	if err != nil {
+		return nil, err
+	}
+	list, err := loadersFrom(ctx).Enrollment(obj.CRN)
+	if err != nil {
+		return nil, err
+	}
+	start, end := p.Slice(len(list))
+	return enrollmentConnection(list[start:end], p), nil
 }
 
-func (r *examResolver) StartTime(ctx context.Context, obj *catalog.Exam) (*string, error) {
-	s := obj.StartTime.String()
-	return &s, nil
+func (r *examResolver) ID(ctx context.Context, obj *models.Exam) (string, error) {
+	return relay.IntID(examNode, int64(obj.CRN)), nil
 }
 
-func (r *examResolver) EndTime(ctx context.Context, obj *catalog.Exam) (*string, error) {
-	s := obj.EndTime.String()
-	return &s, nil
+func (r *instructorResolver) ID(ctx context.Context, obj *models.Instructor) (string, error) {
+	return relay.IntID(instrNode, obj.ID), nil
 }
 
-func (r *subCourseResolver) StartTime(ctx context.Context, obj *catalog.SubCourse) (*string, error) {
-	var d = obj.StartTime.String()
-	return &d, nil
+func (r *instructorResolver) Courses(ctx context.Context, obj *models.Instructor, first *int, after *string) (*graph.CourseConnection, error) {
+	p, err := relay.NewPage(first, after)
+	if err != nil {
+		return nil, err
+	}
+	list, err := loadersFrom(ctx).InstructorCourses(obj.ID)
+	if err != nil {
+		return nil, err
+	}
+	start, end := p.Slice(len(list))
+	return courseConnection(list[start:end], p), nil
 }
 
-func (r *subCourseResolver) EndTime(ctx context.Context, obj *catalog.SubCourse) (*string, error) {
-	var d = obj.EndTime.String()
-	return &d, nil
+func (r *lectureResolver) ID(ctx context.Context, obj *models.PrimaryCourse) (string, error) {
+	return relay.IntID(lectureNode, int64(obj.CRN)), nil
 }
 
-func (r *subCourseResolver) UpdatedAt(ctx context.Context, obj *catalog.SubCourse) (*string, error) {
-	var d = obj.UpdatedAt.String()
-	return &d, nil
+func (r *lectureResolver) Instructor(ctx context.Context, obj *models.PrimaryCourse) (*models.Instructor, error) {
+	return loadersFrom(ctx).Instructor(obj.InstructorID)
+}
+
+func (r *lectureResolver) Exam(ctx context.Context, obj *models.PrimaryCourse) (*models.Exam, error) {
+	return loadersFrom(ctx).Exam(obj.CRN)
+}
+
+func (r *lectureResolver) Subcourses(ctx context.Context, obj *models.PrimaryCourse, first *int, after *string) (*graph.SubCourseConnection, error) {
+	p, err := relay.NewPage(first, after)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := loadersFrom(ctx).Subcourses(obj.CRN)
+	if err != nil {
+		return nil, err
+	}
+	start, end := p.Slice(len(sub))
+	return subcourseConnection(sub[start:end], p), nil
+}
+
+func (r *subCourseResolver) ID(ctx context.Context, obj *catalog.SubCourse) (string, error) {
+	return relay.IntID(subcourseNode, int64(obj.CRN)), nil
 }
 
 func (r *subCourseResolver) Days(ctx context.Context, obj *catalog.SubCourse) ([]string, error) {
 	return resolveDays(obj.Days), nil
 }
 
+func (r *subCourseResolver) Instructor(ctx context.Context, obj *catalog.SubCourse) (*models.Instructor, error) {
+	return loadersFrom(ctx).Instructor(obj.InstructorID)
+}
+
 // Course returns graph.CourseResolver implementation.
 func (r *Resolver) Course() graph.CourseResolver { return &courseResolver{r} }
 
 // Exam returns graph.ExamResolver implementation.
 func (r *Resolver) Exam() graph.ExamResolver { return &examResolver{r} }
 
+// Instructor returns graph.InstructorResolver implementation.
+func (r *Resolver) Instructor() graph.InstructorResolver { return &instructorResolver{r} }
+
+// Lecture returns graph.LectureResolver implementation.
+func (r *Resolver) Lecture() graph.LectureResolver { return &lectureResolver{r} }
+
 // SubCourse returns graph.SubCourseResolver implementation.
 func (r *Resolver) SubCourse() graph.SubCourseResolver { return &subCourseResolver{r} }
 
 type courseResolver struct{ *Resolver }
 type examResolver struct{ *Resolver }
+type instructorResolver struct{ *Resolver }
+type lectureResolver struct{ *Resolver }
 type subCourseResolver struct{ *Resolver }
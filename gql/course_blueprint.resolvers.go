@@ -10,6 +10,10 @@ import (
 	"github.com/mercedtime/api/gql/internal/graph"
 )
 
+func (r *courseBlueprintResolver) ID(ctx context.Context, obj *catalog.CourseBlueprint) (string, error) {
+	return blueprintID(obj), nil
+}
+
 func (r *courseBlueprintResolver) Crns(ctx context.Context, obj *catalog.CourseBlueprint) ([]int, error) {
 	return pqArrToIntArr(obj.CRNs), nil
 }
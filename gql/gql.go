@@ -2,29 +2,88 @@ package gql
 
 import (
 	"context"
-	"fmt"
 	"log"
 	"strings"
+	"time"
 
+	"github.com/99designs/gqlgen/graphql"
 	"github.com/99designs/gqlgen/graphql/handler"
+	"github.com/99designs/gqlgen/graphql/handler/extension"
+	"github.com/99designs/gqlgen/graphql/handler/lru"
+	"github.com/99designs/gqlgen/graphql/handler/transport"
 	"github.com/99designs/gqlgen/graphql/playground"
+	sq "github.com/Masterminds/squirrel"
 	"github.com/gin-gonic/gin"
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
+	"github.com/mercedtime/api/app"
 	"github.com/mercedtime/api/catalog"
 	"github.com/mercedtime/api/gql/internal/graph"
+	"github.com/mercedtime/api/gql/relay"
 )
 
 //go:generate go run github.com/99designs/gqlgen
 
-// Handler returns a graphql handler function
-func Handler(db *sqlx.DB) gin.HandlerFunc {
-	h := handler.NewDefaultServer(graph.NewExecutableSchema(
-		graph.Config{Resolvers: &Resolver{db}},
-	))
+// Handler returns a graphql handler function. Subscriptions
+// are served over websockets using the graphql-ws protocol.
+// Queries are limited by the graphql section of the config,
+// and can be sent as automatic persisted queries. The user is
+// taken from the identity set by app.OptionalAuth.
+func Handler(a *app.App) (gin.HandlerFunc, error) {
+	conf := graph.Config{Resolvers: &Resolver{DB: a.DB, Hub: a.Hub, App: a}}
+	conf.Directives.Auth = authDirective
+	conf.Directives.HasRole = hasRoleDirective(a.DB)
+	setComplexity(&conf.Complexity)
+	h, err := newServer(graph.NewExecutableSchema(conf), a.Config)
+	if err != nil {
+		return nil, err
+	}
+	h.Use(newLimits(a.Config, a.RateStore))
 	return func(c *gin.Context) {
-		h.ServeHTTP(c.Writer, c.Request)
+		ctx := context.WithValue(c.Request.Context(), ipKey{}, c.ClientIP())
+		// Websocket connections can stay open for hours so their
+		// loaders do not cache results between subscription events.
+		ctx = context.WithValue(ctx, loadersKey{}, newLoaders(ctx, a.DB, !c.IsWebsocket()))
+		ctx = context.WithValue(ctx, ginKey{}, c)
+		if u, ok := a.Identity(c); ok {
+			ctx = context.WithValue(ctx, userKey{}, u)
+		}
+		h.ServeHTTP(c.Writer, c.Request.WithContext(ctx))
+	}, nil
+}
+
+// newServer is handler.NewDefaultServer with the persisted
+// queries from the config.
+func newServer(es graphql.ExecutableSchema, conf *app.Config) (*handler.Server, error) {
+	var c app.GraphQLConfig
+	if conf != nil {
+		c = conf.GraphQL
+	}
+	if c.APQCacheSize <= 0 {
+		c.APQCacheSize = defaultAPQCacheSize
 	}
+	h := handler.New(es)
+	h.AddTransport(transport.Websocket{
+		KeepAlivePingInterval: 10 * time.Second,
+	})
+	h.AddTransport(transport.Options{})
+	h.AddTransport(transport.GET{})
+	h.AddTransport(transport.POST{})
+	h.AddTransport(transport.MultipartForm{})
+	h.SetQueryCache(lru.New(1000))
+	h.Use(extension.Introspection{})
+
+	if c.PersistedQueries != "" {
+		l, err := loadAllowList(c.PersistedQueries, conf.Mode == gin.ReleaseMode)
+		if err != nil {
+			return nil, err
+		}
+		h.Use(l)
+	}
+	h.Use(extension.AutomaticPersistedQuery{
+		Cache: lru.New(c.APQCacheSize),
+	})
+	return h, nil
 }
 
 // Playground returns a hander func for the graphql playground
@@ -60,35 +119,91 @@ func pqArrToIntArr(a pq.Int32Array) []int {
 	return res
 }
 
+var psql = sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
+
+func selectQuery(ctx context.Context, db *sqlx.DB, dest interface{}, q sq.SelectBuilder) error {
+	query, args, err := q.ToSql()
+	if err != nil {
+		return err
+	}
+	return db.SelectContext(ctx, dest, query, args...)
+}
+
+// semester filters a query by the subject, year,
+// and term columns of a course table.
+func semester(q sq.SelectBuilder, table string, subject *string, year, term *int) sq.SelectBuilder {
+	if subject != nil {
+		q = q.Where(sq.Eq{table + ".subject": strings.ToUpper(*subject)})
+	}
+	if year != nil {
+		q = q.Where(sq.Eq{table + ".year": *year})
+	}
+	if term != nil {
+		q = q.Where(sq.Eq{table + ".term_id": *term})
+	}
+	return q
+}
+
+// page selects the items of a connection page and one more
+// so that the connection can tell if there is a next page.
+func page(q sq.SelectBuilder, p relay.Page) sq.SelectBuilder {
+	if p.Offset > 0 {
+		q = q.Offset(uint64(p.Offset))
+	}
+	if f := p.Fetch(); f >= 0 {
+		q = q.Limit(uint64(f))
+	}
+	return q
+}
+
+// catalogFilter is the catalog filter for the
+// semester arguments of a query.
+func catalogFilter(subject *string, year, term *int) catalog.Filter {
+	var f catalog.Filter
+	if subject != nil {
+		f.Subject = *subject
+	}
+	if year != nil {
+		f.Year = *year
+	}
+	if term != nil {
+		f.TermID = *term
+	}
+	return f
+}
+
+// pageParams selects the items of a connection page
+// and one more, like page does.
+func pageParams(p relay.Page) catalog.PageParams {
+	var pp catalog.PageParams
+	if p.Offset > 0 {
+		o := uint(p.Offset)
+		pp.Offset = &o
+	}
+	if f := p.Fetch(); f >= 0 {
+		l := uint(f)
+		pp.Limit = &l
+	}
+	return pp
+}
+
 func resolveCourses(
 	ctx context.Context,
 	db *sqlx.DB,
-	limit *int,
-	offset *int,
+	p relay.Page,
 	subject *string,
+	year, term *int,
+	typ *string,
 ) ([]*catalog.Course, error) {
-	var (
-		resp = make([]*catalog.Course, 0, 500)
-		q    = `SELECT * FROM course`
-		c    = 1
-		args = make([]interface{}, 0, 2)
-	)
-	if subject != nil {
-		q += fmt.Sprintf(" WHERE subject = $%d", c)
-		c++
-		args = append(args, *subject)
-	}
-	if limit != nil {
-		q += fmt.Sprintf(" LIMIT $%d", c)
-		c++
-		args = append(args, *limit)
+	q := catalog.Query{
+		From:   catalog.FromCourses,
+		Filter: catalogFilter(subject, year, term),
+		Page:   pageParams(p),
 	}
-	if offset != nil {
-		q += fmt.Sprintf(" OFFSET $%d", c)
-		c++
-		args = append(args, *offset)
+	if typ != nil {
+		q.Filter.Types = []string{*typ}
 	}
-	err := db.SelectContext(ctx, &resp, q, args...)
+	resp, err := q.Courses(ctx, db)
 	if err != nil {
 		log.Println(err)
 		return nil, err
@@ -99,35 +214,44 @@ func resolveCourses(
 func resolveCatalog(
 	ctx context.Context,
 	db *sqlx.DB,
-	limit *int,
-	offset *int,
+	p relay.Page,
 	subject *string,
+	year, term *int,
 ) ([]*catalog.Course, error) {
-	var (
-		q = `SELECT * FROM catalog
-				where type in ('LECT','SEM','STDO')`
-		resp = make(catalog.Catalog, 0, 500)
-		c    = 1
-		args = make([]interface{}, 0, 2)
-	)
-	if subject != nil {
-		q += fmt.Sprintf(" AND subject = $%d", c)
-		c++
-		args = append(args, strings.ToUpper(*subject))
-	}
-	if limit != nil {
-		q += fmt.Sprintf(" LIMIT $%d", c)
-		c++
-		args = append(args, *limit)
-	}
-	if offset != nil {
-		q += fmt.Sprintf(" OFFSET $%d", c)
-		c++
-		args = append(args, *offset)
+	q := catalog.Query{
+		From:   catalog.FromCatalog,
+		Filter: catalogFilter(subject, year, term),
+		Page:   pageParams(p),
 	}
-	err := db.SelectContext(ctx, &resp, q, args...)
-	if err != nil {
-		return nil, err
+	q.Filter.Types = catalog.PrimaryTypes
+	return q.Courses(ctx, db)
+}
+
+func resolveBlueprints(
+	ctx context.Context,
+	db *sqlx.DB,
+	p relay.Page,
+	subject *string,
+	year, term *int,
+) ([]*catalog.CourseBlueprint, error) {
+	q := catalog.Query{
+		From:   catalog.FromBlueprints,
+		Filter: catalogFilter(subject, year, term),
+		Page:   pageParams(p),
 	}
-	return resp, nil
+	return q.Blueprints(ctx, db)
+}
+
+// resolveSubcourses lists the labs or discussions.
+func resolveSubcourses(
+	ctx context.Context,
+	db *sqlx.DB,
+	typ string,
+	p relay.Page,
+	subject *string,
+	year, term *int,
+) ([]*catalog.SubCourse, error) {
+	q := subcourseSelect.Where(sq.Eq{"course.type": typ}).Where(notCancelled)
+	q = page(semester(q, "course", subject, year, term), p)
+	return selectSubcourses(ctx, db, q.OrderBy("aux.crn"))
 }
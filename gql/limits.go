@@ -0,0 +1,246 @@
+package gql
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/99designs/gqlgen/complexity"
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/99designs/gqlgen/graphql/errcode"
+	"github.com/mercedtime/api/app"
+	"github.com/mercedtime/api/gql/internal/graph"
+	"github.com/ulule/limiter/v3"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+const (
+	defaultMaxDepth         = 10
+	defaultMaxComplexity    = 5000
+	defaultComplexityBudget = 50000
+
+	// Number of items a list without a first argument is assumed to have,
+	// the course and catalog queries return about this many.
+	defaultListSize = 500
+	// Estimated number of labs and discussions for a lecture
+	subcourseListSize = 5
+	// Estimated number of enrollment records for a course
+	enrollmentListSize = 30
+	// Estimated number of lectures taught by an instructor
+	taughtListSize = 10
+
+	// Complexity points that are taken from a client's budget at
+	// a time. The rate store only counts one hit per call.
+	budgetUnit = 100
+)
+
+const (
+	errDepthLimit  = "DEPTH_LIMIT_EXCEEDED"
+	errComplexity  = "COMPLEXITY_LIMIT_EXCEEDED"
+	errBudgetLimit = "COMPLEXITY_BUDGET_EXCEEDED"
+)
+
+// setComplexity sets the cost of the connection fields, the
+// fields of their nodes are counted once for every item asked
+// for with the first argument.
+func setComplexity(c *graph.ComplexityRoot) {
+	semesterList := func(child int, first *int, after *string, subject *string, year, term *int) int {
+		return listComplexity(child, first, defaultListSize)
+	}
+	pageList := func(child int, first *int, after *string) int {
+		return listComplexity(child, first, defaultListSize)
+	}
+	c.Query.Courses = func(child int, first *int, after *string, subject *string, year, term *int, typ *string) int {
+		return listComplexity(child, first, defaultListSize)
+	}
+	c.Query.Catalog = semesterList
+	c.Query.Blueprints = semesterList
+	c.Query.Lectures = semesterList
+	c.Query.Labs = semesterList
+	c.Query.Discussions = semesterList
+	c.Query.Exams = pageList
+	c.Query.Instructors = pageList
+	c.Query.Users = func(child int, query *string, first *int, after *string) int {
+		return listComplexity(child, first, defaultListSize)
+	}
+	c.Course.Subcourses = func(child int, first *int, after *string) int {
+		return listComplexity(child, first, subcourseListSize)
+	}
+	c.Lecture.Subcourses = c.Course.Subcourses
+	c.Course.Enrollment = func(child int, first *int, after *string) int {
+		return listComplexity(child, first, enrollmentListSize)
+	}
+	c.Instructor.Courses = func(child int, first *int, after *string) int {
+		return listComplexity(child, first, taughtListSize)
+	}
+
+	// The edges and nodes of a connection add nothing to the
+	// cost of the items that are counted by the connection field.
+	pass := func(child int) int { return child }
+	c.CourseConnection.Edges, c.CourseEdge.Node = pass, pass
+	c.CourseBlueprintConnection.Edges, c.CourseBlueprintEdge.Node = pass, pass
+	c.LectureConnection.Edges, c.LectureEdge.Node = pass, pass
+	c.SubCourseConnection.Edges, c.SubCourseEdge.Node = pass, pass
+	c.ExamConnection.Edges, c.ExamEdge.Node = pass, pass
+	c.InstructorConnection.Edges, c.InstructorEdge.Node = pass, pass
+	c.EnrollmentConnection.Edges, c.EnrollmentEdge.Node = pass, pass
+	c.SubjectConnection.Edges, c.SubjectEdge.Node = pass, pass
+	c.SemesterConnection.Edges, c.SemesterEdge.Node = pass, pass
+	c.UserConnection.Edges, c.UserEdge.Node = pass, pass
+}
+
+// listComplexity is the cost of a list field, its fields are
+// counted once for every item that the list could have.
+func listComplexity(child int, limit *int, size int) int {
+	if limit != nil && *limit >= 0 && *limit < size {
+		size = *limit
+	}
+	if size < 1 {
+		size = 1
+	}
+	return 1 + child*size
+}
+
+// limits rejects queries that are nested too deeply or are too
+// complex, and takes the complexity of every query from the client's
+// budget in the rate store.
+type limits struct {
+	maxDepth      int
+	maxComplexity int
+	budget        limiter.Rate
+	store         limiter.Store
+
+	es graphql.ExecutableSchema
+}
+
+var _ interface {
+	graphql.HandlerExtension
+	graphql.OperationContextMutator
+} = (*limits)(nil)
+
+func newLimits(conf *app.Config, store limiter.Store) *limits {
+	var c app.GraphQLConfig
+	if conf != nil {
+		c = conf.GraphQL
+	}
+	if c.MaxDepth <= 0 {
+		c.MaxDepth = defaultMaxDepth
+	}
+	if c.MaxComplexity <= 0 {
+		c.MaxComplexity = defaultMaxComplexity
+	}
+	if c.ComplexityBudget == 0 {
+		c.ComplexityBudget = defaultComplexityBudget
+	}
+	l := &limits{
+		maxDepth:      c.MaxDepth,
+		maxComplexity: c.MaxComplexity,
+	}
+	if c.ComplexityBudget > 0 && store != nil {
+		l.store = store
+		l.budget = limiter.Rate{
+			Period: time.Minute,
+			Limit:  (c.ComplexityBudget + budgetUnit - 1) / budgetUnit,
+		}
+	}
+	return l
+}
+
+func (l *limits) ExtensionName() string { return "Limits" }
+
+func (l *limits) Validate(es graphql.ExecutableSchema) error {
+	l.es = es
+	return nil
+}
+
+func (l *limits) MutateOperationContext(ctx context.Context, rc *graphql.OperationContext) *gqlerror.Error {
+	op := rc.Doc.Operations.ForName(rc.OperationName)
+	if op == nil {
+		return nil
+	}
+	if d := depth(op.SelectionSet); d > l.maxDepth {
+		err := gqlerror.Errorf("query has a depth of %d, which exceeds the limit of %d", d, l.maxDepth)
+		errcode.Set(err, errDepthLimit)
+		return err
+	}
+	c := complexity.Calculate(l.es, op, rc.Variables)
+	if c > l.maxComplexity {
+		err := gqlerror.Errorf("query has a complexity of %d, which exceeds the limit of %d", c, l.maxComplexity)
+		errcode.Set(err, errComplexity)
+		return err
+	}
+	if l.store == nil {
+		return nil
+	}
+	return l.spend(ctx, c)
+}
+
+// spend takes the complexity from the budget of the client's ip
+// address. Queries are rejected if there is not enough left.
+func (l *limits) spend(ctx context.Context, c int) *gqlerror.Error {
+	var (
+		key      = "graphql:complexity:" + clientIP(ctx)
+		units    = int64((c + budgetUnit - 1) / budgetUnit)
+		lctx     limiter.Context
+		err      error
+		exceeded = func(reset int64) *gqlerror.Error {
+			retry := reset - time.Now().Unix()
+			e := gqlerror.Errorf(
+				"query complexity budget of %d per minute exceeded, retry in %d seconds",
+				l.budget.Limit*budgetUnit, retry,
+			)
+			errcode.Set(e, errBudgetLimit)
+			e.Extensions["retryAfter"] = retry
+			return e
+		}
+	)
+	if units == 0 {
+		return nil
+	}
+	lctx, err = l.store.Peek(ctx, key, l.budget)
+	if err != nil {
+		log.Println("could not check graphql budget:", err)
+		return nil
+	}
+	if lctx.Remaining < units {
+		return exceeded(lctx.Reset)
+	}
+	for i := int64(0); i < units; i++ {
+		if lctx, err = l.store.Get(ctx, key, l.budget); err != nil {
+			log.Println("could not spend graphql budget:", err)
+			return nil
+		}
+	}
+	if lctx.Reached {
+		return exceeded(lctx.Reset)
+	}
+	return nil
+}
+
+// depth returns the deepest nesting of fields in a selection set.
+// Introspection fields are not counted.
+func depth(set ast.SelectionSet) int {
+	max := 0
+	for _, sel := range set {
+		var d int
+		switch s := sel.(type) {
+		case *ast.Field:
+			if strings.HasPrefix(s.Name, "__") {
+				continue
+			}
+			d = 1 + depth(s.SelectionSet)
+		case *ast.InlineFragment:
+			d = depth(s.SelectionSet)
+		case *ast.FragmentSpread:
+			if s.Definition != nil {
+				d = depth(s.Definition.SelectionSet)
+			}
+		}
+		if d > max {
+			max = d
+		}
+	}
+	return max
+}
@@ -0,0 +1,123 @@
+package gql
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"github.com/mercedtime/api/app"
+	"github.com/ulule/limiter/v3/drivers/store/memory"
+)
+
+func TestListComplexity(t *testing.T) {
+	n := func(i int) *int { return &i }
+	for _, tt := range []struct {
+		child int
+		limit *int
+		size  int
+		exp   int
+	}{
+		{child: 2, limit: nil, size: 500, exp: 1001},
+		{child: 2, limit: n(10), size: 500, exp: 21},
+		{child: 2, limit: n(1000), size: 500, exp: 1001},
+		{child: 2, limit: n(0), size: 500, exp: 3},
+		{child: 2, limit: n(-1), size: 500, exp: 1001},
+		{child: 3, limit: nil, size: 5, exp: 16},
+	} {
+		if c := listComplexity(tt.child, tt.limit, tt.size); c != tt.exp {
+			t.Errorf("listComplexity(%d, %v, %d) = %d, want %d", tt.child, tt.limit, tt.size, c, tt.exp)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	db := sqlx.NewDb(sql.OpenDB(&countingConnector{}), "postgres")
+	defer db.Close()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/graphql", testHandler(t, &app.App{
+		DB: db,
+		Config: &app.Config{GraphQL: app.GraphQLConfig{
+			MaxDepth:         7,
+			MaxComplexity:    1000,
+			ComplexityBudget: 1500,
+		}},
+		RateStore: memory.NewStore(),
+	}))
+
+	for _, tt := range []struct {
+		query string
+		code  string // error code, empty if the query is allowed
+		msg   string
+	}{
+		{
+			query: `{ courses(first: 10) { edges { node { crn subcourses { edges { node { crn } } } } } } }`,
+		},
+		{
+			query: `{ courses(first: 1) { edges { node { subcourses { edges { node { instructor { name } } } } } } } }`,
+			code:  errDepthLimit, msg: "depth of 8, which exceeds the limit of 7",
+		},
+		{
+			query: `{ courses(first: 1) { edges { node { ...c } } } } fragment c on Course { subcourses { edges { node { instructor { name } } } } }`,
+			code:  errDepthLimit, msg: "depth of 8",
+		},
+		{
+			// unlimited lists are assumed to be large
+			query: `{ courses { edges { node { crn title } } } }`,
+			code:  errComplexity, msg: "complexity of 1001, which exceeds the limit of 1000",
+		},
+		{
+			query: `query($n: Int) { courses(first: $n) { edges { node { crn title } } } }`,
+			code:  errComplexity, msg: "complexity of 1001",
+		},
+		{
+			query: `{ courses(first: 100) { edges { node { crn enrollment { edges { node { enrolled } } } } } } }`,
+			code:  errComplexity, msg: "complexity of 3201",
+		},
+		{
+			// spends 1000 of the 1400 left, budgets are spent in units of 100
+			query: `{ courses(first: 300) { edges { node { crn title subject } } } }`,
+		},
+		{
+			query: `{ courses(first: 300) { edges { node { crn title subject } } } }`,
+			code:  errBudgetLimit, msg: "budget of 1500 per minute exceeded",
+		},
+	} {
+		body, _ := json.Marshal(map[string]string{"query": tt.query})
+		req := httptest.NewRequest("POST", "/graphql", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		var resp struct {
+			Errors []struct {
+				Message    string
+				Extensions map[string]interface{}
+			}
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if tt.code == "" {
+			if len(resp.Errors) > 0 {
+				t.Errorf("%s: unexpected errors %v", tt.query, resp.Errors)
+			}
+			continue
+		}
+		if len(resp.Errors) != 1 {
+			t.Errorf("%s: expected one error, got %v", tt.query, resp.Errors)
+			continue
+		}
+		e := resp.Errors[0]
+		if e.Extensions["code"] != tt.code {
+			t.Errorf("%s: got error code %v, want %s", tt.query, e.Extensions["code"], tt.code)
+		}
+		if !strings.Contains(e.Message, tt.msg) {
+			t.Errorf("%s: expected %q in the error %q", tt.query, tt.msg, e.Message)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package gql
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/mercedtime/api/catalog"
+	"github.com/mercedtime/api/db/models"
+)
+
+var (
+	// How long a loader waits for more keys before running a batch.
+	loaderWait = time.Millisecond * 2
+	// The most keys a loader fetches with one query.
+	loaderMaxBatch = 500
+)
+
+type loadersKey struct{}
+
+// Loaders batch the queries made by resolvers during one request so
+// that a nested field costs one query no matter how many parents are
+// being resolved.
+type Loaders struct {
+	instructors *loader // by instructor id
+	lectures    *loader // by crn
+	subcourses  *loader // aux rows by lecture crn
+	exams       *loader // by crn
+	enrollment  *loader // by crn
+	taught      *loader // courses by instructor id
+}
+
+// newLoaders makes the loaders for a request, results
+// are only cached for the request if cache is true.
+func newLoaders(ctx context.Context, db *sqlx.DB, cache bool) *Loaders {
+	return &Loaders{
+		instructors: newLoader(ctx, cache, func(ctx context.Context, keys []int64) (map[int64]interface{}, error) {
+			rows := make([]*models.Instructor, 0, len(keys))
+			err := db.SelectContext(ctx, &rows, "SELECT id, name FROM instructor WHERE id = ANY($1)", pq.Array(keys))
+			res := make(map[int64]interface{}, len(rows))
+			for _, r := range rows {
+				res[r.ID] = r
+			}
+			return res, err
+		}),
+		lectures: newLoader(ctx, cache, func(ctx context.Context, keys []int64) (map[int64]interface{}, error) {
+			rows := make([]*models.Lecture, 0, len(keys))
+			err := db.SelectContext(ctx, &rows, "SELECT * FROM lectures WHERE crn = ANY($1)", pq.Array(keys))
+			res := make(map[int64]interface{}, len(rows))
+			for _, r := range rows {
+				res[int64(r.CRN)] = r
+			}
+			return res, err
+		}),
+		subcourses: newLoader(ctx, cache, func(ctx context.Context, keys []int64) (map[int64]interface{}, error) {
+			subs, err := selectSubcourses(ctx, db, subcourseSelect.Where(
+				"aux.course_crn = ANY(?)", pq.Array(keys),
+			).Where(notCancelled).OrderBy("aux.crn"))
+			res := make(map[int64]interface{}, len(keys))
+			for _, sub := range subs {
+				list, _ := res[int64(sub.CourseCRN)].([]*catalog.SubCourse)
+				res[int64(sub.CourseCRN)] = append(list, sub)
+			}
+			return res, err
+		}),
+		exams: newLoader(ctx, cache, func(ctx context.Context, keys []int64) (map[int64]interface{}, error) {
+			exams, err := selectExams(ctx, db, examSelect.Where("crn = ANY(?)", pq.Array(keys)))
+			res := make(map[int64]interface{}, len(exams))
+			for _, e := range exams {
+				res[int64(e.CRN)] = e
+			}
+			return res, err
+		}),
+		enrollment: newLoader(ctx, cache, func(ctx context.Context, keys []int64) (map[int64]interface{}, error) {
+			rows := make([]*models.Enrollment, 0, len(keys))
+			err := db.SelectContext(ctx, &rows, "SELECT * FROM enrollment WHERE crn = ANY($1) ORDER BY ts", pq.Array(keys))
+			res := make(map[int64]interface{}, len(keys))
+			for _, r := range rows {
+				list, _ := res[int64(r.CRN)].([]*models.Enrollment)
+				res[int64(r.CRN)] = append(list, r)
+			}
+			return res, err
+		}),
+		taught: newLoader(ctx, cache, func(ctx context.Context, keys []int64) (map[int64]interface{}, error) {
+			rows := make([]*struct {
+				InstructorID int64 `db:"instructor_id"`
+				catalog.Entry
+			}, 0, len(keys))
+			err := db.SelectContext(ctx, &rows, `
+			  SELECT lectures.instructor_id, course.*
+			  FROM course
+			  JOIN lectures ON lectures.crn = course.crn
+			  WHERE lectures.instructor_id = ANY($1)
+			    AND course.cancelled_at IS NULL
+			  ORDER BY course.crn`, pq.Array(keys))
+			res := make(map[int64]interface{}, len(keys))
+			for _, r := range rows {
+				list, _ := res[r.InstructorID].([]*catalog.Course)
+				res[r.InstructorID] = append(list, &catalog.Course{Entry: r.Entry})
+			}
+			return res, err
+		}),
+	}
+}
+
+var (
+	// subcourseSelect selects labs and discussions the same way as the
+	// subcourses in the catalog view. They are read as json because
+	// most of the aux columns are nullable.
+	subcourseSelect = psql.Select(`json_build_object(
+	    'crn',           aux.crn,
+	    'course_crn',    aux.course_crn,
+	    'section',       aux.section,
+	    'days',          course.days,
+	    'enrolled',      course.enrolled,
+	    'capacity',      course.capacity,
+	    'remaining',     course.remaining,
+	    'start_time',    aux.start_time,
+	    'end_time',      aux.end_time,
+	    'building_room', aux.building_room,
+	    'instructor_id', aux.instructor_id,
+	    'updated_at',    aux.updated_at
+	  )`).From("aux").Join("course ON aux.crn = course.crn")
+
+	// exams are also read as json because the times are nullable
+	examSelect = psql.Select("row_to_json(exam)").From("exam")
+
+	// notCancelled leaves out the sections that are no longer
+	// offered, they can still be fetched by id.
+	notCancelled = sq.Eq{"course.cancelled_at": nil}
+)
+
+func selectSubcourses(ctx context.Context, db *sqlx.DB, q sq.SelectBuilder) ([]*catalog.SubCourse, error) {
+	rows := make([][]byte, 0)
+	if err := selectQuery(ctx, db, &rows, q); err != nil {
+		return nil, err
+	}
+	res := make([]*catalog.SubCourse, len(rows))
+	for i, r := range rows {
+		res[i] = new(catalog.SubCourse)
+		if err := json.Unmarshal(r, res[i]); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func selectExams(ctx context.Context, db *sqlx.DB, q sq.SelectBuilder) ([]*models.Exam, error) {
+	rows := make([][]byte, 0)
+	if err := selectQuery(ctx, db, &rows, q); err != nil {
+		return nil, err
+	}
+	res := make([]*models.Exam, len(rows))
+	for i, r := range rows {
+		res[i] = new(models.Exam)
+		if err := json.Unmarshal(r, res[i]); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func loadersFrom(ctx context.Context) *Loaders {
+	return ctx.Value(loadersKey{}).(*Loaders)
+}
+
+// Instructor loads an instructor by id.
+func (l *Loaders) Instructor(id int64) (*models.Instructor, error) {
+	v, err := l.instructors.load(id)
+	i, _ := v.(*models.Instructor)
+	return i, err
+}
+
+// Lecture loads a lecture by crn.
+func (l *Loaders) Lecture(crn int) (*models.Lecture, error) {
+	v, err := l.lectures.load(int64(crn))
+	lect, _ := v.(*models.Lecture)
+	return lect, err
+}
+
+// Subcourses loads the labs and discussions of a lecture.
+func (l *Loaders) Subcourses(crn int) ([]*catalog.SubCourse, error) {
+	v, err := l.subcourses.load(int64(crn))
+	sub, _ := v.([]*catalog.SubCourse)
+	if sub == nil {
+		sub = []*catalog.SubCourse{}
+	}
+	return sub, err
+}
+
+// Exam loads the exam for a crn.
+func (l *Loaders) Exam(crn int) (*models.Exam, error) {
+	v, err := l.exams.load(int64(crn))
+	e, _ := v.(*models.Exam)
+	return e, err
+}
+
+// Enrollment loads the enrollment history of a crn, oldest first.
+func (l *Loaders) Enrollment(crn int) ([]*models.Enrollment, error) {
+	v, err := l.enrollment.load(int64(crn))
+	e, _ := v.([]*models.Enrollment)
+	if e == nil {
+		e = []*models.Enrollment{}
+	}
+	return e, err
+}
+
+// InstructorCourses loads the lectures taught by an instructor.
+func (l *Loaders) InstructorCourses(id int64) ([]*catalog.Course, error) {
+	v, err := l.taught.load(id)
+	c, _ := v.([]*catalog.Course)
+	if c == nil {
+		c = []*catalog.Course{}
+	}
+	return c, err
+}
+
+type fetchFunc func(ctx context.Context, keys []int64) (map[int64]interface{}, error)
+
+// loader collects the keys requested within loaderWait of each
+// other and fetches them with one call, up to loaderMaxBatch keys
+// at a time. If keep is true the results are cached for the
+// lifetime of the loader, otherwise they are only shared by the
+// loads in the same batch.
+type loader struct {
+	ctx   context.Context
+	fetch fetchFunc
+	keep  bool
+
+	mu    sync.Mutex
+	cache map[int64]*result
+	batch *batch
+}
+
+type result struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+}
+
+type batch struct {
+	keys    []int64
+	results []*result
+}
+
+func newLoader(ctx context.Context, keep bool, fetch fetchFunc) *loader {
+	return &loader{ctx: ctx, fetch: fetch, keep: keep, cache: make(map[int64]*result)}
+}
+
+func (l *loader) load(key int64) (interface{}, error) {
+	l.mu.Lock()
+	r, ok := l.cache[key]
+	if !ok {
+		r = &result{done: make(chan struct{})}
+		l.cache[key] = r
+		if l.batch == nil {
+			l.batch = &batch{}
+			go l.run(l.batch)
+		}
+		l.batch.keys = append(l.batch.keys, key)
+		l.batch.results = append(l.batch.results, r)
+		if len(l.batch.keys) >= loaderMaxBatch {
+			l.batch = nil // the next key starts a new batch
+		}
+	}
+	l.mu.Unlock()
+	<-r.done
+	return r.val, r.err
+}
+
+func (l *loader) run(b *batch) {
+	time.Sleep(loaderWait)
+	l.mu.Lock()
+	if l.batch == b {
+		l.batch = nil // no more keys are added to b
+	}
+	l.mu.Unlock()
+
+	vals, err := l.fetch(l.ctx, b.keys)
+	if !l.keep {
+		l.mu.Lock()
+		for _, key := range b.keys {
+			delete(l.cache, key)
+		}
+		l.mu.Unlock()
+	}
+	for i, key := range b.keys {
+		r := b.results[i]
+		r.val, r.err = vals[key], err
+		close(r.done)
+	}
+}
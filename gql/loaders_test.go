@@ -0,0 +1,332 @@
+package gql
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"github.com/mercedtime/api/app"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoadersQueryCount(t *testing.T) {
+	wait := loaderWait
+	loaderWait = time.Millisecond * 20
+	defer func() { loaderWait = wait }()
+
+	db := sqlx.NewDb(sql.OpenDB(&countingConnector{}), "postgres")
+	defer db.Close()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/graphql", testHandler(t, &app.App{DB: db}))
+
+	// courses, exams, subcourses, lectures, enrollment, and
+	// instructors for lectures and subcourses
+	const maxQueries = 7
+	for _, n := range []int{1, 10, 50} {
+		queries = 0
+		body, _ := json.Marshal(map[string]string{"query": fmt.Sprintf(`{
+		  courses(first: %d) {
+		    edges { node {
+		      crn
+		      exam { date }
+		      instructor { name }
+		      enrollment { edges { node { enrolled } } }
+		      subcourses { edges { node { crn instructor { name } } } }
+		    } }
+		  }
+		}`, n)})
+		req := httptest.NewRequest("POST", "/graphql", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+
+		var resp struct {
+			Data struct {
+				Courses struct {
+					Edges []struct {
+						Node struct {
+							CRN        int
+							Instructor struct{ Name string }
+							Subcourses struct {
+								Edges []struct {
+									Node struct {
+										Instructor struct{ Name string }
+									}
+								}
+							}
+						}
+					}
+				}
+			}
+			Errors []interface{}
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Errors) > 0 {
+			t.Fatalf("%d courses: %v", n, resp.Errors)
+		}
+		edges := resp.Data.Courses.Edges
+		if len(edges) != n {
+			t.Fatalf("expected %d courses, got %d", n, len(edges))
+		}
+		c := edges[n-1].Node
+		subs := c.Subcourses.Edges
+		if c.Instructor.Name == "" || len(subs) != 2 || subs[1].Node.Instructor.Name == "" {
+			t.Errorf("nested fields were not resolved: %+v", c)
+		}
+		if q := atomic.LoadInt64(&queries); q > maxQueries {
+			t.Errorf("%d courses took %d queries, want at most %d", n, q, maxQueries)
+		}
+	}
+}
+
+func TestLoaderBatch(t *testing.T) {
+	var calls int64
+	l := newLoader(context.Background(), true, func(ctx context.Context, keys []int64) (map[int64]interface{}, error) {
+		atomic.AddInt64(&calls, 1)
+		res := make(map[int64]interface{})
+		for _, k := range keys {
+			res[k] = k * 2
+		}
+		return res, nil
+	})
+	done := make(chan struct{})
+	for i := 0; i < 20; i++ {
+		go func(key int64) {
+			defer func() { done <- struct{}{} }()
+			v, err := l.load(key)
+			if err != nil || v.(int64) != key*2 {
+				t.Errorf("load(%d) = %v, %v", key, v, err)
+			}
+		}(int64(i % 10))
+	}
+	for i := 0; i < 20; i++ {
+		<-done
+	}
+	if calls != 1 {
+		t.Errorf("expected one batch, got %d", calls)
+	}
+	// cached
+	if _, err := l.load(3); err != nil || calls != 1 {
+		t.Errorf("expected a cached value")
+	}
+}
+
+func TestLoaderMaxBatch(t *testing.T) {
+	max := loaderMaxBatch
+	loaderMaxBatch = 4
+	defer func() { loaderMaxBatch = max }()
+	var calls int64
+	l := newLoader(context.Background(), false, func(ctx context.Context, keys []int64) (map[int64]interface{}, error) {
+		atomic.AddInt64(&calls, 1)
+		if len(keys) > loaderMaxBatch {
+			t.Errorf("got a batch of %d keys", len(keys))
+		}
+		res := make(map[int64]interface{})
+		for _, k := range keys {
+			res[k] = k
+		}
+		return res, nil
+	})
+	done := make(chan struct{})
+	for i := 0; i < 10; i++ {
+		go func(key int64) {
+			defer func() { done <- struct{}{} }()
+			if v, err := l.load(key); err != nil || v.(int64) != key {
+				t.Errorf("load(%d) = %v, %v", key, v, err)
+			}
+		}(int64(i))
+	}
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+	if calls < 3 {
+		t.Errorf("expected at least 3 batches, got %d", calls)
+	}
+	// not cached
+	calls = 0
+	if _, err := l.load(3); err != nil || calls != 1 {
+		t.Errorf("expected the value to be fetched again")
+	}
+}
+
+// queries is the number of queries run by the counting driver.
+var queries int64
+
+// failingKey makes the counting driver return an error.
+const failingKey = 999
+
+// cancelledKey is the id of a cancelled course, it is
+// left out of queries for courses that are not cancelled.
+const cancelledKey = 3
+
+// countingConnector is a fake database that makes up rows for the
+// queries made by the resolvers and counts the queries.
+type countingConnector struct{}
+
+func (c *countingConnector) Connect(context.Context) (driver.Conn, error) {
+	return &countingConn{}, nil
+}
+func (c *countingConnector) Driver() driver.Driver { return nil }
+
+type countingConn struct{}
+
+func (c *countingConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c *countingConn) Close() error                        { return nil }
+func (c *countingConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+func (c *countingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	atomic.AddInt64(&queries, 1)
+	var (
+		now  = time.Now()
+		keys []int64
+	)
+	if i := strings.Index(query, "LIMIT "); i >= 0 {
+		n, _ := strconv.Atoi(strings.Fields(query[i:])[1])
+		keys = make([]int64, n)
+		for i := range keys {
+			keys[i] = int64(i + 1)
+		}
+	}
+	if len(args) > 0 {
+		switch v := args[0].Value.(type) {
+		case int64:
+			keys = append(keys, v)
+		case string: // pq.Array
+			if !strings.HasPrefix(v, "{") {
+				break
+			}
+			for _, k := range strings.Split(strings.Trim(v, "{}"), ",") {
+				n, _ := strconv.ParseInt(k, 10, 64)
+				keys = append(keys, n)
+			}
+		}
+	}
+	for _, k := range keys {
+		if k == failingKey {
+			return nil, errors.New("database is down")
+		}
+	}
+	rows := &fakeRows{}
+	switch {
+	case strings.Contains(query, "FROM aux"):
+		rows.cols = []string{"json_build_object"}
+		for _, k := range keys {
+			for i := int64(1); i <= 2; i++ {
+				sub := fmt.Sprintf(`{"crn": %d, "course_crn": %d, "instructor_id": %d}`, k*10+i, k, k%3+1)
+				rows.add([]byte(sub))
+			}
+		}
+	case strings.Contains(query, "FROM exam"):
+		rows.cols = []string{"row_to_json"}
+		for _, k := range keys {
+			rows.add([]byte(fmt.Sprintf(`{"crn": %d, "date": "2021-05-10T00:00:00Z"}`, k)))
+		}
+	case strings.Contains(query, "FROM enrollment"):
+		rows.cols = []string{"crn", "year", "term", "ts", "enrolled", "capacity"}
+		for _, k := range keys {
+			rows.add(k, int64(2021), int64(1), now, int64(10), int64(20))
+		}
+	case strings.Contains(query, "FROM instructor"):
+		rows.cols = []string{"id", "name"}
+		for _, k := range keys {
+			rows.add(k, "instructor "+strconv.FormatInt(k, 10))
+		}
+	case strings.Contains(query, "FROM lectures"):
+		rows.cols = []string{"crn", "start_time", "end_time", "start_date", "end_date", "instructor_id", "updated_at"}
+		for _, k := range keys {
+			rows.add(k, now, now, now, now, k%3+1, now)
+		}
+	case strings.Contains(query, "FROM course"):
+		rows.cols = []string{
+			"id", "crn", "subject", "course_num", "type", "title", "units", "days", "description",
+			"capacity", "enrolled", "remaining", "updated_at", "year", "term_id", "cancelled_at",
+		}
+		taught := strings.Contains(query, "instructor_id")
+		if taught {
+			rows.cols = append([]string{"instructor_id"}, rows.cols...)
+		}
+		for _, k := range keys {
+			var cancelled interface{}
+			if k == cancelledKey {
+				if strings.Contains(query, "cancelled_at IS NULL") {
+					continue
+				}
+				cancelled = now
+			}
+			row := []interface{}{k, k, "CSE", int64(100), "LECT", "title", int64(4), []byte("{monday}"), "",
+				int64(20), int64(10), int64(10), now, int64(2021), int64(1), cancelled}
+			if taught {
+				row = append([]interface{}{k}, row...)
+			}
+			rows.add(row...)
+		}
+	case strings.Contains(query, "users"):
+		if strings.Contains(query, "count(*)") {
+			rows.cols = []string{"count"}
+			rows.add(int64(1))
+			break
+		}
+		id := int64(1)
+		if len(keys) > 0 {
+			id = keys[0]
+		}
+		rows.cols = []string{
+			"id", "name", "email", "is_admin", "created_at", "hash",
+			"disabled_at", "locked_until", "reset_required", "failed_logins",
+		}
+		rows.add(id, fmt.Sprintf("user %d", id), fmt.Sprintf("user%d@example.com", id),
+			id == 1, now, passwordHash, nil, nil, false, int64(0))
+	default:
+		return nil, fmt.Errorf("unexpected query %q", query)
+	}
+	return rows, nil
+}
+
+func (c *countingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	atomic.AddInt64(&queries, 1)
+	return driver.RowsAffected(1), nil
+}
+
+// passwordHash is the hash of "password" for every fake user
+var passwordHash, _ = bcrypt.GenerateFromPassword([]byte("password"), bcrypt.DefaultCost)
+
+type fakeRows struct {
+	cols []string
+	rows [][]driver.Value
+}
+
+func (r *fakeRows) add(vals ...interface{}) {
+	row := make([]driver.Value, len(vals))
+	for i, v := range vals {
+		row[i] = v
+	}
+	r.rows = append(r.rows, row)
+}
+
+func (r *fakeRows) Columns() []string { return r.cols }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
@@ -0,0 +1,93 @@
+package gql
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/99designs/gqlgen/graphql/errcode"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+const (
+	defaultAPQCacheSize = 1000
+
+	errNotAllowed = "PERSISTED_QUERY_NOT_ALLOWED"
+)
+
+// allowList holds the queries registered ahead of time by their
+// sha256 hash. Clients can send just the hash of a registered query
+// like they would for an automatic persisted query. In strict mode
+// any other query is rejected.
+type allowList struct {
+	queries map[string]string
+	strict  bool
+}
+
+var _ interface {
+	graphql.HandlerExtension
+	graphql.OperationParameterMutator
+} = (*allowList)(nil)
+
+// loadAllowList reads every .graphql file in a directory. Queries
+// are matched by their exact text, so clients have to send the
+// contents of the files unchanged.
+func loadAllowList(dir string, strict bool) (*allowList, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	l := &allowList{queries: make(map[string]string), strict: strict}
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".graphql" {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		l.queries[queryHash(string(b))] = string(b)
+	}
+	return l, nil
+}
+
+func (l *allowList) ExtensionName() string { return "AllowList" }
+
+func (l *allowList) Validate(graphql.ExecutableSchema) error { return nil }
+
+func (l *allowList) MutateOperationParameters(ctx context.Context, params *graphql.RawParams) *gqlerror.Error {
+	if params.Query == "" {
+		if q, ok := l.queries[persistedHash(params)]; ok {
+			params.Query = q
+			return nil
+		}
+		if !l.strict {
+			// may be in the apq cache
+			return nil
+		}
+	} else if _, ok := l.queries[queryHash(params.Query)]; ok || !l.strict {
+		return nil
+	}
+	err := gqlerror.Errorf("query is not in the list of persisted queries")
+	errcode.Set(err, errNotAllowed)
+	return err
+}
+
+// persistedHash returns the hash sent in the persisted
+// query extension of a request.
+func persistedHash(params *graphql.RawParams) string {
+	ext, ok := params.Extensions["persistedQuery"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	hash, _ := ext["sha256Hash"].(string)
+	return hash
+}
+
+func queryHash(query string) string {
+	b := sha256.Sum256([]byte(query))
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,114 @@
+package gql
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"github.com/mercedtime/api/app"
+)
+
+func TestPersistedQueries(t *testing.T) {
+	const (
+		allowed = "{ exams(first: 1) { edges { node { crn } } } }\n"
+		other   = "{ exams(first: 2) { edges { node { crn date } } } }"
+	)
+	dir := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "exams.graphql"), []byte(allowed), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sqlx.NewDb(sql.OpenDB(&countingConnector{}), "postgres")
+	defer db.Close()
+	gin.SetMode(gin.TestMode)
+
+	for _, tt := range []struct {
+		mode string
+		reqs []struct{ query, hash, code string }
+	}{
+		{
+			mode: gin.DebugMode,
+			reqs: []struct{ query, hash, code string }{
+				{query: other},
+				{hash: queryHash(other), code: "PERSISTED_QUERY_NOT_FOUND"},
+				// registered by sending the query with its hash
+				{query: other, hash: queryHash(other)},
+				{hash: queryHash(other)},
+				{hash: queryHash(allowed)},
+			},
+		},
+		{
+			mode: gin.ReleaseMode,
+			reqs: []struct{ query, hash, code string }{
+				{query: allowed},
+				{hash: queryHash(allowed)},
+				{query: other, code: errNotAllowed},
+				{query: other, hash: queryHash(other), code: errNotAllowed},
+				{hash: queryHash(other), code: errNotAllowed},
+			},
+		},
+	} {
+		r := gin.New()
+		r.POST("/graphql", testHandler(t, &app.App{
+			DB: db,
+			Config: &app.Config{
+				Mode:    tt.mode,
+				GraphQL: app.GraphQLConfig{PersistedQueries: dir},
+			},
+		}))
+		for _, req := range tt.reqs {
+			errs := postPersisted(t, r, req.query, req.hash)
+			if req.code == "" {
+				if len(errs) > 0 {
+					t.Errorf("%s mode %+v: unexpected errors %v", tt.mode, req, errs)
+				}
+				continue
+			}
+			if len(errs) != 1 || errs[0].Extensions["code"] != req.code {
+				t.Errorf("%s mode %+v: expected a %s error, got %v", tt.mode, req, req.code, errs)
+			}
+		}
+	}
+
+	_, err = Handler(&app.App{DB: db, Config: &app.Config{
+		GraphQL: app.GraphQLConfig{PersistedQueries: filepath.Join(dir, "missing")},
+	}})
+	if err == nil {
+		t.Error("expected an error for a missing directory")
+	}
+}
+
+type gqlError struct {
+	Message    string
+	Extensions map[string]interface{}
+}
+
+func postPersisted(t *testing.T, h http.Handler, query, hash string) []gqlError {
+	t.Helper()
+	params := map[string]interface{}{}
+	if query != "" {
+		params["query"] = query
+	}
+	if hash != "" {
+		params["extensions"] = map[string]interface{}{
+			"persistedQuery": map[string]interface{}{"version": 1, "sha256Hash": hash},
+		}
+	}
+	body, _ := json.Marshal(params)
+	req := httptest.NewRequest("POST", "/graphql", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	var resp struct{ Errors []gqlError }
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Errors
+}
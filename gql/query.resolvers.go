@@ -5,59 +5,179 @@ package gql
 
 import (
 	"context"
-	"fmt"
 
 	"github.com/mercedtime/api/catalog"
+	"github.com/mercedtime/api/db/models"
 	"github.com/mercedtime/api/gql/internal/graph"
+	"github.com/mercedtime/api/gql/relay"
 )
 
-func (r *queryResolver) Courses(ctx context.Context, limit *int, offset *int, subject *string) ([]*catalog.Course, error) {
-	return resolveCourses(ctx, r.DB, limit, offset, subject)
+func (r *queryResolver) Node(ctx context.Context, id string) (relay.Node, error) {
+	return node(ctx, r.DB, id)
 }
 
-func (r *queryResolver) Somequery(ctx context.Context, input *graph.BlueprintInput) (*int, error) {
-	panic(fmt.Errorf("not implemented"))
+func (r *queryResolver) Courses(ctx context.Context, first *int, after *string, subject *string, year *int, term *int, typeArg *string) (*graph.CourseConnection, error) {
+	p, err := relay.NewPage(first, after)
+	if err != nil {
+		return nil, err
+	}
+	list, err := resolveCourses(ctx, r.DB, p, subject, year, term, typeArg)
+	if err != nil {
+		return nil, err
+	}
+	return courseConnection(list, p), nil
+}
+
+func (r *queryResolver) Blueprints(ctx context.Context, first *int, after *string, subject *string, year *int, term *int) (*graph.CourseBlueprintConnection, error) {
+	p, err := relay.NewPage(first, after)
+	if err != nil {
+		return nil, err
+	}
+	list, err := resolveBlueprints(ctx, r.DB, p, subject, year, term)
+	if err != nil {
+		return nil, err
+	}
+	return blueprintConnection(list, p), nil
+}
+
+func (r *queryResolver) Catalog(ctx context.Context, first *int, after *string, subject *string, year *int, term *int) (*graph.CourseConnection, error) {
+	p, err := relay.NewPage(first, after)
+	if err != nil {
+		return nil, err
+	}
+	list, err := resolveCatalog(ctx, r.DB, p, subject, year, term)
+	if err != nil {
+		return nil, err
+	}
+	return courseConnection(list, p), nil
+}
+
+func (r *queryResolver) Course(ctx context.Context, id string) (*catalog.Course, error) {
+	n, err := nodeID(id, courseNode)
+	if err != nil {
+		return nil, err
+	}
+	return courseByID(ctx, r.DB, int(n))
+}
+
+func (r *queryResolver) Lecture(ctx context.Context, crn int) (*models.PrimaryCourse, error) {
+	return loadersFrom(ctx).Lecture(crn)
 }
 
-func (r *queryResolver) Blueprints(ctx context.Context, limit *int, offset *int, subject *string, year *int, term *string) ([]*catalog.CourseBlueprint, error) {
-	if subject == nil {
-		*subject = ""
+func (r *queryResolver) Lectures(ctx context.Context, first *int, after *string, subject *string, year *int, term *int) (*graph.LectureConnection, error) {
+	p, err := relay.NewPage(first, after)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		resp = make([]*models.PrimaryCourse, 0)
+		q    = psql.Select("lectures.*").From("lectures").Join(
+			"course ON course.crn = lectures.crn").Where(notCancelled)
+	)
+	q = page(semester(q, "course", subject, year, term), p)
+	if err = selectQuery(ctx, r.DB, &resp, q.OrderBy("lectures.crn")); err != nil {
+		return nil, err
+	}
+	return lectureConnection(resp, p), nil
+}
+
+func (r *queryResolver) Labs(ctx context.Context, first *int, after *string, subject *string, year *int, term *int) (*graph.SubCourseConnection, error) {
+	p, err := relay.NewPage(first, after)
+	if err != nil {
+		return nil, err
 	}
-	params := catalog.BlueprintParams{
-		SemesterParams: catalog.SemesterParams{
-			Subject: *subject,
-		},
+	list, err := resolveSubcourses(ctx, r.DB, models.Lab, p, subject, year, term)
+	if err != nil {
+		return nil, err
 	}
-	if year != nil {
-		params.Year = *year
+	return subcourseConnection(list, p), nil
+}
+
+func (r *queryResolver) Discussions(ctx context.Context, first *int, after *string, subject *string, year *int, term *int) (*graph.SubCourseConnection, error) {
+	p, err := relay.NewPage(first, after)
+	if err != nil {
+		return nil, err
 	}
-	if term != nil {
-		params.Term = *term
+	list, err := resolveSubcourses(ctx, r.DB, models.Discussion, p, subject, year, term)
+	if err != nil {
+		return nil, err
 	}
-	if limit != nil {
-		*params.Limit = uint(*limit)
+	return subcourseConnection(list, p), nil
+}
+
+func (r *queryResolver) Exams(ctx context.Context, first *int, after *string) (*graph.ExamConnection, error) {
+	p, err := relay.NewPage(first, after)
+	if err != nil {
+		return nil, err
+	}
+	list, err := selectExams(ctx, r.DB, page(examSelect, p).OrderBy("crn"))
+	if err != nil {
+		return nil, err
 	}
-	if offset != nil {
-		*params.Offset = uint(*offset)
+	return examConnection(list, p), nil
+}
+
+func (r *queryResolver) Instructor(ctx context.Context, id string) (*models.Instructor, error) {
+	n, err := nodeID(id, instrNode)
+	if err != nil {
+		return nil, err
 	}
-	return catalog.GetBlueprints(&params)
+	return loadersFrom(ctx).Instructor(n)
 }
 
-func (r *queryResolver) Catalog(ctx context.Context, limit *int, offset *int, subject *string) ([]*catalog.Course, error) {
-	return resolveCatalog(ctx, r.DB, limit, offset, subject)
+func (r *queryResolver) Instructors(ctx context.Context, first *int, after *string) (*graph.InstructorConnection, error) {
+	p, err := relay.NewPage(first, after)
+	if err != nil {
+		return nil, err
+	}
+	resp := make([]*models.Instructor, 0)
+	q := page(psql.Select("id", "name").From("instructor"), p)
+	if err = selectQuery(ctx, r.DB, &resp, q.OrderBy("id")); err != nil {
+		return nil, err
+	}
+	return instructorConnection(resp, p), nil
 }
 
-func (r *queryResolver) Course(ctx context.Context, id int) (*catalog.Course, error) {
-	var e catalog.Course
-	err := r.DB.Get(&e, "select * from	course where id = $1", id)
+func (r *queryResolver) Subjects(ctx context.Context, first *int, after *string) (*graph.SubjectConnection, error) {
+	p, err := relay.NewPage(first, after)
 	if err != nil {
 		return nil, err
 	}
-	return &e, nil
+	resp := make([]*graph.Subject, 0)
+	q := page(psql.Select("code", "name").From("subject"), p)
+	if err = selectQuery(ctx, r.DB, &resp, q.OrderBy("code")); err != nil {
+		return nil, err
+	}
+	return subjectConnection(resp, p), nil
 }
 
-func (r *queryResolver) Subjects(ctx context.Context) ([]*graph.Subject, error) {
-	panic(fmt.Errorf("not implemented"))
+func (r *queryResolver) Terms(ctx context.Context, first *int, after *string) (*graph.SemesterConnection, error) {
+	p, err := relay.NewPage(first, after)
+	if err != nil {
+		return nil, err
+	}
+	q := page(psql.Select("year", "term_id").Distinct().From("course"), p)
+	query, args, err := q.OrderBy("year", "term_id").ToSql()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := r.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	resp := make([]*graph.Semester, 0)
+	for rows.Next() {
+		var s graph.Semester
+		if err = rows.Scan(&s.Year, &s.Term); err != nil {
+			return nil, err
+		}
+		resp = append(resp, &s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return semesterConnection(resp, p), nil
 }
 
 // Query returns graph.QueryResolver implementation.
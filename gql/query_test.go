@@ -0,0 +1,240 @@
+package gql
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"github.com/mercedtime/api/app"
+	"github.com/mercedtime/api/gql/relay"
+)
+
+func TestQueries(t *testing.T) {
+	db := sqlx.NewDb(sql.OpenDB(&countingConnector{}), "postgres")
+	defer db.Close()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/graphql", testHandler(t, &app.App{DB: db}))
+
+	var resp struct {
+		Courses struct {
+			Edges []struct {
+				Cursor string
+				Node   struct {
+					ID        string
+					CRN       int
+					Type      string
+					Term      string
+					UpdatedAt string `json:"updated_at"`
+				}
+			}
+			PageInfo relay.PageInfo
+		}
+		Lectures struct {
+			Edges []struct {
+				Node struct {
+					CRN        int
+					StartTime  string `json:"start_time"`
+					StartDate  string `json:"start_date"`
+					Exam       struct{ CRN int }
+					Instructor struct {
+						ID         string
+						DatabaseID int `json:"database_id"`
+						Courses    struct {
+							Edges []struct{ Node struct{ CRN int } }
+						}
+					}
+				}
+			}
+		}
+		Labs struct {
+			Edges []struct{ Node struct{ CRN int } }
+		}
+		Exams struct {
+			Edges []struct{ Node struct{ CRN int } }
+		}
+		Instructors struct {
+			Edges []struct{ Node struct{ Name string } }
+		}
+	}
+	query(t, r, `{
+	  courses(first: 2, year: 2021, term: SPRING, type: LECT) {
+	    edges { cursor node { id crn type term updated_at } }
+	    pageInfo { hasNextPage hasPreviousPage startCursor endCursor }
+	  }
+	  lectures(first: 3) { edges { node {
+	    crn start_time start_date
+	    exam { crn date }
+	    instructor { id database_id courses { edges { node { crn } } } }
+	  } } }
+	  labs(first: 2) { edges { node { crn course_crn } } }
+	  exams(first: 2) { edges { node { crn } } }
+	  instructors(first: 2) { edges { node { name } } }
+	}`, &resp)
+
+	if len(resp.Courses.Edges) != 2 || len(resp.Lectures.Edges) != 3 ||
+		len(resp.Exams.Edges) != 2 || len(resp.Instructors.Edges) != 2 {
+		t.Fatalf("wrong number of results: %+v", resp)
+	}
+	// the fake database makes two subcourses for every lecture
+	if n := len(resp.Labs.Edges); n != 2 {
+		t.Errorf("expected 2 labs, got %d", n)
+	}
+	info := resp.Courses.PageInfo
+	if !info.HasNextPage || info.HasPreviousPage || info.EndCursor == nil ||
+		*info.EndCursor != resp.Courses.Edges[1].Cursor {
+		t.Errorf("wrong page info %+v", info)
+	}
+	c := resp.Courses.Edges[0].Node
+	if c.Type != "LECT" || c.Term != "SPRING" {
+		t.Errorf("wrong enums: type %q, term %q", c.Type, c.Term)
+	}
+	if _, err := time.Parse(time.RFC3339, c.UpdatedAt); err != nil {
+		t.Errorf("updated_at is not a Date: %v", err)
+	}
+	lect := resp.Lectures.Edges[2].Node
+	if !regexp.MustCompile(`^\d\d:\d\d:\d\d$`).MatchString(lect.StartTime) {
+		t.Errorf("start_time %q is not a Time", lect.StartTime)
+	}
+	if _, err := time.Parse(time.RFC3339, lect.StartDate); err != nil {
+		t.Errorf("start_date is not a Date: %v", err)
+	}
+	if lect.Exam.CRN != lect.CRN {
+		t.Errorf("got exam for crn %d, want %d", lect.Exam.CRN, lect.CRN)
+	}
+	in := lect.Instructor
+	courses := in.Courses.Edges
+	if in.ID != relay.IntID("Instructor", int64(in.DatabaseID)) ||
+		len(courses) == 0 || courses[0].Node.CRN != in.DatabaseID {
+		t.Errorf("wrong instructor courses %+v", in)
+	}
+
+	// refetch the objects by their global ids
+	var nodes struct {
+		Course     struct{ CRN int }
+		Lecture    struct{ CRN int }
+		Instructor struct{ Name string }
+	}
+	query(t, r, `query($course: ID!, $lecture: ID!, $instructor: ID!) {
+	  course: node(id: $course) { ... on Course { crn } }
+	  lecture: node(id: $lecture) { ... on Lecture { crn } }
+	  instructor: node(id: $instructor) { ... on Instructor { name } }
+	}`, &nodes, map[string]interface{}{
+		"course":     c.ID,
+		"lecture":    relay.IntID("Lecture", 2),
+		"instructor": in.ID,
+	})
+	if nodes.Course.CRN != c.CRN || nodes.Lecture.CRN != 2 ||
+		nodes.Instructor.Name != fmt.Sprintf("instructor %d", in.DatabaseID) {
+		t.Errorf("wrong nodes %+v", nodes)
+	}
+}
+
+func TestNodeError(t *testing.T) {
+	db := sqlx.NewDb(sql.OpenDB(&countingConnector{}), "postgres")
+	defer db.Close()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/graphql", testHandler(t, &app.App{DB: db}))
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"query":     `query($id: ID!) { node(id: $id) { id } }`,
+		"variables": map[string]string{"id": relay.IntID("SubCourse", failingKey)},
+	})
+	req := httptest.NewRequest("POST", "/graphql", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	var resp struct {
+		Errors []struct{ Message string }
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Errors) != 1 || resp.Errors[0].Message != "database is down" {
+		t.Errorf("expected the database error, got %+v", resp.Errors)
+	}
+}
+
+func TestCancelledCourses(t *testing.T) {
+	db := sqlx.NewDb(sql.OpenDB(&countingConnector{}), "postgres")
+	defer db.Close()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/graphql", testHandler(t, &app.App{DB: db}))
+
+	type course struct {
+		CRN         int
+		CancelledAt *string `json:"cancelled_at"`
+	}
+	var resp struct {
+		Courses struct {
+			Edges []struct{ Node course }
+		}
+		Course *course
+	}
+	query(t, r, `query($id: ID!) {
+	  courses(first: 5) { edges { node { crn cancelled_at } } }
+	  course(id: $id) { crn cancelled_at }
+	}`, &resp, map[string]interface{}{"id": relay.IntID("Course", cancelledKey)})
+
+	if len(resp.Courses.Edges) == 0 {
+		t.Fatal("expected some courses")
+	}
+	for _, e := range resp.Courses.Edges {
+		if e.Node.CRN == cancelledKey || e.Node.CancelledAt != nil {
+			t.Errorf("cancelled course %+v should be left out", e.Node)
+		}
+	}
+	if resp.Course == nil || resp.Course.CRN != cancelledKey || resp.Course.CancelledAt == nil {
+		t.Fatalf("expected the cancelled course by id, got %+v", resp.Course)
+	}
+	if _, err := time.Parse(time.RFC3339, *resp.Course.CancelledAt); err != nil {
+		t.Errorf("cancelled_at should be a timestamp like the others: %v", err)
+	}
+}
+
+func testHandler(t *testing.T, a *app.App) gin.HandlerFunc {
+	t.Helper()
+	h, err := Handler(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// query posts a graphql query and decodes the data into dest,
+// the test fails if there are errors.
+func query(t *testing.T, h http.Handler, q string, dest interface{}, vars ...map[string]interface{}) {
+	t.Helper()
+	req := map[string]interface{}{"query": q}
+	if len(vars) > 0 {
+		req["variables"] = vars[0]
+	}
+	body, _ := json.Marshal(req)
+	r := httptest.NewRequest("POST", "/graphql", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	var resp struct {
+		Data   json.RawMessage
+		Errors []interface{}
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Errors) > 0 {
+		t.Fatal(resp.Errors)
+	}
+	if err := json.Unmarshal(resp.Data, dest); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,139 @@
+// Package relay implements the parts of the relay server
+// specification: global object ids and cursor pagination.
+package relay
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Node is an object that has a global id and can be refetched with
+// the node query. It has no methods because the objects are models
+// from other packages.
+type Node interface{}
+
+// ID returns the opaque global id of an object given its type
+// name and a key that is unique for that type.
+func ID(typ, key string) string {
+	return base64.StdEncoding.EncodeToString([]byte(typ + ":" + key))
+}
+
+// IntID returns the global id of an object with a numeric key.
+func IntID(typ string, key int64) string {
+	return ID(typ, strconv.FormatInt(key, 10))
+}
+
+// ErrInvalidID is returned when parsing a global id that was not
+// created by ID.
+var ErrInvalidID = errors.New("invalid id")
+
+// ParseID returns the type name and key of a global id.
+func ParseID(id string) (typ, key string, err error) {
+	b, err := base64.StdEncoding.DecodeString(id)
+	if err != nil {
+		return "", "", ErrInvalidID
+	}
+	parts := strings.SplitN(string(b), ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", ErrInvalidID
+	}
+	return parts[0], parts[1], nil
+}
+
+// PageInfo tells a client if there are more items
+// before or after the edges of a connection.
+type PageInfo struct {
+	HasNextPage     bool    `json:"hasNextPage"`
+	HasPreviousPage bool    `json:"hasPreviousPage"`
+	StartCursor     *string `json:"startCursor"`
+	EndCursor       *string `json:"endCursor"`
+}
+
+const cursorPrefix = "cursor:"
+
+// Cursor returns the cursor for the item at an index of a list.
+func Cursor(i int) string {
+	return base64.StdEncoding.EncodeToString([]byte(cursorPrefix + strconv.Itoa(i)))
+}
+
+// ErrInvalidCursor is returned for cursors that were not created
+// by Cursor and for a negative page size.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Page is the part of a list asked for with the first and after
+// arguments of a connection.
+type Page struct {
+	// Index of the first item
+	Offset int
+	// Max number of items, negative if there is no limit
+	Limit int
+}
+
+// NewPage creates a page of the first items after a cursor. Both
+// arguments are optional.
+func NewPage(first *int, after *string) (Page, error) {
+	p := Page{Limit: -1}
+	if first != nil {
+		if *first < 0 {
+			return p, errors.New("first must not be negative")
+		}
+		p.Limit = *first
+	}
+	if after != nil {
+		b, err := base64.StdEncoding.DecodeString(*after)
+		if err != nil || !strings.HasPrefix(string(b), cursorPrefix) {
+			return p, ErrInvalidCursor
+		}
+		i, err := strconv.Atoi(strings.TrimPrefix(string(b), cursorPrefix))
+		if err != nil || i < 0 {
+			return p, ErrInvalidCursor
+		}
+		p.Offset = i + 1
+	}
+	return p, nil
+}
+
+// Fetch returns the number of items to fetch from the page offset,
+// one more than the limit to find out if there is a next page.
+// Negative if there is no limit.
+func (p Page) Fetch() int {
+	if p.Limit < 0 {
+		return -1
+	}
+	return p.Limit + 1
+}
+
+// Slice returns the part of a list of n items that should be
+// fetched for the page.
+func (p Page) Slice(n int) (start, end int) {
+	start, end = p.Offset, n
+	if start > n {
+		start = n
+	}
+	if f := p.Fetch(); f >= 0 && start+f < end {
+		end = start + f
+	}
+	return start, end
+}
+
+// Edges takes the number of items fetched from the page offset
+// and returns how many of them are in the page and the page info.
+func (p Page) Edges(n int) (int, *PageInfo) {
+	info := &PageInfo{HasPreviousPage: p.Offset > 0}
+	if p.Limit >= 0 && n > p.Limit {
+		n = p.Limit
+		info.HasNextPage = true
+	}
+	if n > 0 {
+		start, end := p.Cursor(0), p.Cursor(n-1)
+		info.StartCursor, info.EndCursor = &start, &end
+	}
+	return n, info
+}
+
+// Cursor returns the cursor of the i'th item in the page.
+func (p Page) Cursor(i int) string {
+	return Cursor(p.Offset + i)
+}
@@ -0,0 +1,64 @@
+package relay
+
+import "testing"
+
+func TestID(t *testing.T) {
+	typ, key, err := ParseID(IntID("Course", 42))
+	if err != nil || typ != "Course" || key != "42" {
+		t.Errorf("ParseID = %q, %q, %v", typ, key, err)
+	}
+	typ, key, err = ParseID(ID("CourseBlueprint", "CSE:100"))
+	if err != nil || typ != "CourseBlueprint" || key != "CSE:100" {
+		t.Errorf("ParseID = %q, %q, %v", typ, key, err)
+	}
+	for _, id := range []string{"", "not base64!", ID("", "1"), ID("Course", ""), Cursor(1)[:4]} {
+		if _, _, err = ParseID(id); err != ErrInvalidID {
+			t.Errorf("ParseID(%q): expected an invalid id", id)
+		}
+	}
+}
+
+func TestPage(t *testing.T) {
+	n := func(i int) *int { return &i }
+	s := func(s string) *string { return &s }
+
+	p, err := NewPage(n(2), nil)
+	if err != nil || p.Offset != 0 || p.Fetch() != 3 {
+		t.Fatalf("NewPage = %+v, %v", p, err)
+	}
+	if start, end := p.Slice(10); start != 0 || end != 3 {
+		t.Errorf("Slice(10) = %d, %d", start, end)
+	}
+	k, info := p.Edges(3)
+	if k != 2 || !info.HasNextPage || info.HasPreviousPage || *info.EndCursor != Cursor(1) {
+		t.Errorf("Edges(3) = %d, %+v", k, info)
+	}
+
+	// the next page starts after the end cursor
+	p, err = NewPage(n(2), info.EndCursor)
+	if err != nil || p.Offset != 2 {
+		t.Fatalf("NewPage = %+v, %v", p, err)
+	}
+	if start, end := p.Slice(3); start != 2 || end != 3 {
+		t.Errorf("Slice(3) = %d, %d", start, end)
+	}
+	k, info = p.Edges(1)
+	if k != 1 || info.HasNextPage || !info.HasPreviousPage || *info.StartCursor != Cursor(2) {
+		t.Errorf("Edges(1) = %d, %+v", k, info)
+	}
+
+	p, _ = NewPage(nil, s(Cursor(20)))
+	if start, end := p.Slice(5); start != 5 || end != 5 || p.Fetch() != -1 {
+		t.Errorf("Slice(5) past the end = %d, %d", start, end)
+	}
+	if k, info = p.Edges(0); k != 0 || info.StartCursor != nil {
+		t.Errorf("Edges(0) = %d, %+v", k, info)
+	}
+
+	if _, err = NewPage(n(-1), nil); err == nil {
+		t.Error("expected an error for a negative page size")
+	}
+	if _, err = NewPage(nil, s(IntID("Course", 1))); err != ErrInvalidCursor {
+		t.Errorf("expected an invalid cursor, got %v", err)
+	}
+}
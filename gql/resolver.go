@@ -1,6 +1,9 @@
 package gql
 
-import "github.com/jmoiron/sqlx"
+import (
+	"github.com/jmoiron/sqlx"
+	"github.com/mercedtime/api/app"
+)
 
 // This file will not be regenerated automatically.
 //
@@ -9,4 +12,8 @@ import "github.com/jmoiron/sqlx"
 // Resolver is a graphql query resolver.
 type Resolver struct {
 	DB *sqlx.DB
+	// Hub sends catalog updates to subscriptions
+	Hub *app.Hub
+	// App runs the account mutations
+	App *app.App
 }
@@ -0,0 +1,89 @@
+// Package scalar has the marshalers for the custom
+// graphql scalars and enums that are not plain strings.
+package scalar
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/mercedtime/api/db/models"
+)
+
+// TimeFormat is the format of the Time scalar, a time of day.
+const TimeFormat = "15:04:05"
+
+// MarshalDate writes a date as an RFC3339 string, zero dates are null.
+func MarshalDate(t time.Time) graphql.Marshaler {
+	return marshalTime(t, time.RFC3339)
+}
+
+// UnmarshalDate reads an RFC3339 date.
+func UnmarshalDate(v interface{}) (time.Time, error) {
+	return unmarshalTime(v, time.RFC3339)
+}
+
+// MarshalTime writes the time of day, zero times are null.
+func MarshalTime(t time.Time) graphql.Marshaler {
+	return marshalTime(t, TimeFormat)
+}
+
+// UnmarshalTime reads a time of day formatted as hh:mm:ss.
+func UnmarshalTime(v interface{}) (time.Time, error) {
+	return unmarshalTime(v, TimeFormat)
+}
+
+func marshalTime(t time.Time, layout string) graphql.Marshaler {
+	if t.IsZero() {
+		return graphql.Null
+	}
+	return graphql.WriterFunc(func(w io.Writer) {
+		io.WriteString(w, strconv.Quote(t.Format(layout)))
+	})
+}
+
+func unmarshalTime(v interface{}, layout string) (time.Time, error) {
+	s, ok := v.(string)
+	if !ok {
+		return time.Time{}, fmt.Errorf("%T is not a time string", v)
+	}
+	return time.Parse(layout, s)
+}
+
+var terms = map[int]string{
+	models.Spring: "spring",
+	models.Summer: "summer",
+	models.Fall:   "fall",
+}
+
+// TermName returns the lowercase name of a term id
+// or an empty string if it is not a term.
+func TermName(id int) string {
+	return terms[id]
+}
+
+// MarshalTerm writes a term id as the Term enum.
+func MarshalTerm(id int) graphql.Marshaler {
+	name, ok := terms[id]
+	if !ok {
+		return graphql.Null
+	}
+	return graphql.MarshalString(strings.ToUpper(name))
+}
+
+// UnmarshalTerm reads the Term enum as a term id.
+func UnmarshalTerm(v interface{}) (int, error) {
+	s, ok := v.(string)
+	if !ok {
+		return 0, fmt.Errorf("%T is not a term", v)
+	}
+	for id, name := range terms {
+		if strings.EqualFold(s, name) {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("%q is not a valid term", s)
+}
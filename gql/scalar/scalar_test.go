@@ -0,0 +1,48 @@
+package scalar
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/mercedtime/api/db/models"
+)
+
+func TestScalars(t *testing.T) {
+	tm := time.Date(2021, time.May, 10, 13, 30, 5, 0, time.UTC)
+	for _, tt := range []struct {
+		name string
+		m    interface{ MarshalGQL(w io.Writer) }
+		exp  string
+	}{
+		{"date", MarshalDate(tm), `"2021-05-10T13:30:05Z"`},
+		{"time", MarshalTime(tm), `"13:30:05"`},
+		{"zero date", MarshalDate(time.Time{}), `null`},
+		{"zero time", MarshalTime(time.Time{}), `null`},
+		{"term", MarshalTerm(models.Fall), `"FALL"`},
+		{"bad term", MarshalTerm(9), `null`},
+	} {
+		var buf bytes.Buffer
+		tt.m.MarshalGQL(&buf)
+		if buf.String() != tt.exp {
+			t.Errorf("%s: got %s, want %s", tt.name, buf.String(), tt.exp)
+		}
+	}
+
+	if d, err := UnmarshalDate("2021-05-10T13:30:05Z"); err != nil || !d.Equal(tm) {
+		t.Errorf("UnmarshalDate = %v, %v", d, err)
+	}
+	if d, err := UnmarshalTime("13:30:05"); err != nil || d.Hour() != 13 || d.Second() != 5 {
+		t.Errorf("UnmarshalTime = %v, %v", d, err)
+	}
+	if _, err := UnmarshalTime(10); err == nil {
+		t.Error("expected an error for a number")
+	}
+	if id, err := UnmarshalTerm("SUMMER"); err != nil || id != models.Summer {
+		t.Errorf("UnmarshalTerm = %d, %v", id, err)
+	}
+	if _, err := UnmarshalTerm("WINTER"); err == nil {
+		t.Error("expected an error for an unknown term")
+	}
+}
@@ -0,0 +1,83 @@
+package gql
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/mercedtime/api/app"
+	"github.com/mercedtime/api/catalog"
+	"github.com/mercedtime/api/gql/scalar"
+)
+
+var errNoCRNs = errors.New("no crns given")
+
+func courseSubscription(year, term *int, subject *string, crns []int) (*app.SubscriptionRequest, error) {
+	req := &app.SubscriptionRequest{Type: "subscribe", CRNs: crns}
+	if year != nil || term != nil {
+		if year == nil || term == nil {
+			return nil, errors.New("year and term must be given together")
+		}
+		req.Semesters = []app.Semester{{Year: *year, Term: scalar.TermName(*term)}}
+	}
+	if subject != nil {
+		req.Subjects = []string{*subject}
+	}
+	return req, nil
+}
+
+// streamCourses sends every updated entry that passes the
+// filter as a course until the updates channel is closed.
+func streamCourses(
+	ctx context.Context,
+	updates <-chan []*catalog.Entry,
+	filter func(*catalog.Entry) bool,
+) <-chan *catalog.Course {
+	ch := make(chan *catalog.Course, 1)
+	go func() {
+		defer close(ch)
+		for entries := range updates {
+			for _, e := range entries {
+				if filter != nil && !filter(e) {
+					continue
+				}
+				select {
+				case ch <- &catalog.Course{Entry: *e}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+// remainingSeats returns the number of open seats for each crn.
+func remainingSeats(ctx context.Context, db *sqlx.DB, crns []int) (map[int]int, error) {
+	rows, err := db.QueryContext(
+		ctx,
+		"SELECT crn, remaining FROM course WHERE crn = ANY($1)",
+		pq.Array(crns),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make(map[int]int, len(crns))
+	for rows.Next() {
+		var crn, remaining int
+		if err = rows.Scan(&crn, &remaining); err != nil {
+			return nil, err
+		}
+		res[crn] = remaining
+	}
+	return res, rows.Err()
+}
+
+type ipKey struct{}
+
+func clientIP(ctx context.Context) string {
+	ip, _ := ctx.Value(ipKey{}).(string)
+	return ip
+}
@@ -0,0 +1,51 @@
+package gql
+
+// This file will be automatically regenerated based on the schema, any resolver implementations
+// will be copied through when generating and any unknown code will be moved to the end.
+
+import (
+	"context"
+
+	"github.com/mercedtime/api/app"
+	"github.com/mercedtime/api/catalog"
+	"github.com/mercedtime/api/gql/internal/graph"
+)
+
+func (r *subscriptionResolver) CourseUpdated(ctx context.Context, year *int, term *int, subject *string, crns []int) (<-chan *catalog.Course, error) {
+	req, err := courseSubscription(year, term, subject, crns)
+	if err != nil {
+		return nil, err
+	}
+	updates, err := r.Hub.Subscribe(ctx, clientIP(ctx), req)
+	if err != nil {
+		return nil, err
+	}
+	return streamCourses(ctx, updates, nil), nil
+}
+
+func (r *subscriptionResolver) SeatsOpened(ctx context.Context, crns []int) (<-chan *catalog.Course, error) {
+	if len(crns) == 0 {
+		return nil, errNoCRNs
+	}
+	remaining, err := remainingSeats(ctx, r.DB, crns)
+	if err != nil {
+		return nil, err
+	}
+	updates, err := r.Hub.Subscribe(ctx, clientIP(ctx), &app.SubscriptionRequest{
+		Type: "subscribe",
+		CRNs: crns,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return streamCourses(ctx, updates, func(e *catalog.Entry) bool {
+		prev, ok := remaining[e.CRN]
+		remaining[e.CRN] = e.Remaining
+		return ok && prev <= 0 && e.Remaining > 0
+	}), nil
+}
+
+// Subscription returns graph.SubscriptionResolver implementation.
+func (r *Resolver) Subscription() graph.SubscriptionResolver { return &subscriptionResolver{r} }
+
+type subscriptionResolver struct{ *Resolver }
@@ -0,0 +1,43 @@
+package gql
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mercedtime/api/catalog"
+	"github.com/mercedtime/api/db/models"
+)
+
+func TestCourseSubscription(t *testing.T) {
+	year, term, subject := 2021, models.Spring, "cse"
+	req, err := courseSubscription(&year, &term, &subject, []int{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(req.Semesters) != 1 || req.Semesters[0].Term != "spring" || req.Semesters[0].Year != 2021 {
+		t.Errorf("wrong semesters %+v", req.Semesters)
+	}
+	if len(req.Subjects) != 1 || len(req.CRNs) != 1 {
+		t.Errorf("wrong request %+v", req)
+	}
+	if _, err = courseSubscription(&year, nil, nil, nil); err == nil {
+		t.Error("expected an error for a year without a term")
+	}
+}
+
+func TestStreamCourses(t *testing.T) {
+	updates := make(chan []*catalog.Entry, 2)
+	updates <- []*catalog.Entry{{CRN: 1, Remaining: 0}, {CRN: 2, Remaining: 3}}
+	updates <- []*catalog.Entry{{CRN: 1, Remaining: 1}}
+	close(updates)
+	courses := streamCourses(context.Background(), updates, func(e *catalog.Entry) bool {
+		return e.Remaining > 0
+	})
+	var crns []int
+	for c := range courses {
+		crns = append(crns, c.CRN)
+	}
+	if len(crns) != 2 || crns[0] != 2 || crns[1] != 1 {
+		t.Errorf("got crns %v, want [2 1]", crns)
+	}
+}
@@ -0,0 +1,87 @@
+package gql
+
+// This file will be automatically regenerated based on the schema, any resolver implementations
+// will be copied through when generating and any unknown code will be moved to the end.
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/mercedtime/api/gql/internal/graph"
+	"github.com/mercedtime/api/gql/relay"
+	"github.com/mercedtime/api/users"
+)
+
+func (r *mutationResolver) Signup(ctx context.Context, input graph.SignupInput) (*graph.AuthPayload, error) {
+	var u users.User
+	if input.Name != nil {
+		u.Name = *input.Name
+	}
+	if input.Email != nil {
+		u.Email = *input.Email
+	}
+	token, expire, err := r.App.Signup(ginContext(ctx), &u, input.Password)
+	if err != nil {
+		return nil, err
+	}
+	return &graph.AuthPayload{Token: token, Expire: expire, User: &u}, nil
+}
+
+func (r *mutationResolver) Login(ctx context.Context, name string, password string) (*graph.AuthPayload, error) {
+	u, token, expire, err := r.App.Login(ginContext(ctx), name, password)
+	if err != nil {
+		return nil, err
+	}
+	return &graph.AuthPayload{Token: token, Expire: expire, User: u}, nil
+}
+
+func (r *mutationResolver) DeleteSelf(ctx context.Context) (bool, error) {
+	if err := r.App.DeleteUser(ginContext(ctx), currentUser(ctx).ID); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (r *queryResolver) Me(ctx context.Context) (*users.User, error) {
+	u, err := users.GetUserByID(r.DB, currentUser(ctx).ID)
+	if err == sql.ErrNoRows {
+		// deleted since the token was issued
+		return nil, nil
+	}
+	return u, err
+}
+
+func (r *queryResolver) Users(ctx context.Context, query *string, first *int, after *string) (*graph.UserConnection, error) {
+	p, err := relay.NewPage(first, after)
+	if err != nil {
+		return nil, err
+	}
+	var params users.SearchParams
+	if query != nil {
+		params.Query = *query
+	}
+	if f := p.Fetch(); f >= 0 {
+		l := uint(f)
+		params.Limit = &l
+	}
+	o := uint(p.Offset)
+	params.Offset = &o
+	list, _, err := users.Search(r.DB, params)
+	if err != nil {
+		return nil, err
+	}
+	return userConnection(list, p), nil
+}
+
+func (r *userResolver) ID(ctx context.Context, obj *users.User) (string, error) {
+	return relay.IntID(userNode, int64(obj.ID)), nil
+}
+
+// Mutation returns graph.MutationResolver implementation.
+func (r *Resolver) Mutation() graph.MutationResolver { return &mutationResolver{r} }
+
+// User returns graph.UserResolver implementation.
+func (r *Resolver) User() graph.UserResolver { return &userResolver{r} }
+
+type mutationResolver struct{ *Resolver }
+type userResolver struct{ *Resolver }
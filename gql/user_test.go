@@ -0,0 +1,121 @@
+package gql
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"github.com/mercedtime/api/app"
+	"github.com/mercedtime/api/gql/relay"
+	"github.com/mercedtime/api/users"
+	"github.com/ulule/limiter/v3/drivers/store/memory"
+)
+
+func TestAuth(t *testing.T) {
+	db := sqlx.NewDb(sql.OpenDB(&countingConnector{}), "postgres")
+	defer db.Close()
+	gin.SetMode(gin.TestMode)
+	a := &app.App{
+		DB:        db,
+		Config:    &app.Config{Secret: "testing-secret"},
+		RateStore: memory.NewStore(),
+	}
+	auth, err := a.NewJWTAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := gin.New()
+	r.POST("/graphql", a.OptionalAuth, testHandler(t, a))
+
+	token := func(u *users.User) string {
+		tok, _, err := auth.TokenGenerator(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok
+	}
+	var (
+		user  = token(&users.User{ID: 2, Name: "user 2"})
+		admin = token(&users.User{ID: 1, Name: "user 1", IsAdmin: true})
+		// user 2 is not an admin in the database any more
+		stale = token(&users.User{ID: 2, Name: "user 2", IsAdmin: true})
+	)
+	for _, tt := range []struct {
+		token, query string
+		code, msg    string // expected error
+		data         string // expected in the data
+	}{
+		{query: `{ me { name } }`, code: errUnauthenticated},
+		{token: user, query: `{ me { id name } }`, data: `"name":"user 2"`},
+		{token: user, query: `{ users { edges { node { name } } } }`, code: errForbidden},
+		{token: admin, query: `{ users(first: 5) { edges { node { name email } } } }`, data: `"email":"user1@example.com"`},
+		{token: stale, query: `{ users { edges { node { name } } } }`, code: errForbidden},
+		{
+			token: user,
+			query: fmt.Sprintf(`{ node(id: %q) { ... on User { name } } }`, relay.IntID("User", 2)),
+			data:  `"name":"user 2"`,
+		},
+		{
+			// only admins can see other users
+			token: user,
+			query: fmt.Sprintf(`{ node(id: %q) { id } }`, relay.IntID("User", 3)),
+			data:  `"node":null`,
+		},
+		{query: `mutation { deleteSelf }`, code: errUnauthenticated},
+		{token: user, query: `mutation { deleteSelf }`, data: `"deleteSelf":true`},
+		{
+			query: `mutation { login(name: "user 1", password: "password") { token user { name } } }`,
+			data:  `"name":"user 1"`,
+		},
+		{query: `mutation { login(name: "user 1", password: "wrong") { token } }`, msg: "incorrect"},
+		{
+			query: `mutation { signup(input: {name: "someone", password: "pw"}) { token expire user { id } } }`,
+			data:  `"token":"`,
+		},
+		{query: `mutation { signup(input: {name: "someone", password: ""}) { token } }`, msg: "no password"},
+	} {
+		data, errs := postAs(t, r, tt.token, tt.query)
+		switch {
+		case tt.code != "":
+			if len(errs) != 1 || errs[0].Extensions["code"] != tt.code {
+				t.Errorf("%s: expected a %s error, got %v", tt.query, tt.code, errs)
+			}
+		case tt.msg != "":
+			if len(errs) != 1 || !strings.Contains(errs[0].Message, tt.msg) {
+				t.Errorf("%s: expected an error with %q, got %v", tt.query, tt.msg, errs)
+			}
+		case len(errs) > 0:
+			t.Errorf("%s: unexpected errors %v", tt.query, errs)
+		case !strings.Contains(string(data), tt.data):
+			t.Errorf("%s: expected %s in %s", tt.query, tt.data, data)
+		}
+	}
+}
+
+// postAs posts a graphql query with a token.
+func postAs(t *testing.T, h http.Handler, token, query string) (json.RawMessage, []gqlError) {
+	t.Helper()
+	body, _ := json.Marshal(map[string]string{"query": query})
+	req := httptest.NewRequest("POST", "/graphql", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	var resp struct {
+		Data   json.RawMessage
+		Errors []gqlError
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%s: %v %s", query, err, rec.Body.String())
+	}
+	return resp.Data, resp.Errors
+}
@@ -0,0 +1,53 @@
+package publish
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mercedtime/api/catalog"
+)
+
+// Channel is the postgres channel notified of
+// new entries in the update log.
+const Channel = "catalog_updates"
+
+// DefaultHistory is the number of updates kept
+// in the update log when no size is given.
+const DefaultHistory = 64
+
+// Notify adds the entries to the update log and notifies the
+// instances using a postgres broadcaster once the transaction is
+// committed. The update log is pruned to the newest history updates.
+func Notify(tx sqlx.Ext, entries []*catalog.Entry, history int) (uint64, error) {
+	seq, err := Append(tx, entries, history)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("SELECT pg_notify($1, $2)", Channel, strconv.FormatUint(seq, 10))
+	return seq, err
+}
+
+// Append adds the entries to the update log without notifying
+// anyone and returns the sequence number of the update.
+func Append(db sqlx.Ext, entries []*catalog.Entry, size int) (uint64, error) {
+	if size <= 0 {
+		size = DefaultHistory
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return 0, err
+	}
+	var seq uint64
+	err = db.QueryRowx(
+		"INSERT INTO update_log (entries) VALUES ($1) RETURNING seq",
+		data,
+	).Scan(&seq)
+	if err != nil {
+		return 0, err
+	}
+	if seq > uint64(size) {
+		_, err = db.Exec("DELETE FROM update_log WHERE seq <= $1", seq-uint64(size))
+	}
+	return seq, err
+}
@@ -0,0 +1,70 @@
+// Package publish is what the api server and mtupdate share to
+// publish catalog updates: the signatures on update requests and
+// the update log that is kept in postgres.
+package publish
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Headers used to sign requests to the update endpoint.
+const (
+	SignatureHeader = "X-MT-Signature"
+	TimestampHeader = "X-MT-Timestamp"
+)
+
+// MaxSkew is the max difference between the signature
+// timestamp and the server's clock.
+const MaxSkew = time.Minute * 5
+
+var (
+	// ErrBadSignature is returned when the signature does not match.
+	ErrBadSignature = errors.New("invalid signature")
+	// ErrBadTimestamp is returned when the timestamp is too far off.
+	ErrBadTimestamp = errors.New("invalid or expired timestamp")
+)
+
+// Sign returns the hex encoded hmac-sha256 of
+// the timestamp and request body.
+func Sign(secret []byte, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest sets the signature headers on a request
+// to the update endpoint.
+func SignRequest(r *http.Request, secret []byte, body []byte) {
+	ts := time.Now().Unix()
+	r.Header.Set(TimestampHeader, strconv.FormatInt(ts, 10))
+	r.Header.Set(SignatureHeader, Sign(secret, ts, body))
+}
+
+// Verify checks the signature of an update request.
+func Verify(secret []byte, timestamp, signature string, body []byte, now time.Time) error {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrBadTimestamp
+	}
+	skew := now.Sub(time.Unix(ts, 0))
+	if skew > MaxSkew || skew < -MaxSkew {
+		return ErrBadTimestamp
+	}
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return ErrBadSignature
+	}
+	expected, _ := hex.DecodeString(Sign(secret, ts, body))
+	if !hmac.Equal(sig, expected) {
+		return ErrBadSignature
+	}
+	return nil
+}
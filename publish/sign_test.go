@@ -0,0 +1,38 @@
+package publish
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	var (
+		secret = []byte("shh")
+		body   = []byte(`[{"crn":1}]`)
+		now    = time.Unix(1614556800, 0)
+		ts     = strconv.FormatInt(now.Unix(), 10)
+		sig    = Sign(secret, now.Unix(), body)
+	)
+	for i, tst := range []struct {
+		secret    []byte
+		timestamp string
+		signature string
+		body      []byte
+		err       error
+	}{
+		{secret, ts, sig, body, nil},
+		{[]byte("wrong"), ts, sig, body, ErrBadSignature},
+		{secret, ts, sig, []byte(`[{"crn":2}]`), ErrBadSignature},
+		{secret, ts, "not hex", body, ErrBadSignature},
+		{secret, strconv.FormatInt(now.Unix()+1, 10), sig, body, ErrBadSignature},
+		{secret, strconv.FormatInt(now.Add(-time.Hour).Unix(), 10), sig, body, ErrBadTimestamp},
+		{secret, strconv.FormatInt(now.Add(time.Hour).Unix(), 10), sig, body, ErrBadTimestamp},
+		{secret, "yesterday", sig, body, ErrBadTimestamp},
+	} {
+		err := Verify(tst.secret, tst.timestamp, tst.signature, tst.body, now)
+		if err != tst.err {
+			t.Errorf("case %d: got %v, want %v", i, err, tst.err)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package users
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// SearchParams are the parameters used to search
+// for users. An empty query will match all users.
+type SearchParams struct {
+	Query  string
+	Limit  *uint
+	Offset *uint
+}
+
+const (
+	defaultLimit = 100
+	maxLimit     = 1000
+)
+
+func (p *SearchParams) limit() uint {
+	if p.Limit == nil || *p.Limit == 0 {
+		return defaultLimit
+	} else if *p.Limit > maxLimit {
+		return maxLimit
+	}
+	return *p.Limit
+}
+
+// Search will find users with a name or email that contains
+// the query. It returns the page of users and the total
+// number of users that matched.
+func Search(db *sqlx.DB, p SearchParams) ([]*User, int, error) {
+	var (
+		total   int
+		pattern = "%" + likeEscaper.Replace(p.Query) + "%"
+		list    = make([]*User, 0)
+	)
+	err := db.Get(&total, `
+	  SELECT count(*) FROM users
+	  WHERE name ILIKE $1 OR email ILIKE $1`, pattern)
+	if err != nil {
+		return nil, 0, err
+	}
+	err = db.Select(&list, `
+	  SELECT * FROM users
+	  WHERE name ILIKE $1 OR email ILIKE $1
+	  ORDER BY id
+	  LIMIT $2 OFFSET $3`, pattern, p.limit(), p.Offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, u := range list {
+		u.db = db
+	}
+	return list, total, nil
+}
+
+// likeEscaper escapes the characters that are special in
+// LIKE patterns so that the query is matched literally.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// SetAdmin will promote or demote a user.
+func SetAdmin(db *sqlx.DB, id int, admin bool) error {
+	return updateUser(db, "UPDATE users SET is_admin = $2 WHERE id = $1", id, admin)
+}
+
+// Disable will stop a user from logging in until they are enabled again.
+func Disable(db *sqlx.DB, id int) error {
+	return updateUser(db, `
+	  UPDATE users
+	  SET disabled_at = COALESCE(disabled_at, now())
+	  WHERE id = $1`, id)
+}
+
+// Enable will re-enable a disabled user.
+func Enable(db *sqlx.DB, id int) error {
+	return updateUser(db, "UPDATE users SET disabled_at = NULL WHERE id = $1", id)
+}
+
+// Lock will stop a user from logging in until some time.
+func Lock(db *sqlx.DB, id int, until time.Time) error {
+	return updateUser(db, "UPDATE users SET locked_until = $2 WHERE id = $1", id, until)
+}
+
+// Unlock will unlock a locked user and reset their failed logins.
+func Unlock(db *sqlx.DB, id int) error {
+	return updateUser(db, `
+	  UPDATE users
+	  SET locked_until = NULL, failed_logins = 0
+	  WHERE id = $1`, id)
+}
+
+// ForcePasswordReset will replace a user's password with a
+// random temporary password and mark the user as needing
+// to choose a new one. The temporary password is returned.
+func ForcePasswordReset(db *sqlx.DB, id int) (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	var (
+		password = base64.RawURLEncoding.EncodeToString(b)
+		u        = User{ID: id}
+	)
+	if err := u.setPassword(password); err != nil {
+		return "", err
+	}
+	err := updateUser(db, `
+	  UPDATE users
+	  SET hash = $2, reset_required = true
+	  WHERE id = $1`, id, u.Hash)
+	if err != nil {
+		return "", err
+	}
+	return password, nil
+}
+
+func updateUser(db *sqlx.DB, query string, args ...interface{}) error {
+	var (
+		res sql.Result
+		err error
+	)
+	if res, err = db.Exec(query, args...); err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package users
+
+import "testing"
+
+func TestLikeEscaper(t *testing.T) {
+	for in, exp := range map[string]string{
+		"jim":        "jim",
+		"100%":       `100\%`,
+		"first_last": `first\_last`,
+		`a\b`:        `a\\b`,
+		`\%_`:        `\\\%\_`,
+	} {
+		if got := likeEscaper.Replace(in); got != exp {
+			t.Errorf("%q: got %q, want %q", in, got, exp)
+		}
+	}
+}
+
+func TestSearchLimit(t *testing.T) {
+	uptr := func(u uint) *uint { return &u }
+	for _, tst := range []struct {
+		limit *uint
+		exp   uint
+	}{
+		{nil, defaultLimit},
+		{uptr(0), defaultLimit},
+		{uptr(20), 20},
+		{uptr(maxLimit), maxLimit},
+		{uptr(maxLimit + 1), maxLimit},
+	} {
+		p := SearchParams{Limit: tst.limit}
+		if got := p.limit(); got != tst.exp {
+			t.Errorf("got limit %d, want %d", got, tst.exp)
+		}
+	}
+}
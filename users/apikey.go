@@ -0,0 +1,140 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// APIKeyPrefix is prepended to every generated api key so
+// that they are easy to recognize.
+const APIKeyPrefix = "mt_"
+
+// APIKey is a key that a third-party client can use to
+// access the api on behalf of a user.
+type APIKey struct {
+	ID     int    `db:"id" json:"id"`
+	UserID int    `db:"user_id" json:"user_id"`
+	Name   string `db:"name" json:"name"`
+	// Prefix is the first few characters of the key so
+	// users can tell their keys apart.
+	Prefix string `db:"prefix" json:"prefix"`
+	Hash   string `db:"hash" json:"-"`
+	// RateLimit is the number of requests per second
+	RateLimit int64 `db:"rate_limit" json:"rate_limit"`
+	// DailyQuota is the number of requests allowed per day
+	DailyQuota int64      `db:"daily_quota" json:"daily_quota"`
+	CreatedAt  time.Time  `db:"created_at" json:"created_at"`
+	RevokedAt  *time.Time `db:"revoked_at" json:"revoked_at,omitempty"`
+}
+
+// CreateAPIKey will generate a new api key, store the key's hash in
+// the database, and return the raw key. The raw key cannot be
+// recovered after this.
+func CreateAPIKey(db *sqlx.DB, k *APIKey) (string, error) {
+	raw, err := generateAPIKey()
+	if err != nil {
+		return "", err
+	}
+	k.Prefix = raw[:len(APIKeyPrefix)+8]
+	k.Hash = hashToken(raw)
+	query, args, err := db.BindNamed(`
+	  INSERT INTO
+	    api_keys (user_id, name, prefix, hash, rate_limit, daily_quota)
+	  VALUES (:user_id, :name, :prefix, :hash, :rate_limit, :daily_quota)
+	  RETURNING *`, k)
+	if err != nil {
+		return "", err
+	}
+	if err = db.QueryRowx(query, args...).StructScan(k); err != nil {
+		return "", err
+	}
+	return raw, nil
+}
+
+// GetAPIKey will find an active api key given the raw key.
+func GetAPIKey(db *sqlx.DB, raw string) (*APIKey, error) {
+	if !strings.HasPrefix(raw, APIKeyPrefix) {
+		return nil, ErrAPIKeyNotFound
+	}
+	var k APIKey
+	err := db.Get(&k, `
+	  SELECT * FROM api_keys
+	  WHERE
+	    hash = $1 AND
+	    revoked_at IS NULL`, hashToken(raw))
+	if err == sql.ErrNoRows {
+		return nil, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// GetAPIKeys will get all the active api keys owned by a user.
+func GetAPIKeys(db *sqlx.DB, userID int) ([]*APIKey, error) {
+	keys := make([]*APIKey, 0)
+	err := db.Select(&keys, `
+	  SELECT * FROM api_keys
+	  WHERE
+	    user_id = $1 AND
+	    revoked_at IS NULL
+	  ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey will revoke a user's api key so that it
+// can no longer be used.
+func RevokeAPIKey(db *sqlx.DB, userID, keyID int) error {
+	res, err := db.Exec(`
+	  UPDATE api_keys
+	    SET revoked_at = now()
+	  WHERE
+	    id = $1 AND
+	    user_id = $2 AND
+	    revoked_at IS NULL`, keyID, userID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+func generateAPIKey() (string, error) {
+	tok, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	return APIKeyPrefix + tok, nil
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Api keys and tokens are long random strings so they don't
+// need to be hashed with a slow algorithm like bcrypt.
+func hashToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
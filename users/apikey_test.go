@@ -0,0 +1,32 @@
+package users
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGenerateAPIKey(t *testing.T) {
+	a, err := generateAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := generateAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b {
+		t.Error("generated the same key twice")
+	}
+	if !strings.HasPrefix(a, APIKeyPrefix) {
+		t.Errorf("key %q should start with %q", a, APIKeyPrefix)
+	}
+	if hashToken(a) != hashToken(a) {
+		t.Error("key hash should be deterministic")
+	}
+	if hashToken(a) == hashToken(b) {
+		t.Error("different keys should have different hashes")
+	}
+	if len(hashToken(a)) != 64 {
+		t.Error("hash should fit in the api_keys.hash column")
+	}
+}
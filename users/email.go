@@ -0,0 +1,75 @@
+package users
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// RequestEmailChange stores a pending email change for the user and
+// returns the token needed to verify it. Any older pending changes
+// for the user are thrown away.
+func RequestEmailChange(db *sqlx.DB, userID int, email string, ttl time.Duration) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec("DELETE FROM email_verifications WHERE user_id = $1", userID); err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(`
+	  INSERT INTO
+	    email_verifications (token_hash, user_id, email, expires_at)
+	  VALUES ($1, $2, $3, $4)`,
+		hashToken(token), userID, email, time.Now().Add(ttl))
+	if err != nil {
+		return "", err
+	}
+	return token, tx.Commit()
+}
+
+// ConfirmEmailChange will use a verification token to
+// change a user's email and return the updated user.
+func ConfirmEmailChange(db *sqlx.DB, token string) (*User, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	var change struct {
+		UserID int    `db:"user_id"`
+		Email  string `db:"email"`
+	}
+	err = tx.Get(&change, `
+	  DELETE FROM email_verifications
+	  WHERE
+	    token_hash = $1 AND
+	    expires_at > now()
+	  RETURNING user_id, email`, hashToken(token))
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	u := &User{}
+	err = tx.QueryRowx(`
+	  UPDATE users
+	  SET email = $2, email_verified_at = now()
+	  WHERE id = $1
+	  RETURNING *`, change.UserID, change.Email).StructScan(u)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	u.db = db
+	return u, tx.Commit()
+}
@@ -8,4 +8,14 @@ var (
 	ErrUserNotFound = errors.New("user not found")
 	// ErrInvalidUser is returned when the user given is not valid
 	ErrInvalidUser = errors.New("invalid user")
+	// ErrAPIKeyNotFound is returned when an api key does not
+	// exist or has been revoked.
+	ErrAPIKeyNotFound = errors.New("api key not found")
+	// ErrUserDisabled is returned when a disabled user tries to log in.
+	ErrUserDisabled = errors.New("account disabled")
+	// ErrUserLocked is returned when a locked user tries to log in.
+	ErrUserLocked = errors.New("account locked")
+	// ErrInvalidToken is returned when a verification
+	// token does not exist or has expired.
+	ErrInvalidToken = errors.New("invalid or expired token")
 )
@@ -0,0 +1,69 @@
+package users
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Identity links a user to an account with
+// an external identity provider.
+type Identity struct {
+	Issuer    string    `db:"issuer" json:"issuer"`
+	Subject   string    `db:"subject" json:"subject"`
+	UserID    int       `db:"user_id" json:"user_id"`
+	Email     string    `db:"email" json:"email,omitempty"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// LinkIdentity will store the link between a user
+// and an external identity.
+func LinkIdentity(db *sqlx.DB, id *Identity) error {
+	query, args, err := db.BindNamed(`
+	  INSERT INTO
+	    user_identities (issuer, subject, user_id, email)
+	  VALUES (:issuer, :subject, :user_id, :email)
+	  RETURNING *`, id)
+	if err != nil {
+		return err
+	}
+	return db.QueryRowx(query, args...).StructScan(id)
+}
+
+// GetUserByIdentity will find the user that has been linked
+// to an identity from an external provider.
+func GetUserByIdentity(db *sqlx.DB, issuer, subject string) (*User, error) {
+	u, err := getUser(db, `
+	  SELECT users.* FROM users
+	  JOIN user_identities i ON i.user_id = users.id
+	  WHERE
+	    i.issuer = $1 AND
+	    i.subject = $2`, issuer, subject)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	return u, err
+}
+
+// GetVerifiedUserByEmail will get the oldest user that has
+// verified an email address.
+func GetVerifiedUserByEmail(db *sqlx.DB, email string) (*User, error) {
+	var query = `
+	  SELECT * FROM users
+	  WHERE
+	    email = $1 AND
+	    email_verified_at IS NOT NULL
+	  ORDER BY id LIMIT 1`
+	u, err := getUser(db, query, email)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	return u, err
+}
+
+// VerifyEmail marks a user's current email address as verified.
+func VerifyEmail(db *sqlx.DB, id int) error {
+	_, err := db.Exec("UPDATE users SET email_verified_at = now() WHERE id = $1", id)
+	return err
+}
@@ -0,0 +1,31 @@
+package users
+
+import (
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// LoginFailed records a failed login for the user and
+// returns the number of failed logins in a row.
+func LoginFailed(db *sqlx.DB, id int) (int, error) {
+	var n int
+	err := db.Get(&n, `
+	  UPDATE users
+	  SET failed_logins = failed_logins + 1
+	  WHERE id = $1
+	  RETURNING failed_logins`, id)
+	if err == sql.ErrNoRows {
+		return 0, ErrUserNotFound
+	}
+	return n, err
+}
+
+// LoginSucceeded resets the user's failed logins.
+func LoginSucceeded(db *sqlx.DB, id int) error {
+	_, err := db.Exec(`
+	  UPDATE users
+	  SET failed_logins = 0
+	  WHERE id = $1 AND failed_logins > 0`, id)
+	return err
+}
@@ -9,6 +9,17 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+var cost = bcrypt.DefaultCost
+
+// SetCost sets the bcrypt cost used when hashing passwords.
+func SetCost(c int) error {
+	if c < bcrypt.MinCost || c > bcrypt.MaxCost {
+		return bcrypt.InvalidCostError(c)
+	}
+	cost = c
+	return nil
+}
+
 // User is a user model
 type User struct {
 	ID        int       `db:"id" json:"id"`
@@ -17,7 +28,23 @@ type User struct {
 	IsAdmin   bool      `db:"is_admin" json:"is_admin"`
 	CreatedAt time.Time `db:"created_at" json:"created_at"`
 	Hash      []byte    `db:"hash" json:"-"`
-	db        *sqlx.DB  `db:"-" json:"-"`
+
+	// DisabledAt is set when an admin disables the account.
+	DisabledAt *time.Time `db:"disabled_at" json:"disabled_at,omitempty"`
+	// LockedUntil stops the user from logging in until
+	// the time has passed.
+	LockedUntil *time.Time `db:"locked_until" json:"locked_until,omitempty"`
+	// ResetRequired is set when the user has been given
+	// a temporary password and should choose a new one.
+	ResetRequired bool `db:"reset_required" json:"reset_required"`
+	// FailedLogins is the number of failed logins
+	// since the last successful login.
+	FailedLogins int `db:"failed_logins" json:"failed_logins"`
+	// EmailVerifiedAt is set once the user has shown
+	// that they own their email address.
+	EmailVerifiedAt *time.Time `db:"email_verified_at" json:"email_verified_at,omitempty"`
+
+	db *sqlx.DB `db:"-" json:"-"`
 }
 
 // Create will create a user
@@ -59,9 +86,9 @@ func GetUserByName(db *sqlx.DB, name string) (*User, error) {
 	return getUser(db, query, name)
 }
 
-func getUser(db *sqlx.DB, query string, cond interface{}) (*User, error) {
+func getUser(db *sqlx.DB, query string, cond ...interface{}) (*User, error) {
 	u := &User{}
-	err := db.QueryRowx(query, cond).StructScan(u)
+	err := db.QueryRowx(query, cond...).StructScan(u)
 	if err != nil {
 		return nil, err
 	}
@@ -121,7 +148,11 @@ func (u *User) Save() error {
 		  name = :name,
 		  email = :email,
 		  is_admin = :is_admin,
-		  hash = :hash
+		  hash = :hash,
+		  reset_required = :reset_required,
+		  email_verified_at = CASE
+		    WHEN email = :email THEN email_verified_at
+		  END
 		WHERE id = :id`,
 		u,
 	)
@@ -135,6 +166,53 @@ func (u *User) PasswordOK(pw string) (ok bool) {
 	return err == nil
 }
 
+// Disabled returns true if the account has been disabled.
+func (u *User) Disabled() bool {
+	return u.DisabledAt != nil
+}
+
+// EmailVerified returns true if the user's email address
+// has been verified.
+func (u *User) EmailVerified() bool {
+	return u.EmailVerifiedAt != nil
+}
+
+// Locked returns true if the account is currently locked.
+func (u *User) Locked() bool {
+	return u.LockedUntil != nil && u.LockedUntil.After(time.Now())
+}
+
+// SetPassword will change the user's password. Call
+// Save to store the new password.
+func (u *User) SetPassword(pw string) error {
+	if pw == "" {
+		return errors.New("empty password")
+	}
+	if err := u.setPassword(pw); err != nil {
+		return err
+	}
+	u.ResetRequired = false
+	return nil
+}
+
+// NeedsRehash returns true if the stored password hash
+// was made with a lower cost than the current bcrypt cost.
+func (u *User) NeedsRehash() bool {
+	c, err := bcrypt.Cost(u.Hash)
+	return err == nil && c < cost
+}
+
+// Rehash will hash the password again using the current bcrypt
+// cost and save the new hash. The password should be checked
+// with PasswordOK first.
+func (u *User) Rehash(pw string) error {
+	if err := u.setPassword(pw); err != nil {
+		return err
+	}
+	_, err := u.db.Exec("UPDATE users SET hash = $2 WHERE id = $1", u.ID, u.Hash)
+	return err
+}
+
 // SetDB allows callers to set the internal
 // database field on the user struct
 func (u *User) SetDB(db *sqlx.DB) {
@@ -142,7 +220,7 @@ func (u *User) SetDB(db *sqlx.DB) {
 }
 
 func (u *User) setPassword(pw string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(pw), bcrypt.DefaultCost)
+	hash, err := bcrypt.GenerateFromPassword([]byte(pw), cost)
 	if err != nil {
 		return err
 	}
@@ -1,6 +1,10 @@
 package users
 
-import "testing"
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
 
 func TestCreateUser(t *testing.T) {
 	u := User{
@@ -21,3 +25,32 @@ func TestCreateUser(t *testing.T) {
 		t.Error("password hasing failed")
 	}
 }
+
+func TestNeedsRehash(t *testing.T) {
+	defer SetCost(bcrypt.DefaultCost)
+	if err := SetCost(bcrypt.MaxCost + 1); err == nil {
+		t.Error("expected an error for an invalid cost")
+	}
+	if err := SetCost(bcrypt.MinCost + 1); err != nil {
+		t.Fatal(err)
+	}
+	u := User{Name: "test"}
+	if err := u.setPassword("password1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tst := range []struct {
+		cost int
+		exp  bool
+	}{
+		{bcrypt.MinCost, false},
+		{bcrypt.MinCost + 1, false},
+		{bcrypt.MinCost + 2, true},
+	} {
+		if err := SetCost(tst.cost); err != nil {
+			t.Fatal(err)
+		}
+		if u.NeedsRehash() != tst.exp {
+			t.Errorf("cost %d: expected NeedsRehash to be %v", tst.cost, tst.exp)
+		}
+	}
+}